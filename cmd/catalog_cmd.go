@@ -0,0 +1,73 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var catalogImagesFile string
+var catalogVersion string
+
+// catalogCmd represents the catalog command
+var catalogCmd = &cobra.Command{
+	Use:   "catalog <cloud> <region>.json...",
+	Short: "Regenerate the offline catalog of VM sizes, regions & images of a cloud",
+	Long: `Regenerate the offline catalog the infra entries are validated against,
+from data files exported from the cloud, and write it to catalog/<cloud>.json,
+which replaces the catalog shipped with ephstack. For azure:
+
+  az vm list-sizes --location westus --output json > westus.json
+  az vm image list --all --output json > images.json
+  ephstack catalog azure westus.json eastus.json --images images.json`,
+
+	Args:         cobra.MinimumNArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		catalog, err := ephstack.RegenerateCatalog(args[0], catalogVersion, args[1:], catalogImagesFile)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(catalog, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(ephstack.CatalogDir, 0755); err != nil {
+			return err
+		}
+		fileName := filepath.Join(ephstack.CatalogDir, catalog.Cloud+".json")
+		if err := os.WriteFile(fileName, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s: %d sizes in %d regions, %d images, version %s\n",
+			fileName, len(catalog.Sizes), len(catalog.Regions), len(catalog.Images), catalog.Version)
+		return nil
+	},
+}
+
+func init() {
+	catalogCmd.Flags().StringVar(&catalogImagesFile, "images", "", "images exported from the cloud, e.g. by 'az vm image list --all --output json'")
+	catalogCmd.Flags().StringVar(&catalogVersion, "version", time.Now().Format("2006-01-02"), "version of the catalog")
+	rootCmd.AddCommand(catalogCmd)
+}
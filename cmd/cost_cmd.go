@@ -0,0 +1,56 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// costCmd represents the cost command
+var costCmd = &cobra.Command{
+	Use:   "cost <stack file>",
+	Short: "Estimate the hourly and monthly spend of the stack",
+	Long: `Estimate the hourly and monthly spend of each app of the stack and of the
+whole stack, from the sizes, data disks and public IPs of its infra and the
+local price table of its cloud, catalog/<cloud>-prices.json, else the one
+shipped with ephstack. The stack's budget is shown when it has one: deploy
+refuses to run when the estimate exceeds it, or --max-cost.`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := parse(args[0]); err != nil {
+			return err
+		}
+		cost, err := ephstack.EstimateCost()
+		if err != nil {
+			return err
+		}
+		ephstack.PrintCost(cost)
+		if ephstack.StackInstance.Budget > 0 {
+			fmt.Printf("budget: %.2f %s a month\n", ephstack.StackInstance.Budget, cost.Currency)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(costCmd)
+}
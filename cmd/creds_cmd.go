@@ -0,0 +1,105 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var credsExport bool
+var credsYes bool
+
+// credsCmd represents the creds command
+var credsCmd = &cobra.Command{
+	Use:   "creds <stack> <app>",
+	Short: "Print the login credentials of an app of a deployed stack",
+	Long: `Print the login credentials of an app of a deployed stack, of its first host,
+or of one of its hosts <app>-<index>, e.g. app2-1.
+
+The credentials are secrets, so they are only printed after a confirmation.
+With --export they are printed as shell exports, e.g.
+
+  eval "$(ephstack creds --export stack1 app1)"`,
+
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stackName, appName := args[0], args[1]
+
+		if err := resolveBackend(stackName); err != nil {
+			return err
+		}
+		outs, err := ephstack.StackOutputs(stackName)
+		if err != nil {
+			return err
+		}
+		ip, err := ephstack.AppIPAddress(outs, appName)
+		if err != nil {
+			return err
+		}
+
+		if !credsYes && !confirm("Print the secret credentials of "+appName+" in stack "+stackName+"?") {
+			return errors.New("not confirmed, credentials were not printed")
+		}
+
+		creds := ephstack.AppCredentials(outs, appName)
+		if credsExport {
+			fmt.Printf("export EPHSTACK_HOST=%s\n", shellQuote(ip))
+			fmt.Printf("export EPHSTACK_USERNAME=%s\n", shellQuote(creds.Username))
+			fmt.Printf("export EPHSTACK_PASSWORD=%s\n", shellQuote(creds.Password))
+			fmt.Printf("export EPHSTACK_PRIVATE_KEY=%s\n", shellQuote(creds.Private_key))
+			return nil
+		}
+		fmt.Println("Host:       ", ip)
+		fmt.Println("Username:   ", creds.Username)
+		fmt.Println("Password:   ", creds.Password)
+		fmt.Println("Private key:")
+		fmt.Print(creds.Private_key)
+		return nil
+	},
+}
+
+// shellQuote quotes a value for a POSIX shell: nothing is expanded between single quotes,
+// newlines included, and a single quote is written as '\''
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// confirm asks a yes/no question on stderr, so it doesn't end up in exported output
+func confirm(question string) bool {
+	fmt.Fprint(os.Stderr, question+" [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func init() {
+	rootCmd.AddCommand(credsCmd)
+
+	credsCmd.Flags().BoolVar(&credsExport, "export", false, "print the credentials as shell exports")
+	credsCmd.Flags().BoolVarP(&credsYes, "yes", "y", false, "skip the confirmation")
+}
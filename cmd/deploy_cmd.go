@@ -34,38 +34,106 @@ var deployCmd = &cobra.Command{
 	Short: "Deploy the app(s) specified in the stack file",
 
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	// errors are reported with the exit code of their kind, see the root command
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			err := errors.New("<stack file> was not specified")
-			cobra.CheckErr(err)
+			return err
 		}
 		stackFile := args[0]
 		// read in the stack file.
 		_, err := os.Open(stackFile)
-		cobra.CheckErr(err)
+		if err != nil {
+			return ephstack.NewError(ephstack.ParseError, "open stack file", err)
+		}
+		return nil
 	},
-	PostRun: func(cmd *cobra.Command, args []string) {
+	PostRunE: func(cmd *cobra.Command, args []string) error {
 		// pass the stack file name to the populate the data structures & deploy
 		if err := parse(args[0]); err != nil {
-			cobra.CheckErr(err)
+			return err
+		}
+		if deployMock {
+			return runMock()
 		}
+		// nothing is provisioned if the stack breaks a policy or would cost more than its budget
+		if err := ephstack.EnforcePolicies(os.Stderr); err != nil {
+			return err
+		}
+		if err := ephstack.CheckBudget(deployMaxCost); err != nil {
+			return err
+		}
+		return ephstack.ProvisionInfrastructure()
 	},
 }
 
+// run the stack's programs against the pulumi mocks instead of the cloud
+var deployMock bool
+
+// the most the stack may cost a month, overrides its budget
+var deployMaxCost float64
+
+func runMock() error {
+	resources, err := ephstack.MockDeploy()
+	if err != nil {
+		return err
+	}
+	return ephstack.PrintMockReport(os.Stdout, resources)
+}
+
+// the interpolator of the parsed stack file, the config files are resolved with its vars
+var interpolator *ephstack.Interpolator
+
 func parseStackFile(stackFileName string) error {
 
-	// set the stack file that viper needs to parse 
-	viper.SetConfigFile(stackFileName)
+	// the stack file with its fragments included and its apps extended
+	settings, err := readStackSettings(stackFileName, nil)
+	if err != nil {
+		return err
+	}
+	if err := ephstack.ResolveExtends(settings, stackFileName); err != nil {
+		return err
+	}
+
+	// resolve the ${...} references before reading any value, the stack name first as
+	// the vars: defaults may refer to it; it can only refer to the vars of --set
+	nameInterp, err := ephstack.NewInterpolator(stackFileName, "", nil)
+	if err != nil {
+		return err
+	}
+	stackName, _ := settings["stack"].(map[string]interface{})["name"].(string)
+	stackName = nameInterp.String(stackName, stackFileName+": stack.name", nil)
+	if err := nameInterp.Err(); err != nil {
+		return err
+	}
+	vars, _ := settings["stack"].(map[string]interface{})["vars"].(map[string]interface{})
+	interp, err := ephstack.NewInterpolator(stackFileName, stackName, vars)
+	if err != nil {
+		return err
+	}
+	settings = interp.Settings(settings, stackFileName)
+	if err := interp.Err(); err != nil {
+		return err
+	}
+	interpolator = interp
 
-	// If a config file is found, read it in.
-	yamlData, _ := os.Open(stackFileName)
-	if err := viper.ReadConfig(yamlData); err != nil {
+	// viper only reads the resolved settings from now on
+	viper.Reset()
+	viper.SetConfigFile(stackFileName)
+	if err := viper.MergeConfigMap(settings); err != nil {
 		return errors.New("Unable to parse " + stackFileName)
 	}
 
 	var stackInstance =  new(ephstack.StackType)
 	fmt.Fprintln(os.Stderr, "Reading stack file:", viper.ConfigFileUsed())
 	stackInstance.Id = viper.GetString("stack.name")
+	stackInstance.Env = ephstack.Environment
+	stackInstance.TTL = viper.GetDuration("stack.ttl")
+	stackInstance.Budget = viper.GetFloat64("stack.budget")
+	if vNetworkTree := viper.Sub("stack.network"); vNetworkTree != nil {
+		stackInstance.Network = parseNetwork(vNetworkTree)
+	}
 
 	// walk thru the 'apps' decls
 	vAppInstancesTree := viper.Sub("stack.apps")
@@ -84,36 +152,259 @@ func parseStackFile(stackFileName string) error {
 				Creds:       ephstack.Credentials{Username: "", Password: "", Private_key: ""},
 				Config:      "",
                 Facts:       make(map[string]string),
+				Tags:        make(map[string]string),
+				Count:       1,
 			}
-		}
-		switch keyValPair[1] {
-		case "config":
-			appInst.Config = vAppInstancesTree.Get(keyVal).(string)
-			appInstances[keyValPair[0]] = appInst
-		case "infra":
-			appInst.Infra = vAppInstancesTree.Get(keyVal).(string)
 			appInstances[keyValPair[0]] = appInst
-		case "facts":
-            var factsMap map[string]string = make(map[string]string) 
-            for key,value := range vAppInstancesTree.Get(keyVal).([]interface{}) {
-                var strKey string   = fmt.Sprintf("%v", key)
-                var strValue string = fmt.Sprintf("%v", value)
-                factsMap[strKey] = strValue
-            }
-            appInst.Facts = factsMap
-            appInstances[keyValPair[0]] = appInst
-		default:
-            err := errors.New("unexpected App instance value '" + keyValPair[1] + "' found in " + stackFileName)
+		}
+		if err := parseAppKey(appInst, vAppInstancesTree, keyVal, stackFileName); err != nil {
 			return err
 		}
 	}
 
+	// the selected environment overrides the apps & ttl of the base stack
+	if err := parseEnvironment(stackInstance, appInstances, stackFileName); err != nil {
+		return err
+	}
+
 	// Save the stack info
 	stackInstance.AppInstances = appInstances
 	ephstack.StackInstance = stackInstance
 	return nil 
 }
 
+// readStackSettings reads a stack file, or a fragment, and the fragments it lists under
+// stack.include, relative to it. The file's own settings are merged onto the ones it includes.
+// included holds the files being read, to detect include cycles.
+func readStackSettings(stackFileName string, included []string) (map[string]interface{}, error) {
+	for _, seen := range included {
+		if seen == stackFileName {
+			return nil, errors.New("include cycle " + strings.Join(append(included, stackFileName), " -> "))
+		}
+	}
+	included = append(included, stackFileName)
+
+	v := viper.New()
+	v.SetConfigFile(stackFileName)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.New("Unable to parse " + stackFileName)
+	}
+	settings := v.AllSettings()
+	stack, ok := settings["stack"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Malformed YAML file. Unable to parse " + stackFileName)
+	}
+
+	// user_data is relative to the file that declares it
+	for _, declsKey := range []string{"apps", "bases"} {
+		decls, _ := stack[declsKey].(map[string]interface{})
+		for _, decl := range decls {
+			fields, _ := decl.(map[string]interface{})
+			if userData, ok := fields["user_data"].(string); ok && len(included) > 1 && !filepath.IsAbs(userData) {
+				fields["user_data"], _ = filepath.Abs(filepath.Join(filepath.Dir(stackFileName), userData))
+			}
+		}
+	}
+
+	merged := make(map[string]interface{})
+	for _, fragment := range v.GetStringSlice("stack.include") {
+		if !filepath.IsAbs(fragment) {
+			fragment = filepath.Join(filepath.Dir(stackFileName), fragment)
+		}
+		fragmentSettings, err := readStackSettings(fragment, included)
+		if err != nil {
+			return nil, err
+		}
+		merged = ephstack.MergeSettings(merged, fragmentSettings)
+	}
+	merged = ephstack.MergeSettings(merged, settings)
+	delete(merged["stack"].(map[string]interface{}), "include")
+	return merged, nil
+}
+
+// parseAppKey sets one "<app>.<key>" value of an app decl
+func parseAppKey(appInst *ephstack.AppInstanceType, vAppTree *viper.Viper, keyVal string, stackFileName string) error {
+	var keyValPair []string = strings.Split(keyVal, ".") // viper returns "app1.config"
+	switch keyValPair[1] {
+	case "config":
+		appInst.Config = vAppTree.Get(keyVal).(string)
+	case "infra":
+		appInst.Infra = vAppTree.Get(keyVal).(string)
+	case "facts":
+		// merged, so an environment only needs to list the facts it changes
+		for key, value := range ephstack.FlattenMapList(vAppTree.Get(keyVal)) {
+			appInst.Facts[key] = value
+		}
+	case "secret_facts":
+		appInst.SecretFacts = vAppTree.GetStringSlice(keyVal)
+	case "password_auth":
+		appInst.PasswordAuth = vAppTree.GetBool(keyVal)
+	case "subnet":
+		// viper lower cases the subnet names of the network section
+		appInst.Subnet = strings.ToLower(vAppTree.GetString(keyVal))
+	case "public_ip":
+		appInst.PublicIP = strings.ToLower(vAppTree.GetString(keyVal))
+	case "dns_label":
+		appInst.DNSLabel = vAppTree.GetString(keyVal)
+	case "user_data":
+		// relative to the stack file, like the stack's other files
+		appInst.UserData = vAppTree.GetString(keyVal)
+		if !filepath.IsAbs(appInst.UserData) {
+			appInst.UserData = filepath.Join(filepath.Dir(stackFileName), appInst.UserData)
+		}
+	case "tags":
+		// merged, like the facts
+		for key, value := range ephstack.FlattenMapList(vAppTree.Get(keyVal)) {
+			appInst.Tags[key] = value
+		}
+	case "count":
+		appInst.Count = vAppTree.GetInt(keyVal)
+	case "size":
+		// a portable size like medium, or a requirement like { cpus: 4, memory_gb: 16 }
+		if len(keyValPair) == 2 {
+			appInst.Size = strings.ToLower(vAppTree.GetString(keyVal))
+			break
+		}
+		if appInst.SizeRequirement == nil {
+			appInst.SizeRequirement = &ephstack.SizeRequirementType{}
+		}
+		switch keyValPair[2] {
+		case "cpus":
+			appInst.SizeRequirement.CPUs = vAppTree.GetInt(keyVal)
+		case "memory_gb":
+			appInst.SizeRequirement.MemoryGB = vAppTree.GetFloat64(keyVal)
+		default:
+			return errors.New("unexpected size requirement '" + keyValPair[2] + "' of app '" + keyValPair[0] + "' found in " + stackFileName)
+		}
+	case "image":
+		appInst.Image = strings.ToLower(vAppTree.GetString(keyVal))
+	case "cloud":
+		appInst.Cloud = strings.ToLower(vAppTree.GetString(keyVal))
+	case "ports":
+		ports, err := parsePorts(vAppTree.Get(keyVal))
+		if err != nil {
+			return errors.New("app '" + keyValPair[0] + "' in " + stackFileName + ": " + err.Error())
+		}
+		appInst.Ports = ports
+	default:
+		err := errors.New("unexpected App instance value '" + keyValPair[1] + "' found in " + stackFileName)
+		return err
+	}
+	return nil
+}
+
+// parseEnvironment applies the 'environments.<env>' section of the stack file, e.g.
+//
+//	environments:
+//	  qa:
+//	    ttl: 24h
+//	    apps:
+//	      app1:
+//	        infra: azure_centos7_Standard_DS2_v2
+func parseEnvironment(stackInstance *ephstack.StackType, appInstances map[string]*ephstack.AppInstanceType, stackFileName string) error {
+	envName := stackInstance.Env
+	vEnvTree := viper.Sub("stack.environments." + envName)
+	if vEnvTree == nil {
+		if envName == ephstack.DefaultEnvironment {
+			return nil
+		}
+		return errors.New("environment '" + envName + "' is not declared in " + stackFileName)
+	}
+
+	if vEnvTree.IsSet("ttl") {
+		stackInstance.TTL = vEnvTree.GetDuration("ttl")
+	}
+	if vEnvTree.IsSet("budget") {
+		stackInstance.Budget = vEnvTree.GetFloat64("budget")
+	}
+	// an environment replaces the whole network layout, e.g. to use its own address space
+	if vNetworkTree := vEnvTree.Sub("network"); vNetworkTree != nil {
+		stackInstance.Network = parseNetwork(vNetworkTree)
+	}
+
+	vEnvAppsTree := vEnvTree.Sub("apps")
+	if vEnvAppsTree == nil {
+		return nil
+	}
+	for _, keyVal := range vEnvAppsTree.AllKeys() {
+		appName := strings.Split(keyVal, ".")[0]
+		appInst := appInstances[appName]
+		if appInst == nil {
+			return errors.New("environment '" + envName + "' overrides unknown app '" + appName + "' in " + stackFileName)
+		}
+		if err := parseAppKey(appInst, vEnvAppsTree, keyVal, stackFileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePorts reads the 'ports' list of an app, e.g.
+//
+//	ports:
+//	  - port: 5432
+//	    from: [app2]
+//	  - port: 8000-8080
+//	    protocol: udp
+//	    from: [10.0.0.0/8, 192.168.1.0/24]
+func parsePorts(value interface{}) ([]ephstack.PortRuleType, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("'ports' must be a list")
+	}
+	ports := make([]ephstack.PortRuleType, 0, len(items))
+	for _, item := range items {
+		fields := make(map[string]interface{})
+		switch v := item.(type) {
+		case map[string]interface{}:
+			fields = v
+		case map[interface{}]interface{}:
+			for key, value := range v {
+				fields[fmt.Sprintf("%v", key)] = value
+			}
+		default:
+			return nil, errors.New("'ports' entries must have a port and its sources")
+		}
+
+		rule := ephstack.PortRuleType{}
+		for key, value := range fields {
+			switch key {
+			case "port":
+				rule.Port = fmt.Sprintf("%v", value)
+			case "protocol":
+				rule.Protocol = strings.ToLower(fmt.Sprintf("%v", value))
+			case "from":
+				if sources, ok := value.([]interface{}); ok {
+					for _, source := range sources {
+						rule.From = append(rule.From, fmt.Sprintf("%v", source))
+					}
+				} else {
+					rule.From = []string{fmt.Sprintf("%v", value)}
+				}
+			default:
+				return nil, errors.New("unexpected port value '" + key + "'")
+			}
+		}
+		ports = append(ports, rule)
+	}
+	return ports, nil
+}
+
+// parseNetwork reads a 'network' section of a stack or config file, e.g.
+//
+//	network:
+//	  resource_group: tiered-rg
+//	  address_space: [10.1.0.0/16]
+//	  subnets:
+//	    web: 10.1.1.0/24
+//	    db: 10.1.2.0/24
+func parseNetwork(vNetworkTree *viper.Viper) *ephstack.NetworkType {
+	return ephstack.NewNetwork(
+		vNetworkTree.GetString("resource_group"),
+		vNetworkTree.GetStringSlice("address_space"),
+		vNetworkTree.GetStringMapString("subnets"))
+}
+
 func parseConfigFiles() error {
 
 	// parse all the config files 
@@ -139,6 +430,8 @@ func parseConfigFiles() error {
 
 	// a map to store all the cloud infra settings 
 	infraHWInstancesMap := &ephstack.InfraHWInstancesMapType{}
+	// the config file that set the state backend
+	backendFileName := ""
 
 	for _,configFileName := range configFileNames {
 		viper.SetConfigFile(configFileName)
@@ -147,83 +440,177 @@ func parseConfigFiles() error {
 			err1 := errors.New("unable to read config file" + configFileName)
 			return err1
 		}
+		settings := interpolator.Settings(viper.AllSettings(), configFileName)
+		if err := interpolator.Err(); err != nil {
+			return err
+		}
+		if err := viper.MergeConfigMap(settings); err != nil {
+			return errors.New("unable to read config file" + configFileName)
+		}
 
-		vConfigTree := viper.Sub("config.infra")
-		if vConfigTree == nil {
+		if !viper.IsSet("config.infra") {
 			err = errors.New("config file: " + configFileName + " YAML syntax is not correct")
 			return err
 		}
-		
-		// per cloud map 
-		infraHWMap := &ephstack.InfraHWInstMapType{}
-		(*infraHWInstancesMap)[viper.GetString("config.cloud")] = infraHWMap
-		
-		for _, keyVal := range vConfigTree.AllKeys() {
-			var keyValPair []string = strings.Split(keyVal, ".") // viper returns "<key>.size"
-
-			// each cloud config stack is stored in InfraHwType  objects 
-			var infraHWInst *ephstack.InfraHwType = (*infraHWMap)[keyValPair[0]]
-		    if infraHWInst == nil { // uninitalized
-		        infraHWInst = &ephstack.InfraHwType {
-					Name       : "",
-					Region     : "", 
-					Type       : "",
-					Image      : "",
-					Disks      : make([]string,0),
-		            Tags       : make(map[string]string,0),
-				}
-			}  
-
-			switch keyValPair[1] {
-			case "image":
-			  infraHWInst.Image = vConfigTree.Get(keyVal).(string)
-			  (*infraHWMap)[keyValPair[0]] = infraHWInst
-			case "region":
-				infraHWInst.Region  = vConfigTree.Get(keyVal).(string)
-				(*infraHWMap)[keyValPair[0]] = infraHWInst
-			case "type":
-				infraHWInst.Type  = vConfigTree.Get(keyVal).(string)
-				(*infraHWMap)[keyValPair[0]] = infraHWInst
-			case "disk":
-				for _,v := range vConfigTree.Get(keyVal).([]interface{}) {
-					var value string = fmt.Sprintf("%v", v)
-					infraHWInst.Disks = append(infraHWInst.Disks, value)
-				}
-				(*infraHWMap)[keyValPair[0]] =  infraHWInst
-			case "tags":
-				var tagMap map[string]string = make(map[string]string) 
-           		for key,value := range vConfigTree.Get(keyVal).([]interface{}) {
-            		var strKey string   = fmt.Sprintf("%v", key)
-            		var strValue string = fmt.Sprintf("%v", value)
-            		tagMap[strKey] = strValue
-           		}
-				infraHWInst.Tags             = tagMap
-            	(*infraHWMap)[keyValPair[0]] = infraHWInst
-			default:
-				err := errors.New("unexpected Config instance value " + keyValPair[1] + " found in " + configFileName)
+
+		// the entries, merged onto the ones they extend & the defaults
+		infraHWMap, err := ephstack.ResolveInfra(viper.GetStringMap("config.infra"), viper.GetStringMap("config.defaults"), configFileName)
+		if err != nil {
+			return err
+		}
+		// per cloud map, the files of the same cloud add up
+		if err := ephstack.AddCloudInfra(*infraHWInstancesMap, viper.GetString("config.cloud"), infraHWMap); err != nil {
+			return err
+		}
+
+		// the portable sizes & images, which take the values they don't set from the defaults
+		if viper.IsSet("config.sizes") || viper.IsSet("config.images") {
+			defaults, err := ephstack.ResolveDefaults(viper.GetStringMap("config.defaults"), configFileName)
+			if err != nil {
+				return err
+			}
+			if err := ephstack.AddCloudAliases(viper.GetString("config.cloud"), viper.GetStringMap("config.sizes"), viper.GetStringMap("config.images"), defaults, configFileName); err != nil {
 				return err
-			}	
+			}
+		}
+
+		// the state backend, unless --backend sets it
+		if err := setConfigBackend(viper.GetString("config.backend"), configFileName, &backendFileName); err != nil {
+			return err
+		}
+
+		// the network layout of the stacks on this cloud that don't declare their own
+		if vNetworkTree := viper.Sub("config.network"); vNetworkTree != nil {
+			ephstack.CloudNetworks[viper.GetString("config.cloud")] = parseNetwork(vNetworkTree)
 		}
-		 
+
 		ephstack.InfraHWInstances = infraHWInstancesMap
 	}	
 
 	return nil 
 }
 
+// setConfigBackend sets the state backend of a config file, unless --backend sets it.
+// The config files must agree on it, backendFileName is the one that set it first.
+func setConfigBackend(backend string, configFileName string, backendFileName *string) error {
+	if backend == "" || rootCmd.PersistentFlags().Changed("backend") {
+		return nil
+	}
+	backend, err := ephstack.NormalizeBackend(backend)
+	if err != nil {
+		return err
+	}
+	if *backendFileName != "" && backend != ephstack.BackendURL {
+		return ephstack.NewError(ephstack.ValidationError, "parse config files",
+			errors.New("backend "+backend+" of "+configFileName+" conflicts with "+ephstack.BackendURL+" of "+*backendFileName))
+	}
+	ephstack.BackendURL, *backendFileName = backend, configFileName
+	return nil
+}
+
+// resolveBackend sets the state backend of the config files for the commands that
+// don't parse a stack file, so they read the same state as deploy. Their ${...}
+// references resolve with the vars of --set only, as there are no vars: defaults.
+func resolveBackend(stackName string) error {
+	op := "parse config files"
+	if rootCmd.PersistentFlags().Changed("backend") {
+		return nil
+	}
+	var configFileNames []string
+	err := filepath.Walk("config", func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			configFileNames = append(configFileNames, path)
+		}
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		// run outside of a stack's directory, the default backend
+		return nil
+	} else if err != nil {
+		return ephstack.NewError(ephstack.ParseError, op, errors.New("unable to open sub directory 'config'"))
+	}
+
+	interp, err := ephstack.NewInterpolator("", stackName, nil)
+	if err != nil {
+		return err
+	}
+	backendFileName := ""
+	for _, configFileName := range configFileNames {
+		v := viper.New()
+		v.SetConfigFile(configFileName)
+		if err := v.ReadInConfig(); err != nil {
+			return ephstack.NewError(ephstack.ParseError, op, errors.New("unable to read config file "+configFileName))
+		}
+		backend := interp.String(v.GetString("config.backend"), configFileName+": config.backend", nil)
+		if err := interp.Err(); err != nil {
+			return err
+		}
+		if err := setConfigBackend(backend, configFileName, &backendFileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the policy file read if it exists, or if --policy names it
+const defaultPolicyFile = "policy.yaml"
+
+var policyFileName string
+
+// parsePolicyFile reads the 'policies' list of the policy file, e.g.
+//
+//	policies:
+//	  - name: approved-regions
+//	    level: enforce
+//	    allowed_regions: [ westus, eastus ]
+func parsePolicyFile() error {
+	if _, err := os.Stat(policyFileName); os.IsNotExist(err) && !rootCmd.PersistentFlags().Changed("policy") {
+		return nil
+	}
+	v := viper.New()
+	v.SetConfigFile(policyFileName)
+	if err := v.ReadInConfig(); err != nil {
+		return ephstack.NewError(ephstack.ParseError, "parse policy file", errors.New("unable to read policy file "+policyFileName))
+	}
+	policies, ok := v.Get("policies").([]interface{})
+	if !ok {
+		return ephstack.NewError(ephstack.ParseError, "parse policy file", errors.New("policy file "+policyFileName+" has no 'policies' list"))
+	}
+	parsed, err := ephstack.ParsePolicies(policies, policyFileName)
+	if err != nil {
+		return err
+	}
+	ephstack.Policies = parsed
+	return nil
+}
+
 func parse(stackFileName string) error {
 
+	// undefined references are already reported as validation errors
 	err := parseStackFile(stackFileName)
-	if err != nil {
+	if ephstack.IsKind(err, ephstack.ValidationError) {
 		return err
+	} else if err != nil {
+		return ephstack.NewError(ephstack.ParseError, "parse stack file", err)
 	}
 
 	err = parseConfigFiles()
-	if err != nil {
-		return err 
+	if ephstack.IsKind(err, ephstack.ValidationError) {
+		return err
+	} else if err != nil {
+		return ephstack.NewError(ephstack.ParseError, "parse config files", err)
 	}
 
-	return nil
+	// the apps with a portable size & image get an infra entry of their cloud
+	if err := ephstack.ResolveAliases(); err != nil {
+		return err
+	}
+
+	if err := parsePolicyFile(); err != nil {
+		return err
+	}
+
+	return ephstack.ValidateStack()
 }
 
 
@@ -232,6 +619,19 @@ func init() {
 	// define your flags and configuration settings.
 	rootCmd.AddCommand(deployCmd)
 
+	deployCmd.Flags().StringVar(&ephstack.LogFormat, "log-format", ephstack.LogFormatPretty,
+		"progress output: 'pretty' per-app view, 'json' event per line or 'raw' pulumi output")
+	deployCmd.Flags().BoolVar(&deployMock, "mock", false,
+		"report the resources that would be created, using pulumi mocks instead of the cloud")
+	deployCmd.Flags().Float64Var(&deployMaxCost, "max-cost", 0,
+		"refuse to deploy if the estimated monthly cost exceeds it, overrides the stack's budget")
+	deployCmd.Flags().DurationVar(&ephstack.LockTimeout, "lock-timeout", 0,
+		"how long to wait for another deploy or destroy of the stack to finish, e.g. 10m")
+	deployCmd.Flags().BoolVar(&ephstack.NoLock, "no-lock", false,
+		"run without the lock of the stack, e.g. without the credentials to keep it in the state backend")
+	deployCmd.Flags().StringVar(&ephstack.OnFailure, "on-failure", ephstack.OnFailureKeep,
+		"when the deploy fails midway: 'keep' what was built, 'destroy' what it created or 'rollback' to the last successful deployment")
+
 	// read in the stack file first 
 	
 	// parse the config files and only read in the settings for the 
@@ -0,0 +1,101 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rajeshr264/ephstack/internal"
+)
+
+// the commands that don't parse a stack file use the backend of the config files too
+func TestConfigBackend(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		ephstack.BackendURL, unlockForce = "", false
+	})
+	t.Setenv("HOME", filepath.Join(dir, "home"))
+	t.Setenv("TEAM_STATE", filepath.Join(dir, "team"))
+
+	os.Mkdir("config", 0700)
+	config := "config:\n  cloud: local\n  backend: ${env:TEAM_STATE}/${stack.name}\n"
+	if err := os.WriteFile(filepath.Join("config", "local.yaml"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lockFile := filepath.Join(dir, "team", "s1", ".ephstack", "locks", "s1", "dev.json")
+	os.MkdirAll(filepath.Dir(lockFile), 0700)
+	lock := `{"holder":"other@elsewhere","host":"elsewhere","pid":1,"operation":"deploy","acquiredAt":"2099-01-01T00:00:00Z"}`
+	if err := os.WriteFile(lockFile, []byte(lock), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rootCmd.SetArgs([]string{"unlock", "--force", "s1"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "file://" + filepath.Join(dir, "team", "s1"); ephstack.BackendURL != want {
+		t.Errorf("backend %q, want %q", ephstack.BackendURL, want)
+	}
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Errorf("the lock in the backend of the config files is left: %v", err)
+	}
+}
+
+// the commands reading a deployed stack exit with the code of their error's kind
+func TestStackCommandsExitCode(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE", "pw")
+	for _, args := range [][]string{{"ssh", "nope", "app1"}, {"creds", "-y", "nope", "app1"}, {"ssh-config", "nope"}} {
+		rootCmd.SetArgs(args)
+		err := rootCmd.Execute()
+		if code := ephstack.ExitCode(err); code != int(ephstack.ParseError) && code != int(ephstack.ValidationError) {
+			t.Errorf("%v exits with %d: %v", args, code, err)
+		}
+	}
+}
+
+// the vars: defaults can refer to the stack name
+func TestStackNameInVars(t *testing.T) {
+	t.Setenv("EPHSTACK_TEST_NAME", "s1")
+	t.Cleanup(func() { ephstack.StackInstance = nil })
+	stackFileName := filepath.Join(t.TempDir(), "stack.yaml")
+	stack := `stack:
+  name: ${env:EPHSTACK_TEST_NAME}
+  vars:
+    prefix: ${stack.name}-web
+  apps:
+    web:
+      infra: local_small
+      facts:
+        - role: ${var:prefix}
+`
+	if err := os.WriteFile(stackFileName, []byte(stack), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseStackFile(stackFileName); err != nil {
+		t.Fatal(err)
+	}
+	if ephstack.StackInstance.Id != "s1" || ephstack.StackInstance.AppInstances["web"].Facts["role"] != "s1-web" {
+		t.Errorf("stack %s has the facts %v", ephstack.StackInstance.Id, ephstack.StackInstance.AppInstances["web"].Facts)
+	}
+}
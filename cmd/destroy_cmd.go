@@ -16,36 +16,37 @@ limitations under the License.
 package cmd
 
 import (
-	"fmt"
+	"rajeshr264/ephstack/internal"
 
 	"github.com/spf13/cobra"
 )
 
 // destroyCmd represents the destroy command
 var destroyCmd = &cobra.Command{
-	Use:   "destroy",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("destroy called")
+	Use:   "destroy <stack file>",
+	Short: "Destroy the app(s) specified in the stack file",
+	Long: `Destroy the app(s) specified in the stack file.
+
+Everything deployed for the selected environment is torn down: the VMs and the
+network on a cloud, or the allocated hosts on the local provider.`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := parse(args[0]); err != nil {
+			return err
+		}
+		return ephstack.DestroyInfrastructure()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(destroyCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// destroyCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// destroyCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	destroyCmd.Flags().StringVar(&ephstack.LogFormat, "log-format", ephstack.LogFormatPretty,
+		"progress output: 'pretty' per-app view, 'json' event per line or 'raw' pulumi output")
+	destroyCmd.Flags().DurationVar(&ephstack.LockTimeout, "lock-timeout", 0,
+		"how long to wait for another deploy or destroy of the stack to finish, e.g. 10m")
+	destroyCmd.Flags().BoolVar(&ephstack.NoLock, "no-lock", false,
+		"run without the lock of the stack, e.g. without the credentials to keep it in the state backend")
 }
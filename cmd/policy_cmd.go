@@ -0,0 +1,57 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// policyCmd represents the policy command
+var policyCmd = &cobra.Command{
+	Use:   "policy <stack file>",
+	Short: "Check the stack against the policies of the policy file",
+	Long: `Check the apps of the stack, with the infra they run on, against the
+policies of the policy file: allowed regions, denied sizes, allowed images and
+required tags. Every violation is reported; a policy at the 'warn' level only
+reports them, one at the 'enforce' level also makes deploy refuse to run.
+Exits with the policy error code if any enforced policy is violated.`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := parse(args[0]); err != nil {
+			return err
+		}
+		if len(ephstack.Policies) == 0 {
+			fmt.Println("no policies in " + policyFileName)
+			return nil
+		}
+		if err := ephstack.EnforcePolicies(os.Stdout); err != nil {
+			return err
+		}
+		fmt.Printf("%d policies, no enforced policy is violated\n", len(ephstack.Policies))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(policyCmd)
+}
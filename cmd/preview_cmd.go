@@ -0,0 +1,56 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var previewMock bool
+
+// previewCmd represents the preview command
+var previewCmd = &cobra.Command{
+	Use:   "preview <stack file>",
+	Short: "Preview the changes deploying the stack file would make",
+	Long: `Preview the changes deploying the stack file would make.
+
+With --mock the stack's programs run against pulumi mocks with canned IDs and IPs,
+and the resources that would be created are reported per app with their inputs.
+That needs neither cloud credentials nor a state backend, e.g. for CI.`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := parse(args[0]); err != nil {
+			return err
+		}
+		if previewMock {
+			return runMock()
+		}
+		return ephstack.PreviewInfrastructure()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(previewCmd)
+
+	previewCmd.Flags().BoolVar(&previewMock, "mock", false,
+		"report the resources that would be created, using pulumi mocks instead of the cloud")
+	previewCmd.Flags().StringVar(&ephstack.LogFormat, "log-format", ephstack.LogFormatPretty,
+		"progress output: 'pretty' per-app view, 'json' event per line or 'raw' pulumi output; the mock report is pretty or json")
+}
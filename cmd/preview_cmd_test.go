@@ -0,0 +1,134 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"rajeshr264/ephstack/internal"
+)
+
+// the mock of the sample tiered stack creates the resources of every app with its
+// settings, in the subnets of the stack file
+func TestMockTieredStack(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		ephstack.StackInstance, ephstack.InfraHWInstances, ephstack.Policies = nil, nil, nil
+		ephstack.BackendURL, ephstack.LogFormat = "", ephstack.LogFormatPretty
+	})
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE", "pw")
+
+	if err := parse("stacks/tiered_stack.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	resources, err := ephstack.MockDeploy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 18 {
+		t.Errorf("%d resources, want 18", len(resources))
+	}
+	byName := make(map[string]ephstack.MockedResource)
+	for _, res := range resources {
+		byName[res.Name] = res
+	}
+	input := func(name string, key string) interface{} {
+		res, ok := byName[name]
+		if !ok {
+			t.Fatalf("no resource %s", name)
+		}
+		return res.Inputs[key]
+	}
+	object := func(value interface{}) map[string]interface{} {
+		values, _ := value.(map[string]interface{})
+		return values
+	}
+	first := func(value interface{}) map[string]interface{} {
+		if values, _ := value.([]interface{}); len(values) > 0 {
+			return object(values[0])
+		}
+		return nil
+	}
+
+	for app, subnet := range map[string]string{"web1": "web", "app1": "app", "db1": "db"} {
+		for _, name := range []string{app + "-0", app + "-0-nic", app + "-0-nsg", app + "-0-vm"} {
+			if res := byName[name]; res.App != app || res.Stack != "dev" {
+				t.Errorf("%s is reported in %s/%s, want dev/%s", name, res.Stack, res.App, app)
+			}
+		}
+		if subnetID, _ := first(input(app+"-0-nic", "ipConfigurations"))["subnetId"].(string); !strings.HasSuffix(subnetID, "/subnets/"+subnet) {
+			t.Errorf("%s is attached to %q, want subnet %s", app, subnetID, subnet)
+		}
+	}
+
+	// only web1 has a public IP, a static one with its DNS label
+	if input("web1-0-ip", "allocationMethod") != "Static" || input("web1-0-ip", "domainNameLabel") != "tiered-web1" {
+		t.Errorf("web1 public IP inputs %v", byName["web1-0-ip"].Inputs)
+	}
+	for _, name := range []string{"app1-0-ip", "db1-0-ip"} {
+		if _, ok := byName[name]; ok {
+			t.Errorf("%s is created for public_ip: none", name)
+		}
+	}
+
+	// the ports are open to the subnets of the apps named in from:
+	if rule := first(input("app1-0-nsg", "securityRules")); rule["destinationPortRange"] != "8080" ||
+		len(rule["sourceAddressPrefixes"].([]interface{})) != 1 || rule["sourceAddressPrefixes"].([]interface{})[0] != "10.1.1.0/24" {
+		t.Errorf("app1 first rule %v", rule)
+	}
+	if rule := first(input("db1-0-nsg", "securityRules")); rule["destinationPortRange"] != "5432" ||
+		rule["sourceAddressPrefixes"].([]interface{})[0] != "10.1.2.0/24" {
+		t.Errorf("db1 first rule %v", rule)
+	}
+
+	if input("db1-0-vm", "vmSize") != "Standard_DS4_v2" || input("web1-0-vm", "vmSize") != "Standard_DS2_v2" {
+		t.Errorf("vm sizes %v and %v", input("db1-0-vm", "vmSize"), input("web1-0-vm", "vmSize"))
+	}
+	if disks, _ := input("db1-0-vm", "storageDataDisks").([]interface{}); len(disks) != 2 {
+		t.Errorf("db1 data disks %v, want 2", disks)
+	}
+
+	// the user_data is rendered with addresses in the subnets of the hosts
+	customData, _ := object(input("web1-0-vm", "osProfile"))["customData"].(string)
+	if !strings.Contains(customData, "web 0 at 10.1.1.") || !strings.Contains(customData, "APP_HOST=10.1.2.") {
+		t.Errorf("web1 user_data %q", customData)
+	}
+	if customData, _ := object(input("db1-0-vm", "osProfile"))["customData"].(string); !strings.Contains(customData, "host all all 10.1.2.") {
+		t.Errorf("db1 user_data %q", customData)
+	}
+
+	ephstack.LogFormat = ephstack.LogFormatJSON
+	var out bytes.Buffer
+	if err := ephstack.PrintMockReport(&out, resources); err != nil {
+		t.Fatal(err)
+	}
+	var reported []ephstack.MockedResource
+	if err := json.Unmarshal(out.Bytes(), &reported); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != len(resources) || reported[0].Stack != "networking" {
+		t.Errorf("json report of %d resources, starting in %q", len(reported), reported[0].Stack)
+	}
+}
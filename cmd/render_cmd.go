@@ -0,0 +1,78 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/spf13/cobra"
+)
+
+var renderDeployed bool
+
+// renderCmd represents the render command
+var renderCmd = &cobra.Command{
+	Use:   "render <stack file> <app>",
+	Short: "Print the user_data an app's hosts would boot with",
+	Long: `Print the user_data an app's hosts would boot with, rendered from its template
+and facts. Secret facts are masked.
+
+The addresses of the hosts are placeholders like <app2-1.privateIp>, unless
+--deployed reads them from the deployed environment of the stack.`,
+
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := parse(args[0]); err != nil {
+			return err
+		}
+		var outs auto.OutputMap
+		if renderDeployed {
+			var err error
+			if outs, err = ephstack.StackOutputs(ephstack.StackInstance.Id); err != nil {
+				return err
+			}
+		}
+		rendered, err := ephstack.RenderAppUserData(args[1], outs)
+		if err != nil {
+			return err
+		}
+
+		hostNames := make([]string, 0, len(rendered))
+		for hostName := range rendered {
+			hostNames = append(hostNames, hostName)
+		}
+		sort.Strings(hostNames)
+		for _, hostName := range hostNames {
+			if len(hostNames) > 1 {
+				fmt.Printf("# --- %s\n", hostName)
+			}
+			fmt.Println(rendered[hostName])
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(renderCmd)
+
+	renderCmd.Flags().BoolVar(&renderDeployed, "deployed", false,
+		"fill in the addresses from the deployed environment of the stack")
+}
@@ -0,0 +1,52 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// renderStackCmd represents the render-stack command
+var renderStackCmd = &cobra.Command{
+	Use:   "render-stack <stack file>",
+	Short: "Print the stack that would be deployed, as json",
+	Long: `Print the stack that would be deployed, as json: with the fragments of
+stack.include merged in, the apps that extend a base merged onto it, the
+environment's overrides applied and the ${...} references resolved.
+Secret facts are masked.`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := parse(args[0]); err != nil {
+			return err
+		}
+		rendered, err := ephstack.RenderStack()
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(rendered))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(renderStackCmd)
+}
@@ -19,6 +19,8 @@ import (
 	//"io"
 	"os"
 
+	"rajeshr264/ephstack/internal"
+
 	"github.com/spf13/cobra"
 )
 
@@ -29,10 +31,27 @@ var stackFile string
 var rootCmd = &cobra.Command{
 	Use:   "ephstack",
 	Short: "Manage a stack deployed in hybrid cloud",
-	Long: `Manage a stack deployed in hybrid cloud`,
+	Long: `Manage a stack deployed in hybrid cloud
+
+Exit codes:
+  0  success
+  1  any other error
+  2  parse error: the stack or config files, or the state of a deployed stack, can't be read
+  3  validation error: the stack or config files are inconsistent
+  4  provider auth error: the cloud provider rejected the credentials
+  5  quota error: the cloud subscription ran out of quota
+  6  provisioning error: creating or updating the cloud resources failed
+  8  policy error: the stack breaks an enforced policy of the policy file
+  9  lock error: another deploy or destroy holds the lock of the stack`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
+
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		backend, err := ephstack.NormalizeBackend(ephstack.BackendURL)
+		ephstack.BackendURL = backend
+		return err
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -40,7 +59,7 @@ var rootCmd = &cobra.Command{
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		os.Exit(ephstack.ExitCode(err))
 	}
 }
 
@@ -52,6 +71,31 @@ func init() {
 	// will be global for your application.
 
 	//rootCmd.PersistentFlags().StringVar(&stackFile, "stack", "", "stack file in YAML format")
+
+	// every environment of a stack is deployed side by side as its own pulumi stack
+	rootCmd.PersistentFlags().StringVar(&ephstack.Environment, "env", ephstack.DefaultEnvironment,
+		"environment of the stack, e.g. dev, qa or staging")
+
+	// secrets in stack state are encrypted with a passphrase, read from PULUMI_CONFIG_PASSPHRASE,
+	// a passphrase file, a gpg key file or a prompt, or with any other pulumi secrets provider, e.g. a key vault
+	rootCmd.PersistentFlags().StringVar(&ephstack.SecretsSettings.Provider, "secrets-provider", ephstack.SecretsSettings.Provider,
+		"secrets provider for stack state: 'passphrase' or a pulumi secrets provider URL")
+	rootCmd.PersistentFlags().StringVar(&ephstack.SecretsSettings.PassphraseFile, "passphrase-file", "",
+		"file holding the passphrase of the 'passphrase' secrets provider, instead of PULUMI_CONFIG_PASSPHRASE")
+	rootCmd.PersistentFlags().StringVar(&ephstack.SecretsSettings.GPGKeyFile, "gpg-key-file", "",
+		"OpenPGP private key file the passphrase of the 'passphrase' secrets provider is derived from")
+
+	// ${var:name} references in the stack and config files resolve to the stack's vars: block
+	rootCmd.PersistentFlags().StringToStringVar(&ephstack.VarOverrides, "set", nil,
+		"override a var of the stack file, e.g. --set image=centos8 (repeatable)")
+
+	// the state of the app & networking stacks, shared by the team with a shared volume or bucket
+	rootCmd.PersistentFlags().StringVar(&ephstack.BackendURL, "backend", "",
+		"pulumi state backend: a path, or a file://, s3://, azblob://, gs:// or https:// URL; ~/.pulumi by default")
+
+	// the org rules checked before anything is provisioned, see policy.yaml
+	rootCmd.PersistentFlags().StringVar(&policyFileName, "policy", defaultPolicyFile,
+		"policy file of allowed regions, sizes, images and required tags")
 }
 
 // initConfig reads in config file and ENV variables if set.
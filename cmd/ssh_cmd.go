@@ -0,0 +1,55 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// sshCmd represents the ssh command
+var sshCmd = &cobra.Command{
+	Use:   "ssh <stack> <app>",
+	Short: "Open an interactive SSH session on an app of a deployed stack",
+	Long: `Open an interactive SSH session on an app of a deployed stack, on its first host,
+or on one of its hosts <app>-<index>, e.g. app2-1.`,
+
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stackName, appName := args[0], args[1]
+
+		if err := resolveBackend(stackName); err != nil {
+			return err
+		}
+		outs, err := ephstack.StackOutputs(stackName)
+		if err != nil {
+			return err
+		}
+		ip, err := ephstack.AppIPAddress(outs, appName)
+		if err != nil {
+			return err
+		}
+
+		creds := ephstack.AppCredentials(outs, appName)
+		return ephstack.OpenSSHSession(ip, creds)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshCmd)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// sshConfigCmd represents the ssh-config command
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config <stack>",
+	Short: "Print a ~/.ssh/config Host block for every host of a deployed stack",
+	Long: `Print a ~/.ssh/config Host block for every host of a deployed stack.
+
+The stack's private key is saved to ~/.ephstack/keys and used as the IdentityFile.
+Hosts are named <stack>-<app>-<index>, or <stack>-<env>-<app>-<index> outside the default
+environment.
+Save the output and include it from ~/.ssh/config, e.g.
+
+  ephstack ssh-config stack1 > ~/.ssh/ephstack_stack1
+  echo "Include ~/.ssh/ephstack_stack1" >> ~/.ssh/config
+  ssh stack1-app1-0`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stackName := args[0]
+
+		if err := resolveBackend(stackName); err != nil {
+			return err
+		}
+		outs, err := ephstack.StackOutputs(stackName)
+		if err != nil {
+			return err
+		}
+		appNames := ephstack.StackAppNames(outs)
+		if len(appNames) == 0 {
+			return ephstack.NewError(ephstack.ValidationError, "read stack "+stackName, errors.New("stack "+stackName+" has no deployed apps"))
+		}
+
+		var keyFile string
+		for _, appName := range appNames {
+			hostName, err := ephstack.AppHostName(outs, appName)
+			if err != nil {
+				return err
+			}
+			creds := ephstack.AppCredentials(outs, appName)
+			if keyFile == "" && creds.Private_key != "" {
+				if keyFile, err = ephstack.WriteStackPrivateKey(stackName, ephstack.Environment, creds.Private_key); err != nil {
+					return err
+				}
+			}
+
+			hostAlias := stackName + "-" + appName
+			if ephstack.Environment != ephstack.DefaultEnvironment {
+				hostAlias = stackName + "-" + ephstack.Environment + "-" + appName
+			}
+			fmt.Printf("Host %s\n", hostAlias)
+			fmt.Printf("  HostName %s\n", hostName)
+			fmt.Printf("  User %s\n", creds.Username)
+			if keyFile != "" {
+				fmt.Printf("  IdentityFile %s\n", keyFile)
+				fmt.Println("  IdentitiesOnly yes")
+			}
+			// the VMs are ephemeral, their host keys change with every deploy
+			fmt.Println("  StrictHostKeyChecking no")
+			fmt.Println("  UserKnownHostsFile /dev/null")
+			fmt.Println()
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshConfigCmd)
+}
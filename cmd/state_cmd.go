@@ -0,0 +1,129 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var stateOutput string
+var stateImportForce bool
+
+// stateCmd represents the state command
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Move the state of a deployed stack between backends",
+	Long: `Move the state of an environment of a deployed stack between state backends,
+e.g. from your own ~/.pulumi to a shared one:
+
+  ephstack state export --env qa stack1
+  ephstack state import --backend s3://team-state stack1-qa.ephstate
+
+The archive is encrypted with a passphrase read from EPHSTACK_ARCHIVE_PASSPHRASE,
+else prompted for, as it holds the secrets of the stack in the clear.`,
+}
+
+// stateExportCmd represents the state export command
+var stateExportCmd = &cobra.Command{
+	Use:   "export <stack>",
+	Short: "Archive the state of an environment of a deployed stack",
+	Long: `Archive the state of an environment of a deployed stack, from the backend of
+--backend: the pulumi checkpoints and config of its app and networking stacks,
+with the credentials of its apps, or its local provider state. The secrets are
+decrypted with --secrets-provider and encrypted again with the archive passphrase.
+The archive is written to <stack>-<env>.ephstate unless -o is set.`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := resolveBackend(args[0]); err != nil {
+			return err
+		}
+		passphrase, err := ephstack.ArchivePassphrase(true)
+		if err != nil {
+			return err
+		}
+		archive, err := ephstack.ExportState(context.Background(), args[0], ephstack.Environment, passphrase)
+		if err != nil {
+			return err
+		}
+		fileName := stateOutput
+		if fileName == "" {
+			fileName = args[0] + "-" + ephstack.Environment + ".ephstate"
+		}
+		if err := ephstack.WriteStateArchive(archive, fileName); err != nil {
+			return err
+		}
+		what := "local provider state"
+		if archive.Provider != "local" {
+			what = "pulumi stacks " + strings.Join(archive.Stacks, ", ")
+		}
+		fmt.Printf("exported %s of stack %s/%s to %s\n", what, archive.Stack, archive.Env, fileName)
+		return nil
+	},
+}
+
+// stateImportCmd represents the state import command
+var stateImportCmd = &cobra.Command{
+	Use:   "import <archive>",
+	Short: "Restore an archive of 'ephstack state export' into the state backend",
+	Long: `Restore an archive of 'ephstack state export' into the backend of --backend,
+under the stack and environment it was exported from. The secrets are encrypted
+again with --secrets-provider. An environment already deployed in that backend
+is only replaced with --force.`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		archive, err := ephstack.ReadStateArchive(args[0])
+		if err != nil {
+			return err
+		}
+		if err := resolveBackend(archive.Stack); err != nil {
+			return err
+		}
+		passphrase, err := ephstack.ArchivePassphrase(false)
+		if err != nil {
+			return err
+		}
+		restored, err := ephstack.ImportState(context.Background(), archive, passphrase, stateImportForce)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("imported stack %s/%s, exported %s from %s:\n", archive.Stack, archive.Env, archive.ExportedAt, archive.Backend)
+		for _, item := range restored {
+			fmt.Println("  " + item)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(stateExportCmd)
+	stateCmd.AddCommand(stateImportCmd)
+
+	stateExportCmd.Flags().StringVarP(&stateOutput, "output", "o", "", "archive file, <stack>-<env>.ephstate by default")
+	stateImportCmd.Flags().BoolVar(&stateImportForce, "force", false, "replace the state of an environment already deployed")
+	stateImportCmd.Flags().BoolVar(&ephstack.NoLock, "no-lock", false,
+		"run without the lock of the stack, e.g. without the credentials to keep it in the state backend")
+}
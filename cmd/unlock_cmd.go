@@ -0,0 +1,60 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"rajeshr264/ephstack/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var unlockForce bool
+
+// unlockCmd represents the unlock command
+var unlockCmd = &cobra.Command{
+	Use:   "unlock <stack>",
+	Short: "Remove the lock of an environment of a deployed stack",
+	Long: `Remove the lock a deploy or destroy holds on an environment of a stack
+while it runs, e.g. when it was killed. Without --force only your own lock,
+or a stale one, is removed. The locks are kept in the state backend, pass it
+with --backend if the config files don't set it.`,
+
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := resolveBackend(args[0]); err != nil {
+			return err
+		}
+		held, err := ephstack.Unlock(args[0], ephstack.Environment, unlockForce)
+		if err != nil {
+			return err
+		}
+		if held == nil {
+			fmt.Printf("stack %s is not locked in environment %s\n", args[0], ephstack.Environment)
+			return nil
+		}
+		fmt.Printf("removed the lock of %s\n", held)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(unlockCmd)
+
+	unlockCmd.Flags().BoolVar(&unlockForce, "force", false, "remove the lock even if another user holds it")
+}
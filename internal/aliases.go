@@ -0,0 +1,220 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SizeAliasType is a portable size of a cloud's catalog, e.g.
+//
+//	sizes:
+//	  medium: { type: Standard_DS2_v2, cpus: 2, memory_gb: 7 }
+type SizeAliasType struct {
+	Name     string
+	Type     string  // the cloud's own size
+	CPUs     int     // vCPUs, to match size requirements
+	MemoryGB float64 // to match size requirements
+	source   string
+	defaults *InfraHwType // the 'defaults' of the config file declaring the size
+}
+
+// AliasCatalogType holds the portable sizes & images of a cloud
+type AliasCatalogType struct {
+	Sizes        map[string]*SizeAliasType
+	Images       map[string]string // the cloud's own image, by portable name like ubuntu22
+	imageSources map[string]string
+}
+
+// the size & image aliases of the config files, by cloud
+var CloudAliases = make(map[string]*AliasCatalogType)
+
+// AddCloudAliases adds the 'sizes' & 'images' of a config file to the catalog of its
+// cloud. Like the infra entries, each alias must be declared by a single file.
+func AddCloudAliases(cloudName string, sizes map[string]interface{}, images map[string]interface{}, defaults *InfraHwType, configFileName string) error {
+	op := "add aliases of cloud " + cloudName
+	catalog, ok := CloudAliases[cloudName]
+	if !ok {
+		catalog = &AliasCatalogType{
+			Sizes:        make(map[string]*SizeAliasType),
+			Images:       make(map[string]string),
+			imageSources: make(map[string]string),
+		}
+		CloudAliases[cloudName] = catalog
+	}
+
+	for name, value := range sizes {
+		source := configFileName + ": config.sizes." + name
+		if declared, ok := catalog.Sizes[name]; ok {
+			return NewError(ValidationError, op, errors.New("size '"+name+"' is declared in both "+declared.source+" and "+source))
+		}
+		decl, ok := toSettings(value)
+		if !ok {
+			return NewError(ValidationError, op, errors.New(source+" must be a map of type, cpus & memory_gb"))
+		}
+		size := &SizeAliasType{Name: name, source: source, defaults: defaults}
+		for key, value := range decl {
+			var err error
+			switch key {
+			case "type":
+				size.Type = fmt.Sprintf("%v", value)
+			case "cpus":
+				size.CPUs, err = strconv.Atoi(fmt.Sprintf("%v", value))
+			case "memory_gb":
+				size.MemoryGB, err = strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
+			default:
+				err = errors.New("unexpected size value")
+			}
+			if err != nil {
+				return NewError(ValidationError, op, errors.New(source+"."+key+": "+err.Error()))
+			}
+		}
+		if size.Type == "" {
+			return NewError(ValidationError, op, errors.New(source+" has no type"))
+		}
+		catalog.Sizes[name] = size
+	}
+
+	for name, value := range images {
+		source := configFileName + ": config.images." + name
+		if declared, ok := catalog.imageSources[name]; ok {
+			return NewError(ValidationError, op, errors.New("image '"+name+"' is declared in both "+declared+" and "+source))
+		}
+		catalog.Images[name] = fmt.Sprintf("%v", value)
+		catalog.imageSources[name] = source
+	}
+	return nil
+}
+
+// matchSize returns the smallest size of the catalog that meets the requirement
+func (catalog *AliasCatalogType) matchSize(req *SizeRequirementType) *SizeAliasType {
+	var match *SizeAliasType
+	for _, size := range catalog.Sizes {
+		if size.CPUs < req.CPUs || size.MemoryGB < req.MemoryGB {
+			continue
+		}
+		if match == nil || size.CPUs < match.CPUs ||
+			(size.CPUs == match.CPUs && (size.MemoryGB < match.MemoryGB || (size.MemoryGB == match.MemoryGB && size.Name < match.Name))) {
+			match = size
+		}
+	}
+	return match
+}
+
+// aliasCloud returns the cloud an app's aliases resolve on: its own 'cloud', else the
+// single cloud whose catalog has its size & image
+func aliasCloud(appInst *AppInstanceType) (string, error) {
+	if appInst.Cloud != "" {
+		if _, ok := CloudAliases[appInst.Cloud]; !ok {
+			return "", errors.New("cloud '" + appInst.Cloud + "' has no size or image aliases")
+		}
+		return appInst.Cloud, nil
+	}
+	var clouds []string
+	for cloudName, catalog := range CloudAliases {
+		if _, ok := catalog.Sizes[appInst.Size]; appInst.Size != "" && !ok {
+			continue
+		}
+		if _, ok := catalog.Images[appInst.Image]; appInst.Image != "" && !ok {
+			continue
+		}
+		clouds = append(clouds, cloudName)
+	}
+	sort.Strings(clouds)
+	switch len(clouds) {
+	case 0:
+		return "", errors.New("no cloud has the size & image aliases it asks for")
+	case 1:
+		return clouds[0], nil
+	}
+	return "", errors.New("its aliases resolve on " + strings.Join(clouds, " and ") + ", pick one with cloud: <name>")
+}
+
+// ResolveAliases turns the portable size & image of the apps of the parsed stack into
+// infra entries of their cloud, named <size>.<image>, or <size> for an app without an
+// image, which must not clash with the entries of the config files
+func ResolveAliases() error {
+	op := "resolve aliases of stack " + StackInstance.Id
+	for _, appName := range sortedAppNames() {
+		appInst := StackInstance.AppInstances[appName]
+		if appInst.Size == "" && appInst.SizeRequirement == nil && appInst.Image == "" {
+			continue
+		}
+		if appInst.Infra != "" {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"' sets both infra and a size or image"))
+		}
+		if appInst.Size == "" && appInst.SizeRequirement == nil {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"' has an image but no size"))
+		}
+		cloudName, err := aliasCloud(appInst)
+		if err != nil {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"': "+err.Error()))
+		}
+		catalog := CloudAliases[cloudName]
+
+		size := catalog.Sizes[appInst.Size]
+		if appInst.SizeRequirement != nil {
+			size = catalog.matchSize(appInst.SizeRequirement)
+		}
+		if size == nil {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"': cloud '"+cloudName+"' has no size that fits it"))
+		}
+
+		infraHW := &InfraHwType{
+			Name:    size.Name,
+			Region:  size.defaults.Region,
+			Type:    size.Type,
+			Image:   size.defaults.Image,
+			Disks:   size.defaults.Disks,
+			Tags:    size.defaults.Tags,
+			Sources: make(map[string]string),
+		}
+		for key, source := range size.defaults.Sources {
+			infraHW.Sources[key] = source
+		}
+		infraHW.Sources["name"] = size.source
+		infraHW.Sources["type"] = size.source
+		if appInst.Image != "" {
+			image, ok := catalog.Images[appInst.Image]
+			if !ok {
+				return NewError(ValidationError, op, errors.New("app '"+appName+"': cloud '"+cloudName+"' has no image '"+appInst.Image+"'"))
+			}
+			infraHW.Name += "." + appInst.Image
+			infraHW.Image = image
+			infraHW.Sources["image"] = catalog.imageSources[appInst.Image]
+		}
+
+		if InfraHWInstances == nil {
+			InfraHWInstances = &InfraHWInstancesMapType{}
+		}
+		cloudInfraHW, ok := (*InfraHWInstances)[cloudName]
+		if !ok {
+			cloudInfraHW = &InfraHWInstMapType{}
+			(*InfraHWInstances)[cloudName] = cloudInfraHW
+		}
+		// the apps with the same aliases share the entry
+		if declared, ok := (*cloudInfraHW)[infraHW.Name]; ok && declared.Sources["name"] != size.source {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"': the infra entry of its aliases, '"+infraHW.Name+"', clashes with the one of "+declared.Sources["name"]+", rename either"))
+		}
+		(*cloudInfraHW)[infraHW.Name] = infraHW
+		appInst.Infra = cloudName + "/" + infraHW.Name
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"strings"
+	"testing"
+)
+
+// useAliases parses the aliases of a config file of the azure cloud, declaring infra
+func useAliases(t *testing.T, infra map[string]interface{}) {
+	defaults, err := ResolveDefaults(map[string]interface{}{"region": "westus", "image": "OpenLogic:CentOS:7_9:latest"}, "azure.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infraHWMap, err := ResolveInfra(infra, nil, "azure.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	CloudAliases = make(map[string]*AliasCatalogType)
+	InfraHWInstances = &InfraHWInstancesMapType{}
+	t.Cleanup(func() {
+		CloudAliases = make(map[string]*AliasCatalogType)
+		InfraHWInstances, StackInstance = nil, nil
+	})
+	if err := AddCloudInfra(*InfraHWInstances, "azure", infraHWMap); err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]interface{}{
+		"small":  map[string]interface{}{"type": "Standard_B2s", "cpus": 2, "memory_gb": 4},
+		"medium": map[string]interface{}{"type": "Standard_DS2_v2", "cpus": 2, "memory_gb": 7},
+		"large":  map[string]interface{}{"type": "Standard_DS4_v2", "cpus": 8, "memory_gb": 28},
+	}
+	images := map[string]interface{}{"ubuntu22": "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest"}
+	if err := AddCloudAliases("azure", sizes, images, defaults, "azure.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveAliases(t *testing.T) {
+	useAliases(t, map[string]interface{}{})
+	web := &AppInstanceType{Size: "medium", Image: "ubuntu22"}
+	db := &AppInstanceType{SizeRequirement: &SizeRequirementType{CPUs: 4, MemoryGB: 16}}
+	web2 := &AppInstanceType{Size: "medium", Image: "ubuntu22"}
+	StackInstance = &StackType{Id: "s1", AppInstances: map[string]*AppInstanceType{"web": web, "db": db, "web2": web2}}
+	if err := ResolveAliases(); err != nil {
+		t.Fatal(err)
+	}
+
+	if web.Infra != "azure/medium.ubuntu22" || web2.Infra != web.Infra {
+		t.Errorf("web runs on %q and web2 on %q", web.Infra, web2.Infra)
+	}
+	infraHW := LookupInfraHW(web.Infra)
+	if infraHW.Type != "Standard_DS2_v2" || infraHW.Image != "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest" || infraHW.Region != "westus" {
+		t.Errorf("web infra is %+v", infraHW)
+	}
+	if infraHW.Sources["image"] != "azure.yaml: config.images.ubuntu22" || infraHW.Sources["region"] != "azure.yaml: config.defaults" {
+		t.Errorf("web infra sources %v", infraHW.Sources)
+	}
+
+	// the smallest size that fits, with the image of the defaults
+	if db.Infra != "azure/large" {
+		t.Errorf("db runs on %q", db.Infra)
+	}
+	if infraHW := LookupInfraHW(db.Infra); infraHW.Image != "OpenLogic:CentOS:7_9:latest" {
+		t.Errorf("db infra is %+v", infraHW)
+	}
+}
+
+func TestResolveAliasesErrors(t *testing.T) {
+	tests := []struct {
+		app     *AppInstanceType
+		wantErr string
+	}{
+		{&AppInstanceType{Size: "medium"}, "the infra entry of its aliases, 'medium', clashes with the one of azure.yaml: config.infra.medium"},
+		{&AppInstanceType{Size: "medium", Infra: "medium"}, "sets both infra and a size or image"},
+		{&AppInstanceType{Image: "ubuntu22"}, "has an image but no size"},
+		{&AppInstanceType{Size: "small", Image: "debian"}, "no cloud has the size & image aliases it asks for"},
+		{&AppInstanceType{SizeRequirement: &SizeRequirementType{CPUs: 64}}, "cloud 'azure' has no size that fits it"},
+		{&AppInstanceType{Size: "small", Cloud: "aws"}, "cloud 'aws' has no size or image aliases"},
+	}
+	for _, test := range tests {
+		useAliases(t, map[string]interface{}{"medium": map[string]interface{}{"type": "Standard_B1s"}})
+		StackInstance = &StackType{Id: "s1", AppInstances: map[string]*AppInstanceType{"web": test.app}}
+		err := ResolveAliases()
+		if err == nil || !strings.Contains(err.Error(), "app 'web'") || !strings.Contains(err.Error(), test.wantErr) || ExitCode(err) != 3 {
+			t.Errorf("error %v, want the validation error %q", err, test.wantErr)
+		}
+	}
+}
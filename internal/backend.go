@@ -0,0 +1,93 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the pulumi state backend of the app & networking stacks, normalized by
+// NormalizeBackend; file://~/.pulumi if empty
+var BackendURL string
+
+// the URL schemes of the state backends pulumi can use
+var backendSchemes = map[string]bool{
+	"file":   true, // a directory, e.g. on a shared volume
+	"s3":     true, // S3 or compatible object storage, e.g. MinIO with ?endpoint=...&s3ForcePathStyle=true
+	"azblob": true, // an Azure Blob container, or Azurite, with AZURE_STORAGE_ACCOUNT & AZURE_STORAGE_KEY
+	"gs":     true, // a Google Cloud Storage bucket
+	"https":  true, // the pulumi service, or a self-hosted one
+	"http":   true,
+}
+
+// expandHome expands a leading ~ of a path to the home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~")), nil
+}
+
+// NormalizeBackend checks a backend URL and turns a file path into a file:// URL
+func NormalizeBackend(backend string) (string, error) {
+	op := "set state backend"
+	if backend == "" {
+		return "", nil
+	}
+	scheme, rest, hasScheme := strings.Cut(backend, "://")
+	if !hasScheme {
+		scheme, rest = "file", backend
+	}
+	if !backendSchemes[scheme] {
+		return "", NewError(ValidationError, op, errors.New("backend '"+backend+"' must be a path, or a file://, s3://, azblob://, gs:// or https:// URL"))
+	}
+	if scheme != "file" {
+		return backend, nil
+	}
+	path, err := expandHome(rest)
+	if err != nil {
+		return "", NewError(ValidationError, op, err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", NewError(ValidationError, op, err)
+	}
+	return "file://" + path, nil
+}
+
+// stateBackend returns the URL of the state backend the stacks use
+func stateBackend() string {
+	if BackendURL != "" {
+		return BackendURL
+	}
+	homeDir, _ := os.UserHomeDir()
+	return "file://" + homeDir + "/.pulumi"
+}
+
+// sharedBackendDir returns the directory of a file backend set with --backend or the
+// config files, "" for the default one and the other backends
+func sharedBackendDir() string {
+	if !strings.HasPrefix(BackendURL, "file://") {
+		return ""
+	}
+	return strings.TrimPrefix(BackendURL, "file://")
+}
@@ -0,0 +1,241 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the catalogs shipped with ephstack, a catalog/<cloud>.json of the working directory
+// replaces the one of its cloud
+//
+//go:embed catalogs/*.json
+var shippedCatalogs embed.FS
+
+// the directory of the regenerated catalogs, next to the config directory
+const CatalogDir = "catalog"
+
+// SizeSpecType is what a VM size offers
+type SizeSpecType struct {
+	CPUs         int     `json:"cpus"`
+	MemoryGB     float64 `json:"memoryGb"`
+	MaxDataDisks int     `json:"maxDataDisks"`
+}
+
+// CatalogType is the offline catalog of the VM sizes, regions and images of a cloud
+type CatalogType struct {
+	Cloud   string                   `json:"cloud"`
+	Version string                   `json:"version"`
+	Sizes   map[string]*SizeSpecType `json:"sizes"`   // by size name
+	Regions map[string][]string      `json:"regions"` // the sizes offered, by region
+	Images  []string                 `json:"images"`  // publisher:offer:sku, the images of the offers listed are checked
+}
+
+// the catalogs loaded so far, by cloud
+var catalogs = make(map[string]*CatalogType)
+
+// LoadCatalog returns the catalog of a cloud, nil if there is none
+func LoadCatalog(cloudName string) (*CatalogType, error) {
+	if catalog, ok := catalogs[cloudName]; ok {
+		return catalog, nil
+	}
+	catalog := &CatalogType{}
+	found, err := readCatalogFile(cloudName, catalog)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		catalog = nil
+	}
+	catalogs[cloudName] = catalog
+	return catalog, nil
+}
+
+// readCatalogFile reads catalog/<name>.json, else the one shipped with ephstack, into v.
+// It returns false if there is neither.
+func readCatalogFile(name string, v interface{}) (bool, error) {
+	fileName := filepath.Join(CatalogDir, name+".json")
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		fileName = "catalogs/" + name + ".json"
+		data, err = shippedCatalogs.ReadFile(fileName)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, errors.New("catalog " + fileName + ": " + err.Error())
+	}
+	return true, nil
+}
+
+// size finds a size of the catalog, case insensitively like the cloud does
+func (catalog *CatalogType) size(sizeName string) (string, *SizeSpecType) {
+	for name, spec := range catalog.Sizes {
+		if strings.EqualFold(name, sizeName) {
+			return name, spec
+		}
+	}
+	return "", nil
+}
+
+// validate checks an infra entry's size, region, disks and image against the catalog
+func (catalog *CatalogType) validate(infraHW *InfraHwType) error {
+	where := infraHW.Sources["name"] // the file & entry declaring it
+	of := " (" + catalog.Cloud + " catalog " + catalog.Version + ")"
+
+	sizeName, spec := catalog.size(infraHW.Type)
+	if spec == nil {
+		return errors.New(where + ": unknown size '" + infraHW.Type + "'" + of)
+	}
+	if infraHW.Region != "" {
+		sizes, ok := catalog.Regions[strings.ToLower(infraHW.Region)]
+		if !ok {
+			return errors.New(where + ": unknown region '" + infraHW.Region + "'" + of)
+		}
+		offered := false
+		for _, name := range sizes {
+			offered = offered || name == sizeName
+		}
+		if !offered {
+			return errors.New(where + ": size " + sizeName + " is not offered in " + infraHW.Region + of)
+		}
+	}
+
+	for _, disk := range infraHW.Disks {
+		if sizeGB, err := strconv.Atoi(disk); err != nil || sizeGB <= 0 {
+			return errors.New(where + ": disk '" + disk + "' must be a size in GB")
+		}
+	}
+	if len(infraHW.Disks) > spec.MaxDataDisks {
+		return errors.New(where + ": " + strconv.Itoa(len(infraHW.Disks)) + " disks, size " + sizeName + " takes at most " + strconv.Itoa(spec.MaxDataDisks) + of)
+	}
+
+	// only the images of the offers the catalog lists are checked, by publisher:offer:sku
+	urn := strings.Split(strings.ToLower(infraHW.Image), ":")
+	if infraHW.Image == "" || len(urn) != 4 {
+		return nil
+	}
+	knownOffer := false
+	for _, image := range catalog.Images {
+		known := strings.Split(strings.ToLower(image), ":")
+		if len(known) < 3 || known[0] != urn[0] || known[1] != urn[1] {
+			continue
+		}
+		if known[2] == urn[2] {
+			return nil
+		}
+		knownOffer = true
+	}
+	if knownOffer {
+		return errors.New(where + ": unknown image '" + infraHW.Image + "'" + of)
+	}
+	return nil
+}
+
+// validateCatalog checks the infra entry of an app against the catalog of its cloud
+func validateCatalog(appInst *AppInstanceType) error {
+	cloudName, infraHW := lookupInfraCloud(appInst.Infra)
+	catalog, err := LoadCatalog(cloudName)
+	if err != nil || catalog == nil {
+		return err
+	}
+	return catalog.validate(infraHW)
+}
+
+// azureSize is a size as exported by 'az vm list-sizes --location <region> --output json'
+type azureSize struct {
+	Name             string `json:"name"`
+	NumberOfCores    int    `json:"numberOfCores"`
+	MemoryInMb       int    `json:"memoryInMb"`
+	MaxDataDiskCount int    `json:"maxDataDiskCount"`
+}
+
+// azureImage is an image as exported by 'az vm image list --all --output json'
+type azureImage struct {
+	Urn string `json:"urn"`
+}
+
+// RegenerateCatalog builds the catalog of a cloud from the data files exported from
+// it: one file of sizes per region, named <region>.json, and optionally a file of
+// images. Only azure exports are understood so far.
+func RegenerateCatalog(cloudName string, version string, sizeFiles []string, imagesFile string) (*CatalogType, error) {
+	op := "regenerate catalog of " + cloudName
+	if cloudName != "azure" {
+		return nil, NewError(ValidationError, op, errors.New("only azure exports can be read"))
+	}
+	catalog := &CatalogType{
+		Cloud:   cloudName,
+		Version: version,
+		Sizes:   make(map[string]*SizeSpecType),
+		Regions: make(map[string][]string),
+		Images:  make([]string, 0),
+	}
+
+	for _, sizeFile := range sizeFiles {
+		data, err := os.ReadFile(sizeFile)
+		if err != nil {
+			return nil, NewError(ParseError, op, err)
+		}
+		var sizes []azureSize
+		if err := json.Unmarshal(data, &sizes); err != nil {
+			return nil, NewError(ParseError, op, errors.New(sizeFile+": "+err.Error()))
+		}
+		region := strings.ToLower(strings.TrimSuffix(filepath.Base(sizeFile), filepath.Ext(sizeFile)))
+		for _, size := range sizes {
+			catalog.Sizes[size.Name] = &SizeSpecType{
+				CPUs:         size.NumberOfCores,
+				MemoryGB:     float64(size.MemoryInMb) / 1024,
+				MaxDataDisks: size.MaxDataDiskCount,
+			}
+			catalog.Regions[region] = append(catalog.Regions[region], size.Name)
+		}
+		sort.Strings(catalog.Regions[region])
+	}
+
+	if imagesFile != "" {
+		data, err := os.ReadFile(imagesFile)
+		if err != nil {
+			return nil, NewError(ParseError, op, err)
+		}
+		var images []azureImage
+		if err := json.Unmarshal(data, &images); err != nil {
+			return nil, NewError(ParseError, op, errors.New(imagesFile+": "+err.Error()))
+		}
+		// the versions of an image come and go, the catalog keeps its sku
+		seen := make(map[string]bool)
+		for _, image := range images {
+			urn := strings.Split(image.Urn, ":")
+			if len(urn) != 4 || seen[strings.Join(urn[:3], ":")] {
+				continue
+			}
+			seen[strings.Join(urn[:3], ":")] = true
+			catalog.Images = append(catalog.Images, strings.Join(urn[:3], ":"))
+		}
+		sort.Strings(catalog.Images)
+	}
+	return catalog, nil
+}
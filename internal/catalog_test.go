@@ -0,0 +1,79 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCatalogValidate(t *testing.T) {
+	catalog := &CatalogType{
+		Cloud:   "azure",
+		Version: "test",
+		Sizes: map[string]*SizeSpecType{
+			"Standard_B1s":    {CPUs: 1, MemoryGB: 1, MaxDataDisks: 2},
+			"Standard_DS2_v2": {CPUs: 2, MemoryGB: 7, MaxDataDisks: 8},
+		},
+		Regions: map[string][]string{
+			"westus": {"Standard_B1s", "Standard_DS2_v2"},
+			"eastus": {"Standard_DS2_v2"},
+		},
+		Images: []string{"Canonical:UbuntuServer:18.04-LTS", "OpenLogic:CentOS:7_9"},
+	}
+	tests := []struct {
+		infraHW InfraHwType
+		wantErr string
+	}{
+		{InfraHwType{Type: "standard_b1s", Region: "WestUS", Disks: []string{"128", "256"}, Image: "openlogic:centos:7_9:latest"}, ""},
+		{InfraHwType{Type: "Standard_DS2_v2"}, ""},
+		// the images of the offers the catalog doesn't list aren't checked
+		{InfraHwType{Type: "Standard_DS2_v2", Image: "perforce:centos7:7:latest"}, ""},
+		{InfraHwType{Type: "Standard_X1"}, "unknown size 'Standard_X1' (azure catalog test)"},
+		{InfraHwType{Type: "Standard_B1s", Region: "mars"}, "unknown region 'mars'"},
+		{InfraHwType{Type: "Standard_B1s", Region: "eastus"}, "size Standard_B1s is not offered in eastus"},
+		{InfraHwType{Type: "Standard_B1s", Disks: []string{"big"}}, "disk 'big' must be a size in GB"},
+		{InfraHwType{Type: "Standard_B1s", Disks: []string{"1", "2", "3"}}, "3 disks, size Standard_B1s takes at most 2"},
+		{InfraHwType{Type: "Standard_B1s", Image: "OpenLogic:CentOS:6_10:latest"}, "unknown image 'OpenLogic:CentOS:6_10:latest'"},
+	}
+	for _, test := range tests {
+		infraHW := test.infraHW
+		infraHW.Sources = map[string]string{"name": "azure.yaml: config.infra.x"}
+		err := catalog.validate(&infraHW)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%+v: %v", test.infraHW, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), "azure.yaml: config.infra.x: ") || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%+v: error %v, want %q", test.infraHW, err, test.wantErr)
+		}
+	}
+}
+
+// the shipped catalog takes the infra of the shipped config files
+func TestShippedCatalog(t *testing.T) {
+	catalog, err := LoadCatalog("azure")
+	if err != nil || catalog == nil {
+		t.Fatalf("no azure catalog: %v", err)
+	}
+	for _, infraHW := range []*InfraHwType{
+		{Type: "Standard_DS4_v2", Region: "westus", Image: "OpenLogic:CentOS:7_9:latest", Disks: []string{"128", "256"}},
+		{Type: "Standard_B2s", Region: "westus", Image: "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest"},
+	} {
+		if err := catalog.validate(infraHW); err != nil {
+			t.Errorf("%+v: %v", infraHW, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the keys of an app whose list of maps are merged key by key, instead of replaced
+var mergedAppKeys = map[string]bool{"facts": true, "tags": true}
+
+// MergeSettings deep merges override onto base, as read by viper: maps are merged key
+// by key, any other value of override replaces the one of base
+func MergeSettings(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		baseMap, baseOk := toSettings(merged[key])
+		overrideMap, overrideOk := toSettings(value)
+		if baseOk && overrideOk {
+			merged[key] = MergeSettings(baseMap, overrideMap)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// toSettings returns a viper map value with string keys
+func toSettings(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		settings := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			settings[fmt.Sprintf("%v", key)] = item
+		}
+		return settings, true
+	}
+	return nil, false
+}
+
+// mergeApp merges an app decl onto the decl it extends: facts and tags are merged
+// fact by fact, the other keys as in MergeSettings
+func mergeApp(base map[string]interface{}, app map[string]interface{}) map[string]interface{} {
+	merged := MergeSettings(base, app)
+	for key := range mergedAppKeys {
+		baseList, inBase := base[key]
+		appList, inApp := app[key]
+		if !inBase || !inApp {
+			continue
+		}
+		values := make(map[string]interface{})
+		for name, value := range FlattenMapList(baseList) {
+			values[name] = value
+		}
+		for name, value := range FlattenMapList(appList) {
+			values[name] = value
+		}
+		merged[key] = []interface{}{values}
+	}
+	return merged
+}
+
+// ResolveExtends merges every app of stack.apps that 'extends' another onto it, and
+// drops stack.bases. An app extends an entry of stack.bases, which is never deployed,
+// or another app.
+func ResolveExtends(settings map[string]interface{}, stackFileName string) error {
+	stack, ok := toSettings(settings["stack"])
+	if !ok {
+		return nil
+	}
+	apps, _ := toSettings(stack["apps"])
+	bases, _ := toSettings(stack["bases"])
+
+	// chain holds the bases and apps already extended, to detect cycles
+	var resolve func(decl map[string]interface{}, chain []string) (map[string]interface{}, error)
+	resolve = func(decl map[string]interface{}, chain []string) (map[string]interface{}, error) {
+		baseName, ok := decl["extends"].(string)
+		if !ok {
+			return decl, nil
+		}
+		// viper lower cases the names of the bases and apps
+		baseName = strings.ToLower(baseName)
+		link := "base " + baseName
+		baseDecl, ok := toSettings(bases[baseName])
+		if !ok {
+			link = "app " + baseName
+			baseDecl, ok = toSettings(apps[baseName])
+		}
+		if !ok {
+			return nil, errors.New("extends unknown base or app '" + baseName + "'")
+		}
+		for _, seen := range chain {
+			if seen == link {
+				return nil, errors.New("extends cycle " + strings.Join(append(chain, link), " -> "))
+			}
+		}
+		base, err := resolve(baseDecl, append(chain, link))
+		if err != nil {
+			return nil, err
+		}
+		merged := mergeApp(base, decl)
+		delete(merged, "extends")
+		return merged, nil
+	}
+
+	appNames := make([]string, 0, len(apps))
+	for appName := range apps {
+		appNames = append(appNames, appName)
+	}
+	sort.Strings(appNames)
+	resolved := make(map[string]interface{}, len(apps))
+	for _, appName := range appNames {
+		decl, _ := toSettings(apps[appName])
+		decl, err := resolve(decl, []string{"app " + appName})
+		if err != nil {
+			return NewError(ValidationError, "resolve extends in "+stackFileName, errors.New("app '"+appName+"': "+err.Error()))
+		}
+		resolved[appName] = decl
+	}
+	stack["apps"] = resolved
+	delete(stack, "bases")
+	settings["stack"] = stack
+	return nil
+}
+
+// renderedApp is an app of the parsed stack as printed by RenderStack
+type renderedApp struct {
+	Infra        string            `json:"infra"`
+	InfraHW      *InfraHwType      `json:"infraSettings,omitempty"` // with the file & entry each value came from
+	Config       string            `json:"config,omitempty"`
+	Facts        map[string]string `json:"facts,omitempty"`
+	SecretFacts  []string          `json:"secretFacts,omitempty"`
+	PasswordAuth bool              `json:"passwordAuth,omitempty"`
+	Subnet       string            `json:"subnet"`
+	Ports        []PortRuleType    `json:"ports,omitempty"`
+	PublicIP     string            `json:"publicIp"`
+	DNSLabel     string            `json:"dnsLabel,omitempty"`
+	Count        int               `json:"count,omitempty"`
+	Hosts        []string          `json:"hosts"`
+	UserData     string            `json:"userData,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// RenderStack prints the parsed stack, with its fragments included, its apps extended
+// and its references resolved, as json. Secret facts are masked.
+func RenderStack() ([]byte, error) {
+	layout := StackNetwork()
+	view := struct {
+		Name    string                  `json:"name"`
+		Env     string                  `json:"env"`
+		TTL     string                  `json:"ttl,omitempty"`
+		Network *NetworkType            `json:"network"`
+		Apps    map[string]*renderedApp `json:"apps"`
+	}{
+		Name:    StackInstance.Id,
+		Env:     StackInstance.Env,
+		Network: layout,
+		Apps:    make(map[string]*renderedApp, len(StackInstance.AppInstances)),
+	}
+	if StackInstance.TTL > 0 {
+		view.TTL = StackInstance.TTL.String()
+	}
+	for appName, appInst := range StackInstance.AppInstances {
+		app := &renderedApp{
+			Infra:        appInst.Infra,
+			InfraHW:      LookupInfraHW(appInst.Infra),
+			Config:       appInst.Config,
+			Facts:        appInst.MaskedFacts(),
+			SecretFacts:  appInst.SecretFacts,
+			PasswordAuth: appInst.PasswordAuth,
+			Subnet:       layout.appSubnet(appInst),
+			Ports:        appInst.Ports,
+			PublicIP:     appInst.PublicIP,
+			DNSLabel:     appInst.DNSLabel,
+			Count:        appInst.Count,
+			UserData:     appInst.UserData,
+			Tags:         appInst.Tags,
+		}
+		if app.PublicIP == "" {
+			app.PublicIP = PublicIPDynamic
+		}
+		for _, host := range appInst.hosts(appName) {
+			app.Hosts = append(app.Hosts, host.Name)
+		}
+		view.Apps[appName] = app
+	}
+	return json.MarshalIndent(view, "", "  ")
+}
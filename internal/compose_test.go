@@ -0,0 +1,109 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeSettings(t *testing.T) {
+	base := map[string]interface{}{
+		"name": "s1",
+		"apps": map[string]interface{}{
+			"web": map[string]interface{}{"infra": "small", "ports": []interface{}{"80"}},
+			"db":  map[string]interface{}{"infra": "small"},
+		},
+		"network": map[interface{}]interface{}{"address_space": "10.0.0.0/16"},
+	}
+	override := map[string]interface{}{
+		"apps": map[string]interface{}{
+			"web": map[string]interface{}{"infra": "large", "ports": []interface{}{"443"}},
+		},
+		"network": map[string]interface{}{"subnets": "x"},
+		"ttl":     "4h",
+	}
+	want := map[string]interface{}{
+		"name": "s1",
+		"apps": map[string]interface{}{
+			"web": map[string]interface{}{"infra": "large", "ports": []interface{}{"443"}},
+			"db":  map[string]interface{}{"infra": "small"},
+		},
+		"network": map[string]interface{}{"address_space": "10.0.0.0/16", "subnets": "x"},
+		"ttl":     "4h",
+	}
+	if got := MergeSettings(base, override); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeSettings = %v, want %v", got, want)
+	}
+	if web := base["apps"].(map[string]interface{})["web"].(map[string]interface{}); web["infra"] != "small" {
+		t.Errorf("MergeSettings changed its base: %v", web)
+	}
+}
+
+func TestResolveExtends(t *testing.T) {
+	settings := map[string]interface{}{
+		"stack": map[string]interface{}{
+			"bases": map[string]interface{}{
+				"linux": map[string]interface{}{"infra": "small", "facts": []interface{}{map[string]interface{}{"os": "linux", "tier": "none"}}},
+			},
+			"apps": map[string]interface{}{
+				"web":  map[string]interface{}{"extends": "Linux", "facts": []interface{}{map[string]interface{}{"tier": "web"}}},
+				"web2": map[string]interface{}{"extends": "web", "infra": "large"},
+			},
+		},
+	}
+	if err := ResolveExtends(settings, "s.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	stack := settings["stack"].(map[string]interface{})
+	if _, ok := stack["bases"]; ok {
+		t.Errorf("the bases are left in the stack")
+	}
+	apps := stack["apps"].(map[string]interface{})
+	web := apps["web"].(map[string]interface{})
+	if _, ok := web["extends"]; ok || web["infra"] != "small" {
+		t.Errorf("web is %v", web)
+	}
+	if facts := FlattenMapList(web["facts"]); !reflect.DeepEqual(facts, map[string]string{"os": "linux", "tier": "web"}) {
+		t.Errorf("web facts %v", facts)
+	}
+	web2 := apps["web2"].(map[string]interface{})
+	if web2["infra"] != "large" || FlattenMapList(web2["facts"])["tier"] != "web" {
+		t.Errorf("web2 is %v", web2)
+	}
+}
+
+func TestResolveExtendsErrors(t *testing.T) {
+	tests := []struct {
+		apps    map[string]interface{}
+		wantErr string
+	}{
+		{map[string]interface{}{
+			"a": map[string]interface{}{"extends": "b"},
+			"b": map[string]interface{}{"extends": "a"},
+		}, "app 'a': extends cycle app a -> app b -> app a"},
+		{map[string]interface{}{
+			"a": map[string]interface{}{"extends": "nope"},
+		}, "app 'a': extends unknown base or app 'nope'"},
+	}
+	for _, test := range tests {
+		err := ResolveExtends(map[string]interface{}{"stack": map[string]interface{}{"apps": test.apps}}, "s.yaml")
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) || ExitCode(err) != 3 {
+			t.Errorf("error %v, want the validation error %q", err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// the hours a month is billed for
+const HoursPerMonth = 730
+
+// PriceTableType is the local price table of a cloud, catalogs/<cloud>-prices.json
+type PriceTableType struct {
+	Cloud       string             `json:"cloud"`
+	Version     string             `json:"version"`
+	Currency    string             `json:"currency"`
+	Sizes       map[string]float64 `json:"sizes"`       // hourly price, by size
+	Regions     map[string]float64 `json:"regions"`     // factor of the size prices, 1 for the regions not listed
+	DiskGBMonth float64            `json:"diskGbMonth"` // monthly price of a GB of data disk, of dataDiskType
+	PublicIPs   map[string]float64 `json:"publicIps"`   // hourly price, by allocation
+}
+
+// AppCostType is the estimated spend of the hosts of an app
+type AppCostType struct {
+	App     string
+	Hosts   int
+	Size    string
+	Region  string
+	Hourly  float64
+	Monthly float64
+}
+
+// StackCostType is the estimated spend of the parsed stack
+type StackCostType struct {
+	Currency string
+	Apps     []AppCostType
+	Hourly   float64
+	Monthly  float64
+	Unpriced []string // the clouds without a price table, e.g. local, counted as free
+}
+
+// the price tables loaded so far, by cloud
+var priceTables = make(map[string]*PriceTableType)
+
+// LoadPriceTable returns the price table of a cloud, nil if there is none
+func LoadPriceTable(cloudName string) (*PriceTableType, error) {
+	if table, ok := priceTables[cloudName]; ok {
+		return table, nil
+	}
+	table := &PriceTableType{}
+	found, err := readCatalogFile(cloudName+"-prices", table)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		table = nil
+	}
+	priceTables[cloudName] = table
+	return table, nil
+}
+
+// hostHourly estimates the hourly price of a host of an app as GetDeployVMFunc deploys it:
+// its size in the region of the stack, its data disks and its public IP
+func (table *PriceTableType) hostHourly(appInst *AppInstanceType, infraHW *InfraHwType, region string) (float64, error) {
+	sizePrice, ok := 0.0, false
+	for name, price := range table.Sizes {
+		if strings.EqualFold(name, infraHW.Type) {
+			sizePrice, ok = price, true
+		}
+	}
+	if !ok {
+		return 0, errors.New("size '" + infraHW.Type + "' has no price in the " + table.Cloud + " price table " + table.Version)
+	}
+	if factor, ok := table.Regions[strings.ToLower(region)]; ok {
+		sizePrice *= factor
+	}
+
+	diskGB := 0
+	for _, disk := range infraHW.Disks {
+		sizeGB, _ := strconv.Atoi(disk)
+		diskGB += sizeGB
+	}
+	hourly := sizePrice + float64(diskGB)*table.DiskGBMonth/HoursPerMonth
+
+	switch appInst.PublicIP {
+	case PublicIPNone:
+	case "":
+		hourly += table.PublicIPs[PublicIPDynamic]
+	default:
+		hourly += table.PublicIPs[appInst.PublicIP]
+	}
+	return hourly, nil
+}
+
+// EstimateCost estimates the hourly and monthly spend of the apps of the parsed stack
+func EstimateCost() (*StackCostType, error) {
+	op := "estimate cost of stack " + StackInstance.Id
+	cost := &StackCostType{}
+	region, err := stackRegion()
+	if err != nil {
+		return nil, NewError(ValidationError, op, err)
+	}
+	for _, appName := range sortedAppNames() {
+		appInst := StackInstance.AppInstances[appName]
+		cloudName, infraHW := lookupInfraCloud(appInst.Infra)
+		if infraHW == nil {
+			return nil, NewError(ValidationError, op, errors.New("app '"+appName+"' refers to unknown infra '"+appInst.Infra+"'"))
+		}
+		appCost := AppCostType{
+			App:    appName,
+			Hosts:  len(appInst.hosts(appName)),
+			Size:   infraHW.Type,
+			Region: region,
+		}
+
+		table, err := LoadPriceTable(cloudName)
+		if err != nil {
+			return nil, NewError(ParseError, op, err)
+		}
+		if table == nil {
+			cost.Unpriced = appendUnique(cost.Unpriced, cloudName)
+		} else {
+			hourly, err := table.hostHourly(appInst, infraHW, region)
+			if err != nil {
+				return nil, NewError(ValidationError, op, errors.New("app '"+appName+"': "+err.Error()))
+			}
+			appCost.Hourly = hourly * float64(appCost.Hosts)
+			appCost.Monthly = appCost.Hourly * HoursPerMonth
+			cost.Currency = table.Currency
+		}
+		cost.Apps = append(cost.Apps, appCost)
+		cost.Hourly += appCost.Hourly
+		cost.Monthly += appCost.Monthly
+	}
+	return cost, nil
+}
+
+// appendUnique appends value to values unless it is there already
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// PrintCost prints the estimate per app and for the whole stack
+func PrintCost(cost *StackCostType) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "APP\tHOSTS\tSIZE\tREGION\tHOURLY\tMONTHLY")
+	for _, app := range cost.Apps {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%.4f\t%.2f\n", app.App, app.Hosts, app.Size, app.Region, app.Hourly, app.Monthly)
+	}
+	fmt.Fprintf(w, "total\t\t\t\t%.4f\t%.2f %s\n", cost.Hourly, cost.Monthly, cost.Currency)
+	w.Flush()
+	if len(cost.Unpriced) > 0 {
+		fmt.Println("no price table for " + strings.Join(cost.Unpriced, ", ") + ", counted as free")
+	}
+}
+
+// CheckBudget refuses a stack whose estimated monthly spend exceeds maxCost, else the
+// budget of the stack. There is no limit if both are 0.
+func CheckBudget(maxCost float64) error {
+	budget := maxCost
+	if budget == 0 {
+		budget = StackInstance.Budget
+	}
+	if budget == 0 {
+		return nil
+	}
+	cost, err := EstimateCost()
+	if err != nil {
+		return err
+	}
+	if cost.Monthly > budget {
+		return NewError(ValidationError, "check budget of stack "+StackInstance.Id,
+			fmt.Errorf("estimated monthly cost %.2f %s exceeds the budget of %.2f %s, see 'ephstack cost'", cost.Monthly, cost.Currency, budget, cost.Currency))
+	}
+	return nil
+}
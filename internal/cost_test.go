@@ -0,0 +1,112 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+var testPrices = &PriceTableType{
+	Cloud:       "azure",
+	Version:     "test",
+	Currency:    "USD",
+	Sizes:       map[string]float64{"Standard_B1s": 0.01, "Standard_DS2_v2": 0.1},
+	Regions:     map[string]float64{"westus": 1, "westeurope": 1.5},
+	DiskGBMonth: 0.073,
+	PublicIPs:   map[string]float64{PublicIPDynamic: 0.004, PublicIPStatic: 0.005},
+}
+
+func closeTo(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestHostHourly(t *testing.T) {
+	tests := []struct {
+		infraHW  InfraHwType
+		publicIP string
+		region   string
+		want     float64
+	}{
+		{InfraHwType{Type: "standard_b1s"}, PublicIPNone, "westus", 0.01},
+		{InfraHwType{Type: "Standard_B1s"}, "", "westus", 0.014},
+		{InfraHwType{Type: "Standard_B1s"}, PublicIPStatic, "westus", 0.015},
+		{InfraHwType{Type: "Standard_DS2_v2"}, PublicIPNone, "WestEurope", 0.15},
+		// the regions not listed are priced like the sizes
+		{InfraHwType{Type: "Standard_DS2_v2"}, PublicIPNone, "eastus", 0.1},
+		// 730 GB of disks cost a month what a GB costs an hour
+		{InfraHwType{Type: "Standard_B1s", Disks: []string{"365", "365"}}, PublicIPNone, "westus", 0.01 + 0.073},
+	}
+	for _, test := range tests {
+		got, err := testPrices.hostHourly(&AppInstanceType{PublicIP: test.publicIP}, &test.infraHW, test.region)
+		if err != nil || !closeTo(got, test.want) {
+			t.Errorf("%+v %q in %s: %v, %v, want %v", test.infraHW, test.publicIP, test.region, got, err, test.want)
+		}
+	}
+	if _, err := testPrices.hostHourly(&AppInstanceType{}, &InfraHwType{Type: "Standard_X1"}, "westus"); err == nil || !strings.Contains(err.Error(), "size 'Standard_X1' has no price") {
+		t.Errorf("an unpriced size gave %v", err)
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	priceTables["azure"] = testPrices
+	InfraHWInstances = &InfraHWInstancesMapType{
+		"azure": &InfraHWInstMapType{
+			"web": {Name: "web", Type: "Standard_B1s", Region: "westeurope"},
+			"db":  {Name: "db", Type: "Standard_DS2_v2", Disks: []string{"730"}},
+		},
+		"local": &InfraHWInstMapType{"local_small": {Name: "local_small", Type: "small", Region: "local"}},
+	}
+	defer func() {
+		delete(priceTables, "azure")
+		InfraHWInstances, StackInstance = nil, nil
+	}()
+
+	// the db has no region of its own, it is deployed in the one of the web
+	StackInstance = &StackType{Id: "s1", AppInstances: map[string]*AppInstanceType{
+		"web": {Infra: "web", Count: 2, PublicIP: PublicIPNone},
+		"db":  {Infra: "db", Count: 1, PublicIP: PublicIPNone},
+	}}
+	cost, err := EstimateCost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"db": 0.1*1.5 + 0.073, "web": 2 * 0.01 * 1.5}
+	for _, app := range cost.Apps {
+		if app.Region != "westeurope" || !closeTo(app.Hourly, want[app.App]) || !closeTo(app.Monthly, want[app.App]*HoursPerMonth) {
+			t.Errorf("app %+v, want %v an hour in westeurope", app, want[app.App])
+		}
+	}
+	if !closeTo(cost.Hourly, want["db"]+want["web"]) || cost.Currency != "USD" || len(cost.Unpriced) != 0 {
+		t.Errorf("cost %+v", cost)
+	}
+
+	StackInstance.Budget = 100
+	if err := CheckBudget(0); err == nil || ExitCode(err) != 3 {
+		t.Errorf("a stack over its budget gave %v", err)
+	}
+	if err := CheckBudget(1000); err != nil {
+		t.Errorf("a stack within --max-cost gave %v", err)
+	}
+
+	// the clouds without a price table are free
+	StackInstance = &StackType{Id: "s1", AppInstances: map[string]*AppInstanceType{"app": {Infra: "local_small", Count: 1}}}
+	cost, err = EstimateCost()
+	if err != nil || cost.Hourly != 0 || len(cost.Unpriced) != 1 || cost.Unpriced[0] != "local" {
+		t.Errorf("local cost %+v, %v", cost, err)
+	}
+}
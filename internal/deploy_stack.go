@@ -17,9 +17,10 @@ package ephstack
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pulumi/pulumi-azure/sdk/v4/go/azure/compute"
@@ -27,112 +28,251 @@ import (
 	"github.com/pulumi/pulumi-azure/sdk/v4/go/azure/network"
 	"github.com/pulumi/pulumi-random/sdk/v4/go/random"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
-	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
-	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
-	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
-// Webserver is a reusable web server component that creates and exports a NIC, public IP, and VM.
+// the image of the VMs whose infra sets none, and the region of the stacks whose infra sets none
+const (
+	defaultImage  = "canonical:UbuntuServer:16.04-LTS:latest"
+	defaultRegion = "westus"
+)
+
+// the managed disk type of the data disks, priced by the diskGbMonth of the price table
+const dataDiskType = "Standard_LRS"
+
+// the admin user of the VMs
+const vmUsername = "pulumi"
+
+// the public IP allocations an app can choose
+const (
+	PublicIPNone    = "none"    // private only, reachable from the virtual network
+	PublicIPDynamic = "dynamic" // allocated when the VM starts, may change
+	PublicIPStatic  = "static"  // allocated with the IP resource, kept until it is destroyed
+)
+
+// Webserver is a reusable web server component that creates and exports a NIC, an optional public IP, and VM.
 type Webserver struct {
 	pulumi.ResourceState
 
 	PublicIP         *network.PublicIp
 	NetworkInterface *network.NetworkInterface
+	SecurityGroup    *network.NetworkSecurityGroup
 	VM               *compute.VirtualMachine
+
+	name           string
+	args           *WebserverArgs
+	staticIP       bool
+	vmDependencies []pulumi.Resource
 }
 
 type WebserverArgs struct {
 	// A required username for the VM login.
 	Username pulumi.StringInput
 
-	// A required encrypted password for the VM password.
+	// A required OpenSSH public key authorized for the admin user.
+	SSHPublicKey pulumi.StringInput
+
+	// An optional encrypted password for the VM password, only used when PasswordAuth is set.
 	Password pulumi.StringInput
 
-	// An optional boot script that the VM will use.
-	BootScript pulumi.StringInput
+	// Allow password logins in addition to the SSH key; disabled by default.
+	PasswordAuth bool
 
 	// An optional VM size; if unspecified, Standard_A0 (micro) will be used.
 	VMSize pulumi.StringInput
 
+	// An optional image URN, publisher:offer:sku:version; if unspecified, defaultImage will be used.
+	Image string
+
+	// Optional sizes in GB of the empty data disks attached to the VM, in this order.
+	DataDisks []string
+
 	// A required Resource Group in which to create the VM
 	ResourceGroupName pulumi.StringInput
 
 	// A required Subnet in which to deploy the VM
 	SubnetID pulumi.StringInput
+
+	// An optional public IP allocation, none, dynamic or static; dynamic if unspecified.
+	PublicIP string
+
+	// An optional DNS label of the public IP.
+	DNSLabel string
+
+	// Optional inbound rules; if set, the NIC gets a security group that only lets them in.
+	SecurityRules network.NetworkSecurityGroupSecurityRuleArrayInput
+
+	// Optional tags of all the resources of the web server.
+	Tags pulumi.StringMapInput
 }
 
-// NewWebserver allocates a new web server VM, NIC, and public IP address.
+// NewWebserver allocates the NIC and public IP address of a new web server; StartVM then
+// creates its VM. The two steps let a boot script refer to the addresses of other servers.
 func NewWebserver(ctx *pulumi.Context, name string, args *WebserverArgs, opts ...pulumi.ResourceOption) (*Webserver, error) {
-	webserver := &Webserver{}
+	webserver := &Webserver{name: name, args: args}
 	err := ctx.RegisterComponentResource("ws-ts-azure-comp:webserver:WebServer", name, webserver, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	webserver.PublicIP, err = network.NewPublicIp(ctx, name+"-ip", &network.PublicIpArgs{
-		ResourceGroupName: args.ResourceGroupName,
-		AllocationMethod:  pulumi.String("Dynamic"),
-	}, pulumi.Parent(webserver))
-	if err != nil {
-		return nil, err
+	ipConfig := network.NetworkInterfaceIpConfigurationArgs{
+		Name:                       pulumi.String("webserveripcfg"),
+		SubnetId:                   args.SubnetID.ToStringOutput(),
+		PrivateIpAddressAllocation: pulumi.String("Dynamic"),
+	}
+	if args.PublicIP != PublicIPNone {
+		ipArgs := &network.PublicIpArgs{
+			ResourceGroupName: args.ResourceGroupName,
+			AllocationMethod:  pulumi.String("Dynamic"),
+			Tags:              args.Tags,
+		}
+		if args.PublicIP == PublicIPStatic {
+			ipArgs.AllocationMethod = pulumi.String("Static")
+			webserver.staticIP = true
+		}
+		if args.DNSLabel != "" {
+			ipArgs.DomainNameLabel = pulumi.String(args.DNSLabel)
+		}
+		webserver.PublicIP, err = network.NewPublicIp(ctx, name+"-ip", ipArgs, pulumi.Parent(webserver))
+		if err != nil {
+			return nil, err
+		}
+		ipConfig.PublicIpAddressId = webserver.PublicIP.ID()
+		webserver.vmDependencies = append(webserver.vmDependencies, webserver.PublicIP)
 	}
 
 	webserver.NetworkInterface, err = network.NewNetworkInterface(ctx, name+"-nic", &network.NetworkInterfaceArgs{
 		ResourceGroupName: args.ResourceGroupName,
-		IpConfigurations: network.NetworkInterfaceIpConfigurationArray{
-			network.NetworkInterfaceIpConfigurationArgs{
-				Name:                       pulumi.String("webserveripcfg"),
-				SubnetId:                   args.SubnetID.ToStringOutput(),
-				PrivateIpAddressAllocation: pulumi.String("Dynamic"),
-				PublicIpAddressId:          webserver.PublicIP.ID(),
-			},
-		},
+		IpConfigurations:  network.NetworkInterfaceIpConfigurationArray{ipConfig},
+		Tags:              args.Tags,
 	}, pulumi.Parent(webserver))
 	if err != nil {
 		return nil, err
 	}
+	webserver.vmDependencies = append(webserver.vmDependencies, webserver.NetworkInterface)
+
+	if args.SecurityRules != nil {
+		webserver.SecurityGroup, err = network.NewNetworkSecurityGroup(ctx, name+"-nsg", &network.NetworkSecurityGroupArgs{
+			ResourceGroupName: args.ResourceGroupName,
+			SecurityRules:     args.SecurityRules,
+			Tags:              args.Tags,
+		}, pulumi.Parent(webserver))
+		if err != nil {
+			return nil, err
+		}
+		_, err = network.NewNetworkInterfaceSecurityGroupAssociation(ctx, name+"-nsg-assoc", &network.NetworkInterfaceSecurityGroupAssociationArgs{
+			NetworkInterfaceId:     webserver.NetworkInterface.ID(),
+			NetworkSecurityGroupId: webserver.SecurityGroup.ID(),
+		}, pulumi.Parent(webserver))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return webserver, nil
+}
 
+// StartVM creates the web server's VM, which runs bootScript on its first boot.
+func (ws *Webserver) StartVM(ctx *pulumi.Context, bootScript pulumi.StringInput) error {
+	name, args := ws.name, ws.args
 	vmSize := args.VMSize
 	if vmSize == nil {
 		vmSize = pulumi.String("Standard_A0")
 	}
+	imageRef, err := imageReference(args.Image)
+	if err != nil {
+		return err
+	}
+	dataDisks, err := dataDiskArray(name, args.DataDisks)
+	if err != nil {
+		return err
+	}
+
+	osProfile := compute.VirtualMachineOsProfileArgs{
+		ComputerName:  pulumi.String(name),
+		AdminUsername: args.Username,
+		CustomData:    bootScript.ToStringOutput(),
+	}
+	if args.PasswordAuth {
+		osProfile.AdminPassword = args.Password.ToStringOutput()
+	}
 
-	// Now create the VM, using the resource group and NIC allocated above.
-	webserver.VM, err = compute.NewVirtualMachine(ctx, name+"-vm", &compute.VirtualMachineArgs{
+	// Now create the VM, using the resource group and NIC allocated by NewWebserver.
+	ws.VM, err = compute.NewVirtualMachine(ctx, name+"-vm", &compute.VirtualMachineArgs{
 		ResourceGroupName:            args.ResourceGroupName,
-		NetworkInterfaceIds:          pulumi.StringArray{webserver.NetworkInterface.ID()},
+		NetworkInterfaceIds:          pulumi.StringArray{ws.NetworkInterface.ID()},
 		VmSize:                       vmSize,
 		DeleteDataDisksOnTermination: pulumi.Bool(true),
 		DeleteOsDiskOnTermination:    pulumi.Bool(true),
-		OsProfile: compute.VirtualMachineOsProfileArgs{
-			ComputerName:  pulumi.String("hostname"),
-			AdminUsername: args.Username,
-			AdminPassword: args.Password.ToStringOutput(),
-			CustomData:    args.BootScript.ToStringOutput(),
-		},
+		OsProfile:                    osProfile,
+		Tags:                         args.Tags,
 		OsProfileLinuxConfig: compute.VirtualMachineOsProfileLinuxConfigArgs{
-			DisablePasswordAuthentication: pulumi.Bool(false),
+			DisablePasswordAuthentication: pulumi.Bool(!args.PasswordAuth),
+			SshKeys: compute.VirtualMachineOsProfileLinuxConfigSshKeyArray{
+				compute.VirtualMachineOsProfileLinuxConfigSshKeyArgs{
+					KeyData: args.SSHPublicKey,
+					Path:    pulumi.Sprintf("/home/%s/.ssh/authorized_keys", args.Username),
+				},
+			},
 		},
+		// named after the host, so an unchanged VM is left alone; the random names of the
+		// earlier versions replaced every VM on every deploy, and once more on this change
 		StorageOsDisk: compute.VirtualMachineStorageOsDiskArgs{
 			CreateOption: pulumi.String("FromImage"),
-			Name:         pulumi.String(fmt.Sprintf("%d", rangeIn(10000000, 99999999))),
+			Name:         pulumi.String(name + "-osdisk"),
 		},
-		StorageImageReference: compute.VirtualMachineStorageImageReferenceArgs{
-			Publisher: pulumi.String("canonical"),
-			Offer:     pulumi.String("UbuntuServer"),
-			Sku:       pulumi.String("16.04-LTS"),
-			Version:   pulumi.String("latest"),
-		},
-	}, pulumi.Parent(webserver), pulumi.DependsOn([]pulumi.Resource{webserver.NetworkInterface, webserver.PublicIP}))
-	if err != nil {
-		return nil, err
+		StorageImageReference: imageRef,
+		StorageDataDisks:      dataDisks,
+	}, pulumi.Parent(ws), pulumi.DependsOn(ws.vmDependencies))
+	return err
+}
+
+// dataDiskArray builds the data disks of a VM from their sizes in GB, named after the
+// host and their LUN, which is their index
+func dataDiskArray(name string, disks []string) (compute.VirtualMachineStorageDataDiskArray, error) {
+	dataDisks := compute.VirtualMachineStorageDataDiskArray{}
+	for lun, disk := range disks {
+		sizeGB, err := strconv.Atoi(disk)
+		if err != nil || sizeGB <= 0 {
+			return nil, errors.New("disk '" + disk + "' must be a size in GB")
+		}
+		dataDisks = append(dataDisks, compute.VirtualMachineStorageDataDiskArgs{
+			Name:            pulumi.String(fmt.Sprintf("%s-data%d", name, lun)),
+			CreateOption:    pulumi.String("Empty"),
+			DiskSizeGb:      pulumi.Int(sizeGB),
+			Lun:             pulumi.Int(lun),
+			ManagedDiskType: pulumi.String(dataDiskType),
+		})
 	}
+	return dataDisks, nil
+}
 
-	return webserver, nil
+// imageReference turns an image URN, publisher:offer:sku:version, into the image of a VM
+func imageReference(image string) (compute.VirtualMachineStorageImageReferenceArgs, error) {
+	if image == "" {
+		image = defaultImage
+	}
+	urn := strings.Split(image, ":")
+	if len(urn) != 4 {
+		return compute.VirtualMachineStorageImageReferenceArgs{}, errors.New("image '" + image + "' is not a URN publisher:offer:sku:version")
+	}
+	return compute.VirtualMachineStorageImageReferenceArgs{
+		Publisher: pulumi.String(urn[0]),
+		Offer:     pulumi.String(urn[1]),
+		Sku:       pulumi.String(urn[2]),
+		Version:   pulumi.String(urn[3]),
+	}, nil
 }
 
+// GetIPAddress returns the address the VM is reached at: its public IP, or its
+// private one if it has none
 func (ws *Webserver) GetIPAddress(ctx *pulumi.Context) pulumi.StringOutput {
+	if ws.PublicIP == nil {
+		return ws.NetworkInterface.PrivateIpAddress
+	}
+	// A static IP address is allocated along with its resource.
+	if ws.staticIP {
+		return ws.PublicIP.IpAddress
+	}
 	// The public IP address is not allocated until the VM is running, so wait for that resource to create, and then
 	// lookup the IP address again to report its public IP.
 	ready := pulumi.All(ws.VM.ID(), ws.PublicIP.Name, ws.PublicIP.ResourceGroupName)
@@ -150,183 +290,433 @@ func (ws *Webserver) GetIPAddress(ctx *pulumi.Context) pulumi.StringOutput {
 	}).(pulumi.StringOutput)
 }
 
-func rangeIn(low, hi int) int {
-	rand.Seed(time.Now().UnixNano())
-	return low + rand.Intn(hi-low)
+// GetFQDN returns the DNS name of the VM's public IP, empty if it has no DNS label
+func (ws *Webserver) GetFQDN() pulumi.StringOutput {
+	if ws.PublicIP == nil {
+		return pulumi.String("").ToStringOutput()
+	}
+	return ws.PublicIP.Fqdn
 }
 
-func ProvisionInfrastructure() error {
-
-	ctx := context.Background()
+// prepareAppStack creates or selects the pulumi stack of the parsed stack's environment,
+// ready to run the VM program. It also returns the workspace options the networking
+// stack needs: the secrets provider and the state backend.
+func prepareAppStack(ctx context.Context) (auto.Stack, []auto.LocalWorkspaceOption, error) {
 	pulumiProjectName := StackInstance.Id
-	pulumiStackName := "dev"
-
-	// Specify a local backend instead of using the service.
-	homeDir,_ := os.UserHomeDir()
-	pulumiWorkspaceDir := "file://" + homeDir + "/.pulumi"
-	project := auto.Project(workspace.Project{
-		Name:    tokens.PackageName(pulumiProjectName),
-		Runtime: workspace.NewProjectRuntimeInfo("go", nil),
-		Backend: &workspace.ProjectBackend{
-			URL: pulumiWorkspaceDir,
-		},
-	})
+	pulumiStackName := StackInstance.Env
 
-	// Setup a passphrase secrets provider and use an environment variable to pass in the passphrase.
-	// secretsProvider := auto.SecretsProvider("passphrase")
-	// envvars := auto.EnvVars(map[string]string{
-	// 	// In a real program, you would feed in the password securely or via the actual environment.
-	// 	"PULUMI_CONFIG_PASSPHRASE": "password",
-	// })
-
-	// stackSettings := auto.Stacks(map[string]workspace.ProjectStack{
-	// 	"stackName" : {SecretsProvider: "passphrase"},
-	// })
+	// Setup the secrets provider, by default a passphrase one, so generated credentials are encrypted in state
+	secretsOpts, err := secretsProviderOptions()
+	if err != nil {
+		return auto.Stack{}, nil, NewError(ValidationError, "setup secrets provider", err)
+	}
 
 	// create or select a stack matching the specified name and project.
 	// this will set up a workspace with everything necessary to run our inline program (deployFunc)
-	stack, err := auto.UpsertStackInlineSource(ctx, pulumiStackName, pulumiProjectName, nil, project)
+	// a copy, appending to secretsOpts could write into the array of its caller
+	wsOpts := append(append([]auto.LocalWorkspaceOption{}, secretsOpts...), projectOption(pulumiProjectName))
+	stack, err := auto.UpsertStackInlineSource(ctx, pulumiStackName, pulumiProjectName, nil, wsOpts...)
 	if err != nil {
-		fmt.Print("Stack creation error: ")
-		fmt.Println(err)
-		os.Exit(1)
+		return auto.Stack{}, nil, provisioningError("create stack "+pulumiProjectName+"/"+pulumiStackName, err)
 	}
-	fmt.Println("finished creating stack ")
+	logStatus(pulumiStackName, "", "finished creating stack ")
 
 	w := stack.Workspace()
 	if w == nil {
-		fmt.Println("workspace is nil")
-		os.Exit(1)
+		return auto.Stack{}, nil, NewError(ProvisioningError, "create stack "+pulumiProjectName+"/"+pulumiStackName, errors.New("workspace is nil"))
 	}
 	err = w.InstallPlugin(ctx, "azure", "v4.0.0")
 	if err != nil {
-		fmt.Printf("Failed to install program plugins: %v\n", err)
-		os.Exit(1)
+		return auto.Stack{}, nil, provisioningError("install program plugins", err)
+	}
+
+	region, err := stackRegion()
+	if err != nil {
+		return auto.Stack{}, nil, NewError(ValidationError, "set config", err)
+	}
+	err = stack.SetConfig(ctx, "azure:location", auto.ConfigValue{Value: region})
+	if err != nil {
+		return auto.Stack{}, nil, provisioningError("set config", err)
+	}
+	return stack, wsOpts, nil
+}
+
+// azureProvider provisions the apps as Azure VMs with pulumi
+type azureProvider struct{}
+
+// Provision deploys the network and the VMs of the parsed stack.
+func (azureProvider) Provision(ctx context.Context) error {
+
+	pulumiProjectName := StackInstance.Id
+	pulumiStackName := StackInstance.Env
+
+	stack, wsOpts, err := prepareAppStack(ctx)
+	if err != nil {
+		return err
 	}
+	w := stack.Workspace()
 
-	err = stack.SetConfig(ctx, "azure:location", auto.ConfigValue{Value: "westus"})
+	logStatus(pulumiStackName, "", "ensuring network is configured...")
+	subnetIDs, rgName, err := EnsureNetwork(ctx, pulumiProjectName, StackInstance.Env, StackNetwork(), wsOpts...)
 	if err != nil {
-		fmt.Printf("Failed to set config: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 
-	fmt.Println("ensuring network is configured...")
-	subnetID, rgName, _ := EnsureNetwork(ctx, pulumiProjectName)
+	// the keypair and expiry of the deployed environment are kept
+	outs, err := stack.Outputs(ctx)
+	if err != nil {
+		return provisioningError("get vm stack outputs", err)
+	}
+	keyPair, err := outputsKeyPair(outs)
+	if err != nil {
+		return provisioningError("generate SSH keypair", err)
+	}
 
 	// set out program for the deployment with the resulting network info
-	w.SetProgram(GetDeployVMFunc(subnetID, rgName))
+	w.SetProgram(GetDeployVMFunc(subnetIDs, rgName, keyPair, environmentExpiry(outs)))
 
-	fmt.Println("deploying vm webserver...")
+	logStatus(pulumiStackName, "", "deploying vm webservers...")
 
-	// wire up our update to stream progress to stdout
-	stdoutStreamer := optup.ProgressStreams(os.Stdout)
-	
-	res, err := stack.Up(ctx, stdoutStreamer)
+	// stream the progress to stdout, grouped per app
+	res, err := upWithProgress(ctx, stack, pulumiStackName, sortedAppNames())
 	if err != nil {
-		fmt.Printf("Failed to deploy vm stack: %v\n", err)
-		os.Exit(1)
+		return provisioningError("deploy vm stack", err)
+	}
+	for _, host := range stackHosts() {
+		appInst := StackInstance.AppInstances[host.App]
+		if host.Index == 0 {
+			appInst.Creds = AppCredentials(res.Outputs, host.Name)
+		}
+		appOuts, _ := res.Outputs[host.Name].Value.(map[string]interface{})
+		where := fmt.Sprintf("public IP %v", appOuts["ip"])
+		if appInst.PublicIP == PublicIPNone {
+			where = fmt.Sprintf("private IP %v", appOuts["ip"])
+		} else if fqdn, _ := appOuts["fqdn"].(string); fqdn != "" {
+			where = fmt.Sprintf("%s, public IP %v", fqdn, appOuts["ip"])
+		}
+		logStatus(pulumiStackName, host.App, fmt.Sprintf("deployed %s running at %s", host.Name, where))
+	}
+	if expiresAt, ok := res.Outputs["expiresAt"].Value.(string); ok {
+		logStatus(pulumiStackName, "", fmt.Sprintf("environment %s of stack %s expires at %s", StackInstance.Env, StackInstance.Id, expiresAt))
 	}
-	fmt.Printf("deployed server running at public IP %s\n", res.Outputs["ip"].Value.(string))
 	return nil
 }
 
+// Preview shows what deploying the parsed stack would change, without changing
+// anything. A network that isn't deployed yet is previewed too, and the VMs are
+// previewed against placeholder subnets.
+func (azureProvider) Preview(ctx context.Context) error {
+
+	pulumiProjectName := StackInstance.Id
+	pulumiStackName := StackInstance.Env
+
+	stack, wsOpts, err := prepareAppStack(ctx)
+	if err != nil {
+		return err
+	}
+
+	layout := StackNetwork()
+	networkStack, err := auto.UpsertStackInlineSource(ctx, networkStackName(pulumiStackName), pulumiProjectName, GetDeployNetworkFunc(layout), wsOpts...)
+	if err != nil {
+		return provisioningError("create or select stack "+networkStackName(pulumiStackName), err)
+	}
+	region, err := stackRegion()
+	if err != nil {
+		return NewError(ValidationError, "set networking config", err)
+	}
+	if err := networkStack.SetConfig(ctx, "azure:location", auto.ConfigValue{Value: region}); err != nil {
+		return provisioningError("set networking config", err)
+	}
+	if _, err := previewWithProgress(ctx, networkStack, networkStackName(pulumiStackName), nil); err != nil {
+		return provisioningError("preview network stack", err)
+	}
+
+	// subnets that are not deployed yet are previewed against placeholders
+	outs, err := networkStack.Outputs(ctx)
+	if err != nil {
+		return provisioningError("get networking stack outputs", err)
+	}
+	subnetIDs, rgName := networkOutputs(outs)
+	if rgName == "" {
+		rgName = mockRGName
+	}
+	for _, subnet := range layout.Subnets {
+		if subnetIDs[subnet.Name] == "" {
+			subnetIDs[subnet.Name] = mockSubnetID(subnet.Name)
+		}
+	}
+
+	// the keypair and expiry of the deployed environment are kept
+	vmOuts, err := stack.Outputs(ctx)
+	if err != nil {
+		return provisioningError("get vm stack outputs", err)
+	}
+	keyPair, err := outputsKeyPair(vmOuts)
+	if err != nil {
+		return provisioningError("generate SSH keypair", err)
+	}
+	stack.Workspace().SetProgram(GetDeployVMFunc(subnetIDs, rgName, keyPair, environmentExpiry(vmOuts)))
+
+	res, err := previewWithProgress(ctx, stack, pulumiStackName, sortedAppNames())
+	if err != nil {
+		return provisioningError("preview vm stack", err)
+	}
+	logStatus(pulumiStackName, "", "preview: "+summaryMessage(res.ChangeSummary))
+	return nil
+}
+
+// AppCredentials builds the login credentials of a host, or of an app's first host, from the outputs of its stack
+func AppCredentials(outs auto.OutputMap, appName string) Credentials {
+	creds := Credentials{}
+	creds.Public_key, _ = outs[sshPublicKeyOutput].Value.(string)
+	creds.Private_key, _ = outs[sshPrivateKeyOutput].Value.(string)
+
+	appOuts, ok := hostOutputs(outs, appName)
+	if !ok {
+		return creds
+	}
+	creds.Username, _ = appOuts["username"].(string)
+	creds.Password, _ = appOuts["password"].(string)
+	return creds
+}
+
 // func rangeIn(low, hi int) int {
 // 	rand.Seed(time.Now().UnixNano())
 // 	return low + rand.Intn(hi-low)
 // }
 
-func GetDeployVMFunc(subnetID, rgName string) pulumi.RunFunc {
+// environmentExpiry returns when the environment of the parsed stack expires, as
+// recorded in the outputs of its earlier deploys: its ttl runs from when it was
+// first deployed, not from its latest deploy. It is empty without a ttl.
+func environmentExpiry(outs auto.OutputMap) string {
+	if StackInstance.TTL <= 0 {
+		return ""
+	}
+	if expiresAt, ok := outs["expiresAt"].Value.(string); ok {
+		if _, err := time.Parse(time.RFC3339, expiresAt); err == nil {
+			return expiresAt
+		}
+	}
+	return time.Now().Add(StackInstance.TTL).UTC().Format(time.RFC3339)
+}
+
+// GetDeployVMFunc returns a pulumi program that creates one VM per host of the apps
+// in the stack, each exported under the host's name, and the expiresAt time if set.
+// Every VM authorizes the stack's SSH public key; password logins are only
+// enabled, with a generated password, for apps that ask for them.
+func GetDeployVMFunc(subnetIDs map[string]string, rgName string, keyPair *SSHKeyPair, expiresAt string) pulumi.RunFunc {
 	return func(ctx *pulumi.Context) error {
-		username := "pulumi"
-		password, err := random.NewRandomPassword(ctx, "password", &random.RandomPasswordArgs{
-			Length:  pulumi.Int(16),
-			Special: pulumi.Bool(false),
-		})
-		if err != nil {
-			return err
+		layout := StackNetwork()
+		hosts := stackHosts()
+
+		// the NICs of all the hosts come first, so the boot scripts can refer to their addresses
+		servers := make(map[string]*Webserver, len(hosts))
+		hostOutputs := make(map[string]pulumi.Map, len(hosts))
+		privateIPs := pulumi.StringMap{}
+		for _, host := range hosts {
+			appInst := StackInstance.AppInstances[host.App]
+			args := &WebserverArgs{
+				Username:          pulumi.String(vmUsername),
+				SSHPublicKey:      pulumi.String(keyPair.PublicKey),
+				ResourceGroupName: pulumi.String(rgName),
+				SubnetID:          pulumi.String(subnetIDs[layout.appSubnet(appInst)]),
+				PublicIP:          appInst.PublicIP,
+			}
+			if appInst.DNSLabel != "" {
+				// every host of an app needs a label of its own
+				args.DNSLabel = appInst.DNSLabel
+				if host.Index > 0 {
+					args.DNSLabel = appInst.DNSLabel + "-" + strconv.Itoa(host.Index)
+				}
+			}
+			tags := pulumi.StringMap{}
+			if infraHW := LookupInfraHW(appInst.Infra); infraHW != nil {
+				args.VMSize = pulumi.String(infraHW.Type)
+				args.Image = infraHW.Image
+				args.DataDisks = infraHW.Disks
+				for key, value := range infraHW.Tags {
+					tags[key] = pulumi.String(value)
+				}
+			}
+			for key, value := range appInst.Tags {
+				tags[key] = pulumi.String(value)
+			}
+			if len(tags) > 0 {
+				args.Tags = tags
+			}
+			rules, err := appSecurityRules(appInst, layout)
+			if err != nil {
+				return err
+			}
+			if rules != nil {
+				args.SecurityRules = rules
+			}
+
+			// facts are kept in the app's outputs for the config runners, secret ones encrypted
+			facts := pulumi.Map{}
+			for key, value := range appInst.hostFacts(host) {
+				if appInst.IsSecretFact(key) {
+					facts[key] = pulumi.ToSecret(pulumi.String(value))
+				} else {
+					facts[key] = pulumi.String(value)
+				}
+			}
+
+			appOutputs := pulumi.Map{
+				"app":      pulumi.String(host.App),
+				"username": pulumi.String(vmUsername),
+				"facts":    facts,
+			}
+			if appInst.PasswordAuth {
+				password, err := random.NewRandomPassword(ctx, host.Name+"-password", &random.RandomPasswordArgs{
+					Length:  pulumi.Int(16),
+					Special: pulumi.Bool(false),
+				})
+				if err != nil {
+					return err
+				}
+				args.Password = password.Result
+				args.PasswordAuth = true
+				appOutputs["password"] = pulumi.ToSecret(password.Result)
+			}
+
+			server, err := NewWebserver(ctx, host.Name, args)
+			if err != nil {
+				return err
+			}
+			servers[host.Name] = server
+			hostOutputs[host.Name] = appOutputs
+			privateIPs[host.Name] = server.NetworkInterface.PrivateIpAddress
 		}
 
-		server, err := NewWebserver(ctx, "vm-webserver", &WebserverArgs{
-			Username: pulumi.String(username),
-			Password: password.Result,
-			BootScript: pulumi.String(fmt.Sprintf(`#!/bin/bash
-	echo "Hello, from VMGR!" > index.html
-	nohup python -m SimpleHTTPServer 80 &`)),
-			ResourceGroupName: pulumi.String(rgName),
-			SubnetID:          pulumi.String(subnetID),
-		})
-		if err != nil {
-			return err
+		for _, host := range hosts {
+			appInst, server, appOutputs := StackInstance.AppInstances[host.App], servers[host.Name], hostOutputs[host.Name]
+			if err := server.StartVM(ctx, bootScript(appInst, host, server, privateIPs)); err != nil {
+				return err
+			}
+
+			appOutputs["ip"] = server.GetIPAddress(ctx)
+			appOutputs["privateIp"] = server.NetworkInterface.PrivateIpAddress
+			if appInst.DNSLabel != "" {
+				appOutputs["fqdn"] = server.GetFQDN()
+			}
+			ctx.Export(host.Name, appOutputs)
+		}
+
+		if expiresAt != "" {
+			ctx.Export("expiresAt", pulumi.String(expiresAt))
 		}
 
-		ctx.Export("ip", server.GetIPAddress(ctx))
+		ctx.Export(sshPublicKeyOutput, pulumi.String(keyPair.PublicKey))
+		ctx.Export(sshPrivateKeyOutput, pulumi.ToSecret(pulumi.String(keyPair.PrivateKey)))
 		return nil
 	}
 }
 
-// EnsureNetwork deploys the network stack if none exists, or simply returns the associated
-// subnetID and resourceGroupName
-func EnsureNetwork(ctx context.Context, projectName string) (string, string, error) {
-	pulumiStackName := "networking"
+// bootScript renders the user_data of a host once the addresses it may refer to are
+// allocated. It is kept secret in the state if the app has secret facts.
+func bootScript(appInst *AppInstanceType, host appHost, server *Webserver, privateIPs pulumi.StringMap) pulumi.StringOutput {
+	ip := pulumi.String("").ToStringOutput()
+	if server.staticIP {
+		ip = server.PublicIP.IpAddress
+	}
+	script := pulumi.All(privateIPs.ToStringMapOutput(), ip, server.GetFQDN()).ApplyT(func(args []interface{}) (string, error) {
+		ips := args[0].(map[string]string)
+		self := map[string]string{
+			"username":  vmUsername,
+			"privateIp": ips[host.Name],
+			"ip":        args[1].(string),
+			"fqdn":      args[2].(string),
+		}
+		return appInst.renderUserData(host, self, ips, false)
+	}).(pulumi.StringOutput)
+	if len(appInst.SecretFacts) > 0 {
+		return pulumi.ToSecret(script).(pulumi.StringOutput)
+	}
+	return script
+}
+
+// EnsureNetwork deploys the network stack of an environment, or updates it when its layout
+// changed, and returns the IDs of its subnets by name and its resource group name
+func EnsureNetwork(ctx context.Context, projectName string, envName string, network *NetworkType, opts ...auto.LocalWorkspaceOption) (map[string]string, string, error) {
+	pulumiStackName := networkStackName(envName)
 	// create or select a stack with the inline networking program
-	s, err := auto.UpsertStackInlineSource(ctx, pulumiStackName, projectName, DeployNetworkFunc)
+	s, err := auto.UpsertStackInlineSource(ctx, pulumiStackName, projectName, GetDeployNetworkFunc(network), opts...)
 	if err != nil {
-		fmt.Printf("failed to create or select stack: %v\n", err)
+		return nil, "", provisioningError("create or select stack "+pulumiStackName, err)
 	}
 
-	outs, err := s.Outputs(ctx)
+	region, err := stackRegion()
 	if err != nil {
-		fmt.Printf("failed to get networking stack outputs: %v\n", err)
-		os.Exit(1)
-	}
-	rgName, rgOk := outs["rgName"].Value.(string)
-	subnetID, sidOk := outs["subnetID"].Value.(string)
-	if rgOk && sidOk && rgName != "" && subnetID != "" {
-		return subnetID, rgName, nil
+		return nil, "", NewError(ValidationError, "set networking config", err)
 	}
-
-	err = s.SetConfig(ctx, "azure:location", auto.ConfigValue{Value: "westus"})
+	err = s.SetConfig(ctx, "azure:location", auto.ConfigValue{Value: region})
 	if err != nil {
-		fmt.Printf("Failed to set config: %v\n", err)
-		os.Exit(1)
+		return nil, "", provisioningError("set networking config", err)
 	}
 
-	// wire up our update to stream progress to stdout
-	stdoutStreamer := optup.ProgressStreams(os.Stdout)
-
-	res, err := s.Up(ctx, stdoutStreamer)
+	// an unchanged layout is a no-op update; stream the progress to stdout
+	res, err := upWithProgress(ctx, s, pulumiStackName, nil)
 	if err != nil {
-		fmt.Printf("Failed to deploy network stack: %v\n", err)
-		os.Exit(1)
+		return nil, "", provisioningError("deploy network stack", err)
 	}
-	return res.Outputs["subnetID"].Value.(string), res.Outputs["rgName"].Value.(string), nil
+	subnetIDs, rgName := networkOutputs(res.Outputs)
+	return subnetIDs, rgName, nil
 }
 
-// DeployNetworkFunc is a pulumi program that sets up an RG, and virtual network.
-func DeployNetworkFunc(ctx *pulumi.Context) error {
-	rg, err := core.NewResourceGroup(ctx, "server-rg", nil)
-	if err != nil {
-		return err
+// networkOutputs reads the subnet IDs and resource group name exported by the network program
+func networkOutputs(outs auto.OutputMap) (map[string]string, string) {
+	subnetIDs := make(map[string]string)
+	if ids, ok := outs["subnetIDs"].Value.(map[string]interface{}); ok {
+		for name, id := range ids {
+			subnetIDs[name], _ = id.(string)
+		}
 	}
+	rgName, _ := outs["rgName"].Value.(string)
+	return subnetIDs, rgName
+}
 
-	network, err := network.NewVirtualNetwork(ctx, "server-network", &network.VirtualNetworkArgs{
-		ResourceGroupName: rg.Name,
-		AddressSpaces:     pulumi.StringArray{pulumi.String("10.0.0.0/16")},
-		Subnets: network.VirtualNetworkSubnetArray{
-			network.VirtualNetworkSubnetArgs{
-				Name:          pulumi.String("default"),
-				AddressPrefix: pulumi.String("10.0.1.0/24"),
-			},
-		},
-	})
+// GetDeployNetworkFunc returns a pulumi program that sets up an RG, and a virtual network
+// with the subnets of the layout.
+func GetDeployNetworkFunc(layout *NetworkType) pulumi.RunFunc {
+	return func(ctx *pulumi.Context) error {
+		rg, err := core.NewResourceGroup(ctx, layout.ResourceGroup, nil)
+		if err != nil {
+			return err
+		}
 
-	subnetID := network.Subnets.Index(pulumi.Int(0)).Id().ApplyT(func(val *string) (string, error) {
-		if val == nil {
-			return "", nil
+		addressSpaces := pulumi.StringArray{}
+		for _, cidr := range layout.AddressSpaces {
+			addressSpaces = append(addressSpaces, pulumi.String(cidr))
 		}
-		return *val, nil
-	}).(pulumi.StringOutput)
-	ctx.Export("subnetID", subnetID)
-	ctx.Export("rgName", rg.Name)
-	return nil
+		subnets := network.VirtualNetworkSubnetArray{}
+		for _, subnet := range layout.Subnets {
+			subnets = append(subnets, network.VirtualNetworkSubnetArgs{
+				Name:          pulumi.String(subnet.Name),
+				AddressPrefix: pulumi.String(subnet.AddressPrefix),
+			})
+		}
+
+		vnet, err := network.NewVirtualNetwork(ctx, "server-network", &network.VirtualNetworkArgs{
+			ResourceGroupName: rg.Name,
+			AddressSpaces:     addressSpaces,
+			Subnets:           subnets,
+		})
+		if err != nil {
+			return err
+		}
+
+		subnetIDs := vnet.Subnets.ApplyT(func(subnets []network.VirtualNetworkSubnet) map[string]string {
+			ids := make(map[string]string, len(subnets))
+			for _, subnet := range subnets {
+				if subnet.Id != nil {
+					ids[subnet.Name] = *subnet.Id
+				}
+			}
+			return ids
+		}).(pulumi.StringMapOutput)
+		ctx.Export("subnetIDs", subnetIDs)
+		ctx.Export("rgName", rg.Name)
+		return nil
+	}
 }
@@ -0,0 +1,203 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi-azure/sdk/v4/go/azure/compute"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestImageReference(t *testing.T) {
+	tests := []struct {
+		image string
+		want  []string
+	}{
+		{"OpenLogic:CentOS:7_9:latest", []string{"OpenLogic", "CentOS", "7_9", "latest"}},
+		{"", []string{"canonical", "UbuntuServer", "16.04-LTS", "latest"}},
+		{"OpenLogic:CentOS:7_9", nil},
+		{"none", nil},
+	}
+	for _, test := range tests {
+		ref, err := imageReference(test.image)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("image %q is taken", test.image)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("image %q: %v", test.image, err)
+			continue
+		}
+		got := []pulumi.StringPtrInput{ref.Publisher, ref.Offer, ref.Sku, ref.Version}
+		for i, part := range test.want {
+			if got[i] != pulumi.String(part) {
+				t.Errorf("image %q part %d is %v, want %s", test.image, i, got[i], part)
+			}
+		}
+	}
+}
+
+func TestDataDiskArray(t *testing.T) {
+	disks, err := dataDiskArray("web-1", []string{"128", "256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disks) != 2 {
+		t.Fatalf("got %d disks", len(disks))
+	}
+	for lun, sizeGB := range []int{128, 256} {
+		disk := disks[lun].(compute.VirtualMachineStorageDataDiskArgs)
+		if disk.Name != pulumi.String("web-1-data"+strconv.Itoa(lun)) {
+			t.Errorf("disk %d is named %v", lun, disk.Name)
+		}
+		if disk.Lun != pulumi.Int(lun) || disk.DiskSizeGb != pulumi.Int(sizeGB) || disk.CreateOption != pulumi.String("Empty") {
+			t.Errorf("disk %d is %+v", lun, disk)
+		}
+	}
+
+	if disks, err := dataDiskArray("web", nil); err != nil || len(disks) != 0 {
+		t.Errorf("no disks gave %v, %v", disks, err)
+	}
+	for _, disk := range []string{"0", "-1", "1TB"} {
+		if _, err := dataDiskArray("web", []string{disk}); err == nil {
+			t.Errorf("disk %q is taken", disk)
+		}
+	}
+}
+
+func TestValidatePublicIP(t *testing.T) {
+	tests := []struct {
+		publicIP string
+		dnsLabel string
+		valid    bool
+	}{
+		{"", "", true},
+		{PublicIPNone, "", true},
+		{PublicIPDynamic, "", true},
+		{PublicIPStatic, "", true},
+		{PublicIPDynamic, "web-1", true},
+		{PublicIPStatic, "tiered-web1", true},
+		{"", "tiered-web1", true},
+		{PublicIPNone, "tiered-web1", false},
+		{"elastic", "", false},
+		{"Static", "", false},
+		{PublicIPStatic, "Tiered", false},
+		{PublicIPStatic, "1web", false},
+		{PublicIPStatic, "web-", false},
+		{PublicIPStatic, "ab", false},
+		{PublicIPStatic, "web_1", false},
+		{PublicIPStatic, strings.Repeat("a", 64), false},
+	}
+	for _, test := range tests {
+		err := validatePublicIP("web", &AppInstanceType{PublicIP: test.publicIP, DNSLabel: test.dnsLabel})
+		if test.valid && err != nil {
+			t.Errorf("public_ip %q dns_label %q: %v", test.publicIP, test.dnsLabel, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("public_ip %q dns_label %q is taken", test.publicIP, test.dnsLabel)
+		}
+	}
+}
+
+// the VM program creates a public IP per host of the apps that have one, with the
+// allocation and DNS label of the app, and attaches it to the host's NIC
+func TestDeployVMPublicIP(t *testing.T) {
+	StackInstance = &StackType{Id: "s1", Env: "dev", AppInstances: map[string]*AppInstanceType{
+		"private": {Count: 1, PublicIP: PublicIPNone},
+		"dynamic": {Count: 1},
+		"static":  {Count: 2, PublicIP: PublicIPStatic, DNSLabel: "s1-static"},
+	}}
+	t.Cleanup(func() { StackInstance = nil })
+
+	mocks := &stackMocks{stackLabel: "dev", appNames: sortedAppNames(), region: "westus"}
+	err := pulumi.RunErr(GetDeployVMFunc(map[string]string{"default": mockSubnetID("default")}, mockRGName, mockKeyPair, ""),
+		pulumi.WithMocks("s1", "dev", mocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]MockedResource)
+	for _, res := range mocks.resources {
+		byName[res.Name] = res
+	}
+
+	tests := []struct {
+		host       string
+		allocation string // empty for no public IP
+		dnsLabel   string
+	}{
+		{"private-0", "", ""},
+		{"dynamic-0", "Dynamic", ""},
+		{"static-0", "Static", "s1-static"},
+		{"static-1", "Static", "s1-static-1"},
+	}
+	for _, test := range tests {
+		ip, created := byName[test.host+"-ip"]
+		ipConfigs, _ := byName[test.host+"-nic"].Inputs["ipConfigurations"].([]interface{})
+		if len(ipConfigs) != 1 {
+			t.Fatalf("%s NIC has the IP configurations %v", test.host, ipConfigs)
+		}
+		publicIPID, attached := ipConfigs[0].(map[string]interface{})["publicIpAddressId"]
+		if test.allocation == "" {
+			if created || attached {
+				t.Errorf("%s has a public IP %v attached as %v", test.host, ip.Inputs, publicIPID)
+			}
+			continue
+		}
+		if !created {
+			t.Errorf("%s has no public IP", test.host)
+			continue
+		}
+		if ip.App != strings.Split(test.host, "-")[0] || ip.Type != "azure:network/publicIp:PublicIp" {
+			t.Errorf("%s public IP is a %s of app %s", test.host, ip.Type, ip.App)
+		}
+		if ip.Inputs["allocationMethod"] != test.allocation || ip.Inputs["resourceGroupName"] != mockRGName {
+			t.Errorf("%s public IP inputs %v", test.host, ip.Inputs)
+		}
+		if label, _ := ip.Inputs["domainNameLabel"].(string); label != test.dnsLabel {
+			t.Errorf("%s public IP DNS label %q, want %q", test.host, label, test.dnsLabel)
+		}
+		if publicIPID != test.host+"-ip-id" {
+			t.Errorf("%s NIC is attached to public IP %v", test.host, publicIPID)
+		}
+	}
+}
+
+func TestEnvironmentExpiry(t *testing.T) {
+	StackInstance = &StackType{Id: "s1", Env: "dev", TTL: time.Hour}
+	t.Cleanup(func() { StackInstance = nil })
+
+	deployed := auto.OutputMap{"expiresAt": {Value: "2030-01-02T03:04:05Z"}}
+	if expiresAt := environmentExpiry(deployed); expiresAt != "2030-01-02T03:04:05Z" {
+		t.Errorf("the expiry of the deployed environment became %q", expiresAt)
+	}
+	for _, outs := range []auto.OutputMap{nil, {"expiresAt": {Value: "tomorrow"}}} {
+		expiresAt, err := time.Parse(time.RFC3339, environmentExpiry(outs))
+		if err != nil || expiresAt.Before(time.Now().Add(59*time.Minute)) || expiresAt.After(time.Now().Add(time.Hour)) {
+			t.Errorf("a fresh environment expires at %v: %v", expiresAt, err)
+		}
+	}
+
+	StackInstance.TTL = 0
+	if expiresAt := environmentExpiry(deployed); expiresAt != "" {
+		t.Errorf("an environment without a ttl expires at %q", expiresAt)
+	}
+}
@@ -15,3 +15,164 @@ limitations under the License.
 */
 package ephstack
 
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+)
+
+// Destroy tears down the VMs of the parsed stack's environment, then its network,
+// and removes both pulumi stacks
+func (azureProvider) Destroy(ctx context.Context) error {
+	pulumiProjectName := StackInstance.Id
+	pulumiStackName := StackInstance.Env
+
+	secretsOpts, err := secretsProviderOptions()
+	if err != nil {
+		return NewError(ValidationError, "setup secrets provider", err)
+	}
+
+	stack, err := selectAppStack(ctx, pulumiProjectName, pulumiStackName)
+	if err != nil {
+		return provisioningError("select stack "+pulumiProjectName+"/"+pulumiStackName, err)
+	}
+	logStatus(pulumiStackName, "", "destroying vm webservers...")
+	if err := destroyWithProgress(ctx, stack, pulumiStackName, sortedAppNames()); err != nil {
+		return provisioningError("destroy vm stack", err)
+	}
+	if err := stack.Workspace().RemoveStack(ctx, pulumiStackName); err != nil {
+		return provisioningError("remove vm stack", err)
+	}
+
+	networkStack, err := auto.SelectStackInlineSource(ctx, networkStackName(pulumiStackName), pulumiProjectName, GetDeployNetworkFunc(StackNetwork()),
+		append(secretsOpts, projectOption(pulumiProjectName))...)
+	if err != nil {
+		return provisioningError("select stack "+networkStackName(pulumiStackName), err)
+	}
+	logStatus(pulumiStackName, "", "destroying network...")
+	if err := destroyWithProgress(ctx, networkStack, networkStackName(pulumiStackName), nil); err != nil {
+		return provisioningError("destroy network stack", err)
+	}
+	if err := networkStack.Workspace().RemoveStack(ctx, networkStackName(pulumiStackName)); err != nil {
+		return provisioningError("remove network stack", err)
+	}
+	return nil
+}
+
+// selectEnvStacks selects the app & networking stacks of the parsed stack's environment,
+// the VMs before the network they run in; the ones that don't exist are left out
+func selectEnvStacks(ctx context.Context) ([]auto.Stack, error) {
+	secretsOpts, err := secretsProviderOptions()
+	if err != nil {
+		return nil, NewError(ValidationError, "setup secrets provider", err)
+	}
+	var stacks []auto.Stack
+	for _, pulumiStackName := range []string{StackInstance.Env, networkStackName(StackInstance.Env)} {
+		stack, err := auto.SelectStackInlineSource(ctx, pulumiStackName, StackInstance.Id, nil,
+			append(secretsOpts, projectOption(StackInstance.Id))...)
+		if err == nil {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks, nil
+}
+
+// stackResources returns the URNs of the resources of a stack, without the stack itself
+// and its providers
+func stackResources(ctx context.Context, stack auto.Stack) ([]string, error) {
+	deployment, err := stack.Export(ctx)
+	if err != nil {
+		return nil, provisioningError("export stack "+stack.Name(), err)
+	}
+	var checkpoint struct {
+		Resources []struct {
+			URN  string `json:"urn"`
+			Type string `json:"type"`
+		} `json:"resources"`
+	}
+	if err := json.Unmarshal(deployment.Deployment, &checkpoint); err != nil {
+		return nil, NewError(ProvisioningError, "read stack "+stack.Name(), err)
+	}
+	var urns []string
+	for _, resource := range checkpoint.Resources {
+		if resource.Type != "pulumi:pulumi:Stack" && !strings.HasPrefix(resource.Type, "pulumi:providers:") {
+			urns = append(urns, resource.URN)
+		}
+	}
+	return urns, nil
+}
+
+// Resources lists the resources of the app & networking stacks of the environment,
+// the stacks that have none are left out
+func (azureProvider) Resources(ctx context.Context) (map[string][]string, error) {
+	stacks, err := selectEnvStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resources := make(map[string][]string, len(stacks))
+	for _, stack := range stacks {
+		urns, err := stackResources(ctx, stack)
+		if err != nil {
+			return nil, err
+		}
+		if len(urns) > 0 {
+			resources[stack.Name()] = urns
+		}
+	}
+	return resources, nil
+}
+
+// Cleanup destroys the resources created since before: the app & networking stacks
+// that had none are destroyed & removed, the others only lose their new resources
+func (azureProvider) Cleanup(ctx context.Context, before map[string][]string) ([]string, error) {
+	stacks, err := selectEnvStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var cleaned []string
+	for _, stack := range stacks {
+		urns, err := stackResources(ctx, stack)
+		if err != nil {
+			return cleaned, err
+		}
+		known, existed := before[stack.Name()]
+		if !existed {
+			logStatus(StackInstance.Env, "", "destroying stack "+stack.Name()+"...")
+			if err := destroyWithProgress(ctx, stack, stack.Name(), sortedAppNames()); err != nil {
+				return cleaned, provisioningError("destroy stack "+stack.Name(), err)
+			}
+			if err := stack.Workspace().RemoveStack(ctx, stack.Name()); err != nil {
+				return cleaned, provisioningError("remove stack "+stack.Name(), err)
+			}
+			cleaned = append(cleaned, fmt.Sprintf("stack %s, %d resources", stack.Name(), len(urns)))
+			continue
+		}
+
+		kept := make(map[string]bool, len(known))
+		for _, urn := range known {
+			kept[urn] = true
+		}
+		var created, names []string
+		for _, urn := range urns {
+			if !kept[urn] {
+				created = append(created, urn)
+				names = append(names, resourceName(urn))
+			}
+		}
+		if len(created) == 0 {
+			continue
+		}
+		logStatus(StackInstance.Env, "", "destroying the new resources of stack "+stack.Name()+"...")
+		if err := destroyWithProgress(ctx, stack, stack.Name(), sortedAppNames(),
+			optdestroy.Target(created), optdestroy.TargetDependents()); err != nil {
+			return cleaned, provisioningError("destroy new resources of stack "+stack.Name(), err)
+		}
+		cleaned = append(cleaned, fmt.Sprintf("%d new resources of stack %s: %s", len(created), stack.Name(), strings.Join(names, ", ")))
+	}
+	return cleaned, nil
+}
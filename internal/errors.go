@@ -0,0 +1,151 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// ErrorKind tells what went wrong, so callers can react without parsing messages
+type ErrorKind int
+
+// the exit code of the CLI for each kind of error is the ErrorKind value
+const (
+	ParseError        ErrorKind = iota + 2 // the stack or config files, or the state of a deployed stack, can't be read
+	ValidationError                        // the stack or config files are inconsistent
+	ProviderAuthError                      // the cloud provider rejected the credentials
+	QuotaError                             // the cloud subscription ran out of quota
+	ProvisioningError                      // creating or updating the cloud resources failed
+	_                                      // 7 is kept for the configuration management run
+	PolicyError                            // the stack breaks an enforced policy
+	LockError                              // another operation holds the lock of the stack
+)
+
+var errorKindNames = map[ErrorKind]string{
+	ParseError:        "parse error",
+	ValidationError:   "validation error",
+	ProviderAuthError: "provider auth error",
+	QuotaError:        "quota error",
+	ProvisioningError: "provisioning error",
+	PolicyError:       "policy error",
+	LockError:         "lock error",
+}
+
+func (kind ErrorKind) String() string {
+	return errorKindNames[kind]
+}
+
+// Error is the error returned by the ephstack package. It wraps the underlying
+// error with its kind and the operation that failed.
+type Error struct {
+	Kind ErrorKind
+	Op   string
+	Err  error
+}
+
+// NewError wraps err as an ephstack error of the given kind
+func NewError(kind ErrorKind, op string, err error) *Error {
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Kind.String() + ": " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsKind reports whether err, or any error it wraps, is an ephstack error of the given kind
+func IsKind(err error, kind ErrorKind) bool {
+	var stackErr *Error
+	return errors.As(err, &stackErr) && stackErr.Kind == kind
+}
+
+// ExitCode maps an error to the documented exit code of the CLI:
+// 0 success, 1 any other error, 2 parse, 3 validation, 4 provider auth,
+// 5 quota, 6 provisioning, 8 policy and 9 lock errors
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var stackErr *Error
+	if errors.As(err, &stackErr) {
+		return int(stackErr.Kind)
+	}
+	return 1
+}
+
+// markers of the cloud provider errors that pulumi passes through in its messages
+var providerAuthMarkers = []string{
+	"AuthorizationFailed",
+	"AuthenticationFailed",
+	"InvalidAuthenticationToken",
+	"Please run 'az login'",
+	"building AzureRM Client",
+}
+
+var quotaMarkers = []string{
+	"QuotaExceeded",
+	"exceeding approved", // OperationNotAllowed: ... results in exceeding approved <family> Cores quota
+	"SkuNotAvailable",
+}
+
+// markers of the state backends rejecting the credentials, in the messages of pulumi
+var backendAuthMarkers = []string{
+	"code=PermissionDenied", // the blob storage of the s3, azblob & gs backends
+	"NoCredentialProviders",
+	"InvalidAccessKeyId",
+	"SignatureDoesNotMatch",
+	"Unauthorized", // the pulumi service
+	"invalid access token",
+}
+
+// stackAccessError classifies an error selecting or reading a deployed stack: one the
+// backend doesn't have is a validation error, a backend rejecting the credentials a
+// provider auth error, and the backend failing otherwise a parse error
+func stackAccessError(op string, stackName string, err error) *Error {
+	if auto.IsSelectStack404Error(err) {
+		return NewError(ValidationError, op, errors.New("stack "+stackName+" is not deployed in environment "+Environment+" of the state backend "+stateBackend()))
+	}
+	msg := err.Error()
+	for _, marker := range append(providerAuthMarkers, backendAuthMarkers...) {
+		if strings.Contains(msg, marker) {
+			return NewError(ProviderAuthError, op, err)
+		}
+	}
+	return NewError(ParseError, op, err)
+}
+
+// provisioningError classifies an error returned by pulumi as a provider auth,
+// quota or plain provisioning error
+func provisioningError(op string, err error) *Error {
+	msg := err.Error()
+	for _, marker := range providerAuthMarkers {
+		if strings.Contains(msg, marker) {
+			return NewError(ProviderAuthError, op, err)
+		}
+	}
+	for _, marker := range quotaMarkers {
+		if strings.Contains(msg, marker) {
+			return NewError(QuotaError, op, err)
+		}
+	}
+	return NewError(ProvisioningError, op, err)
+}
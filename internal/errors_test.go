@@ -0,0 +1,98 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	cause := errors.New("boom")
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, 0},
+		{"other error", cause, 1},
+		{"parse", NewError(ParseError, "op", cause), 2},
+		{"validation", NewError(ValidationError, "op", cause), 3},
+		{"provider auth", NewError(ProviderAuthError, "op", cause), 4},
+		{"quota", NewError(QuotaError, "op", cause), 5},
+		{"provisioning", NewError(ProvisioningError, "op", cause), 6},
+		{"policy", NewError(PolicyError, "op", cause), 8},
+		{"lock", NewError(LockError, "op", cause), 9},
+		{"wrapped", fmt.Errorf("deploy: %w", NewError(QuotaError, "op", cause)), 5},
+	}
+	for _, test := range tests {
+		if got := ExitCode(test.err); got != test.want {
+			t.Errorf("%s: ExitCode = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	err := NewError(ValidationError, "parse stack s1", errors.New("no apps"))
+	if got, want := err.Error(), "validation error: parse stack s1: no apps"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if !IsKind(fmt.Errorf("wrapped: %w", err), ValidationError) || IsKind(err, ParseError) {
+		t.Errorf("IsKind doesn't match the kind of a wrapped error")
+	}
+	if !errors.Is(err, err.Err) {
+		t.Errorf("the cause isn't unwrapped")
+	}
+}
+
+func TestProvisioningError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want ErrorKind
+	}{
+		{"Status=403 Code=\"AuthorizationFailed\" Message=\"The client does not have authorization\"", ProviderAuthError},
+		{"obtain subscription: Please run 'az login' to setup account", ProviderAuthError},
+		{"Code=\"QuotaExceeded\" Message=\"Operation results in exceeding quota limits of Core\"", QuotaError},
+		{"Code=\"OperationNotAllowed\" Message=\"Operation could not be completed as it results in exceeding approved standardDSv3Family Cores quota\"", QuotaError},
+		{"Code=\"SkuNotAvailable\" Message=\"The requested size for resource is currently not available in location westus\"", QuotaError},
+		// a resource merely named after quotas is no quota error
+		{"creating resource group \"quota-tracker-rg\": connection reset by peer", ProvisioningError},
+		{"update failed", ProvisioningError},
+	}
+	for _, test := range tests {
+		if got := provisioningError("deploy", errors.New(test.msg)).Kind; got != test.want {
+			t.Errorf("provisioningError(%q) is a %s, want a %s", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestStackAccessError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want ErrorKind
+	}{
+		{"read \"stacks/dev.json\": blob (code=PermissionDenied): AccessDenied", ProviderAuthError},
+		{"NoCredentialProviders: no valid providers in chain", ProviderAuthError},
+		{"[401] Unauthorized: No credentials provided or are invalid.", ProviderAuthError},
+		{"failed to find pulumi CLI", ParseError},
+	}
+	for _, test := range tests {
+		if got := stackAccessError("read stack s1/dev", "s1", errors.New(test.msg)).Kind; got != test.want {
+			t.Errorf("stackAccessError(%q) is a %s, want a %s", test.msg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi-azure/sdk/v4/go/azure/network"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// the priorities of the generated security rules, lower ones are evaluated first
+const (
+	firstRulePriority = 100
+	rulePriorityStep  = 10
+	// azure allows all traffic within the virtual network by default, this rule
+	// makes the declared ports the only way in
+	denyVnetPriority = 4000
+)
+
+var ruleProtocols = map[string]string{
+	"tcp":  "Tcp",
+	"udp":  "Udp",
+	"icmp": "Icmp",
+	"*":    "*",
+}
+
+// validPort reports whether port is a port number, a range of them or *
+func validPort(port string) bool {
+	if port == "*" {
+		return true
+	}
+	bounds := strings.SplitN(port, "-", 2)
+	low := 0
+	for _, bound := range bounds {
+		n, err := strconv.Atoi(bound)
+		if err != nil || n < 1 || n > 65535 || n < low {
+			return false
+		}
+		low = n
+	}
+	return true
+}
+
+// sourcePrefix resolves a source of a port rule to an address prefix: an app is
+// reachable from the subnet of the app it names
+func sourcePrefix(source string, layout *NetworkType) (string, error) {
+	if source == "*" {
+		return source, nil
+	}
+	if _, _, err := net.ParseCIDR(source); err == nil {
+		return source, nil
+	}
+	// viper lower cases the app names of the stack file
+	appInst, ok := StackInstance.AppInstances[strings.ToLower(source)]
+	if !ok {
+		return "", errors.New("'" + source + "' is neither a CIDR nor an app of the stack")
+	}
+	subnetName := layout.appSubnet(appInst)
+	for _, subnet := range layout.Subnets {
+		if subnet.Name == subnetName {
+			return subnet.AddressPrefix, nil
+		}
+	}
+	return "", errors.New("app '" + source + "' has no subnet")
+}
+
+// validatePorts checks the port rules of an app
+func validatePorts(appName string, appInst *AppInstanceType, layout *NetworkType) error {
+	for _, rule := range appInst.Ports {
+		if !validPort(rule.Port) {
+			return errors.New("app '" + appName + "' port '" + rule.Port + "' is not a port, a range or *")
+		}
+		if _, ok := ruleProtocols[rule.Protocol]; !ok && rule.Protocol != "" {
+			return errors.New("app '" + appName + "' port " + rule.Port + " protocol must be tcp, udp, icmp or *")
+		}
+		if len(rule.From) == 0 {
+			return errors.New("app '" + appName + "' port " + rule.Port + " has no 'from' sources")
+		}
+		for _, source := range rule.From {
+			if _, err := sourcePrefix(source, layout); err != nil {
+				return errors.New("app '" + appName + "' port " + rule.Port + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// appSecurityRules builds the inbound security rules of an app's NSG from its ports,
+// nil if the app doesn't declare any
+func appSecurityRules(appInst *AppInstanceType, layout *NetworkType) (network.NetworkSecurityGroupSecurityRuleArray, error) {
+	if appInst.Ports == nil {
+		return nil, nil
+	}
+	rules := network.NetworkSecurityGroupSecurityRuleArray{}
+	for i, rule := range appInst.Ports {
+		protocol := "tcp"
+		if rule.Protocol != "" {
+			protocol = rule.Protocol
+		}
+		sources := pulumi.StringArray{}
+		anySource := false
+		for _, source := range rule.From {
+			prefix, err := sourcePrefix(source, layout)
+			if err != nil {
+				return nil, err
+			}
+			anySource = anySource || prefix == "*"
+			sources = append(sources, pulumi.String(prefix))
+		}
+		securityRule := network.NetworkSecurityGroupSecurityRuleArgs{
+			Name:                     pulumi.String(fmt.Sprintf("allow-%s-%s-%d", strings.ReplaceAll(protocol, "*", "any"), strings.ReplaceAll(rule.Port, "*", "any"), i+1)),
+			Priority:                 pulumi.Int(firstRulePriority + i*rulePriorityStep),
+			Direction:                pulumi.String("Inbound"),
+			Access:                   pulumi.String("Allow"),
+			Protocol:                 pulumi.String(ruleProtocols[protocol]),
+			SourcePortRange:          pulumi.String("*"),
+			DestinationPortRange:     pulumi.String(rule.Port),
+			DestinationAddressPrefix: pulumi.String("*"),
+		}
+		// azure only takes * as the single source prefix, not in a list of them
+		if anySource {
+			securityRule.SourceAddressPrefix = pulumi.String("*")
+		} else {
+			securityRule.SourceAddressPrefixes = sources
+		}
+		rules = append(rules, securityRule)
+	}
+	rules = append(rules, network.NetworkSecurityGroupSecurityRuleArgs{
+		Name:                     pulumi.String("deny-vnet-inbound"),
+		Priority:                 pulumi.Int(denyVnetPriority),
+		Direction:                pulumi.String("Inbound"),
+		Access:                   pulumi.String("Deny"),
+		Protocol:                 pulumi.String("*"),
+		SourcePortRange:          pulumi.String("*"),
+		SourceAddressPrefix:      pulumi.String("VirtualNetwork"),
+		DestinationPortRange:     pulumi.String("*"),
+		DestinationAddressPrefix: pulumi.String("*"),
+	})
+	return rules, nil
+}
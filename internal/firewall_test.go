@@ -0,0 +1,54 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi-azure/sdk/v4/go/azure/network"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestAppSecurityRules(t *testing.T) {
+	appInst := &AppInstanceType{Ports: []PortRuleType{
+		{Port: "80", From: []string{"*"}},
+		{Port: "*", Protocol: "*", From: []string{"10.1.0.0/16", "10.2.0.0/16"}},
+	}}
+	rules, err := appSecurityRules(appInst, &NetworkType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("got %d rules, want the 2 declared ones and the vnet deny", len(rules))
+	}
+
+	anywhere := rules[0].(network.NetworkSecurityGroupSecurityRuleArgs)
+	if anywhere.Name != pulumi.String("allow-tcp-80-1") {
+		t.Errorf("rule 1 is named %v", anywhere.Name)
+	}
+	if anywhere.SourceAddressPrefix != pulumi.String("*") || anywhere.SourceAddressPrefixes != nil {
+		t.Errorf("rule 1 from * has the source %v and the sources %v", anywhere.SourceAddressPrefix, anywhere.SourceAddressPrefixes)
+	}
+
+	cidrs := rules[1].(network.NetworkSecurityGroupSecurityRuleArgs)
+	if cidrs.Name != pulumi.String("allow-any-any-2") {
+		t.Errorf("rule 2 is named %v", cidrs.Name)
+	}
+	want := pulumi.StringArray{pulumi.String("10.1.0.0/16"), pulumi.String("10.2.0.0/16")}
+	if got, ok := cidrs.SourceAddressPrefixes.(pulumi.StringArray); !ok || len(got) != 2 || got[0] != want[0] || got[1] != want[1] || cidrs.SourceAddressPrefix != nil {
+		t.Errorf("rule 2 has the source %v and the sources %v", cidrs.SourceAddressPrefix, cidrs.SourceAddressPrefixes)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/elgamal"
+	"golang.org/x/term"
+)
+
+// the env var the passphrase of a protected gpg key file is read from
+const gpgPassphraseEnvVar = "EPHSTACK_GPG_PASSPHRASE"
+
+// the passphrase derived from the gpg key file, so it is read and decrypted once per run
+var gpgKeyPassphrase string
+
+// gpgKeyFilePassphrase derives the passphrase of the stack secrets from the private key
+// of an OpenPGP key file, e.g. one exported with gpg --export-secret-keys --armor.
+// Whoever holds the key can decrypt the secrets; a protected key is unlocked with
+// EPHSTACK_GPG_PASSPHRASE or a prompt.
+func gpgKeyFilePassphrase(keyFileName string) (string, error) {
+	if gpgKeyPassphrase != "" {
+		return gpgKeyPassphrase, nil
+	}
+	data, err := os.ReadFile(keyFileName)
+	if err != nil {
+		return "", fmt.Errorf("unable to read gpg key file %s: %w", keyFileName, err)
+	}
+	keyRing, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		keyRing, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read gpg key file %s, only RSA, DSA, ElGamal and ECDSA keys are supported: %w", keyFileName, err)
+	}
+	var entity *openpgp.Entity
+	for _, keyEntity := range keyRing {
+		if keyEntity.PrivateKey != nil {
+			entity = keyEntity
+			break
+		}
+	}
+	if entity == nil {
+		return "", errors.New("gpg key file " + keyFileName + " holds no private key, export it with gpg --export-secret-keys")
+	}
+
+	privateKey := entity.PrivateKey
+	if privateKey.Encrypted {
+		keyPassphrase, ok := os.LookupEnv(gpgPassphraseEnvVar)
+		if !ok {
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				return "", errors.New("gpg key file " + keyFileName + " is protected: set " + gpgPassphraseEnvVar)
+			}
+			fmt.Fprint(os.Stderr, "Enter passphrase for gpg key file "+keyFileName+": ")
+			prompted, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return "", err
+			}
+			keyPassphrase = string(prompted)
+		}
+		if err := privateKey.Decrypt([]byte(keyPassphrase)); err != nil {
+			return "", errors.New("wrong passphrase for gpg key file " + keyFileName)
+		}
+	}
+
+	var secret []byte
+	switch key := privateKey.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		secret = key.D.Bytes()
+	case *dsa.PrivateKey:
+		secret = key.X.Bytes()
+	case *ecdsa.PrivateKey:
+		secret = key.D.Bytes()
+	case *elgamal.PrivateKey:
+		secret = key.X.Bytes()
+	default:
+		return "", fmt.Errorf("gpg key file %s has an unsupported %T private key", keyFileName, key)
+	}
+	digest := sha256.New()
+	digest.Write([]byte("ephstack secrets\x00"))
+	digest.Write(privateKey.Fingerprint[:])
+	digest.Write(secret)
+	gpgKeyPassphrase = base64.StdEncoding.EncodeToString(digest.Sum(nil))
+	return gpgKeyPassphrase, nil
+}
@@ -0,0 +1,180 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// infraSetting is the value of a key of an infra entry, with where it was declared
+type infraSetting struct {
+	value  interface{}
+	source string
+}
+
+// ResolveInfra builds the infra entries of a config file: every entry is merged onto the
+// entry it 'extends', and all of them onto the file's 'defaults'. Tags are merged tag by
+// tag, the other keys replaced. Each InfraHwType records where its values came from.
+func ResolveInfra(entries map[string]interface{}, defaults map[string]interface{}, configFileName string) (InfraHWInstMapType, error) {
+	op := "resolve infra in " + configFileName
+
+	defaultSettings := make(map[string]infraSetting, len(defaults))
+	for key, value := range defaults {
+		defaultSettings[key] = infraSetting{value, configFileName + ": config.defaults"}
+	}
+
+	resolved := make(map[string]map[string]infraSetting, len(entries))
+	var resolve func(name string, chain []string) (map[string]infraSetting, error)
+	resolve = func(name string, chain []string) (map[string]infraSetting, error) {
+		if settings, ok := resolved[name]; ok {
+			return settings, nil
+		}
+		for _, seen := range chain {
+			if seen == name {
+				return nil, errors.New("extends cycle " + strings.Join(append(chain, name), " -> "))
+			}
+		}
+		decl, ok := toSettings(entries[name])
+		if !ok {
+			return nil, errors.New("extends unknown infra entry '" + name + "'")
+		}
+
+		base := defaultSettings
+		if baseName, ok := decl["extends"].(string); ok {
+			// viper lower cases the names of the entries
+			var err error
+			if base, err = resolve(strings.ToLower(baseName), append(chain, name)); err != nil {
+				return nil, err
+			}
+		}
+		settings := make(map[string]infraSetting, len(base)+len(decl))
+		for key, setting := range base {
+			settings[key] = setting
+		}
+		source := configFileName + ": config.infra." + name
+		for key, value := range decl {
+			if key == "extends" {
+				continue
+			}
+			if baseTags, ok := settings[key]; ok && key == "tags" {
+				tags := FlattenMapList(baseTags.value)
+				for tag, tagValue := range FlattenMapList(value) {
+					tags[tag] = tagValue
+				}
+				// merged tags come from both
+				settings[key] = infraSetting{tags, baseTags.source + " + " + source}
+				continue
+			}
+			settings[key] = infraSetting{value, source}
+		}
+		resolved[name] = settings
+		return settings, nil
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infraHWMap := make(InfraHWInstMapType, len(entries))
+	for _, name := range names {
+		settings, err := resolve(name, nil)
+		if err != nil {
+			return nil, NewError(ValidationError, op, errors.New("infra entry '"+name+"': "+err.Error()))
+		}
+		infraHW, err := newInfraHW(name, configFileName+": config.infra."+name, settings)
+		if err != nil {
+			return nil, NewError(ValidationError, op, err)
+		}
+		infraHWMap[name] = infraHW
+	}
+	return infraHWMap, nil
+}
+
+// ResolveDefaults builds the 'defaults' of a config file as an InfraHwType, to fill in the
+// values the size & image aliases of the file don't set
+func ResolveDefaults(defaults map[string]interface{}, configFileName string) (*InfraHwType, error) {
+	settings := make(map[string]infraSetting, len(defaults))
+	for key, value := range defaults {
+		settings[key] = infraSetting{value, configFileName + ": config.defaults"}
+	}
+	infraHW, err := newInfraHW("", configFileName+": config.defaults", settings)
+	if err != nil {
+		return nil, NewError(ValidationError, "resolve defaults in "+configFileName, err)
+	}
+	return infraHW, nil
+}
+
+// newInfraHW builds the InfraHwType declared at source from its resolved settings
+func newInfraHW(name string, source string, settings map[string]infraSetting) (*InfraHwType, error) {
+	infraHW := &InfraHwType{
+		Name:    name,
+		Disks:   make([]string, 0),
+		Tags:    make(map[string]string),
+		Sources: map[string]string{"name": source},
+	}
+	for key, setting := range settings {
+		switch key {
+		case "region":
+			infraHW.Region = fmt.Sprintf("%v", setting.value)
+		case "type":
+			infraHW.Type = fmt.Sprintf("%v", setting.value)
+		case "image":
+			infraHW.Image = fmt.Sprintf("%v", setting.value)
+		case "disk":
+			disks, ok := setting.value.([]interface{})
+			if !ok {
+				return nil, errors.New("disk of " + setting.source + " must be a list of disk sizes in GB, e.g. disk: [ 128 ]")
+			}
+			for _, disk := range disks {
+				infraHW.Disks = append(infraHW.Disks, fmt.Sprintf("%v", disk))
+			}
+		case "tags":
+			// a list of maps, like the facts of the apps
+			infraHW.Tags = FlattenMapList(setting.value)
+		default:
+			return nil, errors.New("unexpected Config instance value " + key + " found in " + setting.source)
+		}
+		infraHW.Sources[key] = setting.source
+	}
+	return infraHW, nil
+}
+
+// AddCloudInfra adds the infra entries of a config file to the ones of its cloud. The
+// config files of a cloud add up, but each entry must be declared by a single file.
+func AddCloudInfra(instances InfraHWInstancesMapType, cloudName string, infraHWMap InfraHWInstMapType) error {
+	cloudInfraHW, ok := instances[cloudName]
+	if !ok {
+		cloudInfraHW = &InfraHWInstMapType{}
+		instances[cloudName] = cloudInfraHW
+	}
+	names := make([]string, 0, len(infraHWMap))
+	for name := range infraHWMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if declared, ok := (*cloudInfraHW)[name]; ok {
+			return NewError(ValidationError, "add infra of cloud "+cloudName, errors.New("entry '"+name+"' is declared in both "+declared.Sources["name"]+" and "+infraHWMap[name].Sources["name"]))
+		}
+		(*cloudInfraHW)[name] = infraHWMap[name]
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveInfra(t *testing.T) {
+	defaults := map[string]interface{}{"region": "westus", "tags": []interface{}{map[string]interface{}{"owner": "ops"}}}
+	entries := map[string]interface{}{
+		"base": map[string]interface{}{"type": "Standard_B1s", "image": "canonical:ubuntuserver:18.04-lts:latest", "disk": []interface{}{128}},
+		"big": map[string]interface{}{
+			"extends": "Base",
+			"type":    "Standard_D4s_v3",
+			"disk":    []interface{}{128, 256},
+			"tags":    []interface{}{map[string]interface{}{"tier": "db"}},
+		},
+	}
+	infraHWMap, err := ResolveInfra(entries, defaults, "azure.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := infraHWMap["big"]
+	if big.Region != "westus" || big.Type != "Standard_D4s_v3" || big.Image != "canonical:ubuntuserver:18.04-lts:latest" {
+		t.Errorf("big is %+v", big)
+	}
+	if !reflect.DeepEqual(big.Disks, []string{"128", "256"}) {
+		t.Errorf("big disks %v", big.Disks)
+	}
+	if !reflect.DeepEqual(big.Tags, map[string]string{"owner": "ops", "tier": "db"}) {
+		t.Errorf("big tags %v", big.Tags)
+	}
+	wantSources := map[string]string{
+		"name":   "azure.yaml: config.infra.big",
+		"region": "azure.yaml: config.defaults",
+		"type":   "azure.yaml: config.infra.big",
+		"image":  "azure.yaml: config.infra.base",
+		"disk":   "azure.yaml: config.infra.big",
+		"tags":   "azure.yaml: config.defaults + azure.yaml: config.infra.big",
+	}
+	if !reflect.DeepEqual(big.Sources, wantSources) {
+		t.Errorf("big sources %v, want %v", big.Sources, wantSources)
+	}
+	if base := infraHWMap["base"]; base.Type != "Standard_B1s" || !reflect.DeepEqual(base.Tags, map[string]string{"owner": "ops"}) {
+		t.Errorf("base is %+v", base)
+	}
+}
+
+func TestResolveInfraErrors(t *testing.T) {
+	tests := []struct {
+		entries map[string]interface{}
+		wantErr string
+	}{
+		{map[string]interface{}{
+			"a": map[string]interface{}{"extends": "b"},
+			"b": map[string]interface{}{"extends": "a"},
+		}, "extends cycle a -> b -> a"},
+		{map[string]interface{}{
+			"a": map[string]interface{}{"extends": "nope"},
+		}, "infra entry 'a': extends unknown infra entry 'nope'"},
+		{map[string]interface{}{
+			"a": map[string]interface{}{"disk": 128},
+		}, "disk of azure.yaml: config.infra.a must be a list"},
+		{map[string]interface{}{
+			"a": map[string]interface{}{"size": "medium"},
+		}, "unexpected Config instance value size found in azure.yaml: config.infra.a"},
+	}
+	for _, test := range tests {
+		_, err := ResolveInfra(test.entries, nil, "azure.yaml")
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("error %v, want %q", err, test.wantErr)
+		}
+		if ExitCode(err) != 3 {
+			t.Errorf("%v is not a validation error", err)
+		}
+	}
+
+	// a scalar disk inherited from the defaults names them
+	_, err := ResolveInfra(map[string]interface{}{"a": map[string]interface{}{}}, map[string]interface{}{"disk": "128"}, "azure.yaml")
+	if err == nil || !strings.Contains(err.Error(), "disk of azure.yaml: config.defaults must be a list") {
+		t.Errorf("error %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import "strconv"
+
+// the fact every host gets with its index among the hosts of its app
+const instanceIndexFact = "instance_index"
+
+// appHost is one host of an app, named after the app and its index, so scaling only
+// adds or removes the hosts past the old count
+type appHost struct {
+	Name  string // <app>-<index>
+	App   string
+	Index int
+}
+
+// hosts lists the hosts of an app
+func (appInst *AppInstanceType) hosts(appName string) []appHost {
+	hosts := make([]appHost, 0, appInst.Count)
+	for i := 0; i < appInst.Count; i++ {
+		hosts = append(hosts, appHost{Name: appName + "-" + strconv.Itoa(i), App: appName, Index: i})
+	}
+	return hosts
+}
+
+// stackHosts lists the hosts of all the apps of the parsed stack, sorted by app and index
+func stackHosts() []appHost {
+	var hosts []appHost
+	for _, appName := range sortedAppNames() {
+		hosts = append(hosts, StackInstance.AppInstances[appName].hosts(appName)...)
+	}
+	return hosts
+}
+
+// hostFacts returns the facts of an app's host, its instance index included
+func (appInst *AppInstanceType) hostFacts(host appHost) map[string]string {
+	facts := make(map[string]string, len(appInst.Facts)+1)
+	for key, value := range appInst.Facts {
+		facts[key] = value
+	}
+	facts[instanceIndexFact] = strconv.Itoa(host.Index)
+	return facts
+}
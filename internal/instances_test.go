@@ -0,0 +1,43 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHosts(t *testing.T) {
+	tests := []struct {
+		count int
+		want  []string
+	}{
+		{1, []string{"web-0"}},
+		{3, []string{"web-0", "web-1", "web-2"}},
+	}
+	for _, test := range tests {
+		var names []string
+		for i, host := range (&AppInstanceType{Count: test.count}).hosts("web") {
+			if host.App != "web" || host.Index != i {
+				t.Errorf("count %d: host %d is %+v", test.count, i, host)
+			}
+			names = append(names, host.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("count %d: hosts %v, want %v", test.count, names, test.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the vars set with --set on the command line, they override the vars: defaults
+var VarOverrides = make(map[string]string)
+
+// ${env:NAME}, ${var:name}, ${stack.name}, ${stack.env} or ${facts.name}; $${ is a literal ${
+var referencePattern = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// Interpolator resolves the ${...} references in the values of a stack or config file,
+// and collects the undefined ones with their location
+type Interpolator struct {
+	Vars      map[string]string
+	StackName string
+	undefined []string
+}
+
+// NewInterpolator returns an interpolator for the stack named stackName, with the
+// vars: defaults of its stack file overridden by VarOverrides. The defaults may
+// refer to environment variables.
+func NewInterpolator(stackFileName string, stackName string, defaults map[string]interface{}) (*Interpolator, error) {
+	in := &Interpolator{Vars: make(map[string]string), StackName: stackName}
+	for key, value := range defaults {
+		in.Vars[key] = in.String(fmt.Sprintf("%v", value), stackFileName+": stack.vars."+key, nil)
+	}
+	for key, value := range VarOverrides {
+		// viper lower cases the keys of the vars: block
+		in.Vars[strings.ToLower(key)] = value
+	}
+	return in, in.Err()
+}
+
+// String resolves the references of a single value found at location. facts are the
+// facts of the app the value belongs to, nil outside of an app.
+func (in *Interpolator) String(value string, location string, facts map[string]string) string {
+	return referencePattern.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		expr := strings.TrimSpace(ref[2 : len(ref)-1])
+		var resolved string
+		var ok bool
+		switch {
+		case strings.HasPrefix(expr, "env:"):
+			resolved, ok = os.LookupEnv(strings.TrimPrefix(expr, "env:"))
+		case strings.HasPrefix(expr, "var:"):
+			resolved, ok = in.Vars[strings.ToLower(strings.TrimPrefix(expr, "var:"))]
+		case expr == "stack.name":
+			resolved, ok = in.StackName, in.StackName != ""
+		case expr == "stack.env":
+			resolved, ok = Environment, true
+		case strings.HasPrefix(expr, "facts."):
+			resolved, ok = facts[strings.TrimPrefix(expr, "facts.")]
+		}
+		if !ok {
+			in.undefined = append(in.undefined, location+": undefined "+ref)
+			return ref
+		}
+		return resolved
+	})
+}
+
+// Value resolves the references of every string in a value read from a file, recursively
+func (in *Interpolator) Value(value interface{}, location string, facts map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return in.String(v, location, facts)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = in.Value(item, fmt.Sprintf("%s[%d]", location, i), facts)
+		}
+		return values
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			values[key] = in.Value(item, location+"."+key, facts)
+		}
+		return values
+	case map[interface{}]interface{}:
+		values := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			values[fmt.Sprintf("%v", key)] = in.Value(item, fmt.Sprintf("%s.%v", location, key), facts)
+		}
+		return values
+	}
+	return value
+}
+
+// Apps resolves the references in the decls of the apps of a stack file, where
+// ${facts.name} refers to the app's own facts. base holds the facts of the apps
+// already resolved, an environment's apps add their facts to them.
+func (in *Interpolator) Apps(apps map[string]interface{}, location string, base map[string]map[string]string) map[string]map[string]string {
+	appFacts := make(map[string]map[string]string, len(apps))
+	for appName, value := range apps {
+		appLocation := location + "." + appName
+		decl, ok := value.(map[string]interface{})
+		if !ok {
+			apps[appName] = in.Value(value, appLocation, nil)
+			continue
+		}
+
+		// the facts are resolved first, they can only refer to the facts they override
+		facts := make(map[string]string)
+		for key, value := range base[appName] {
+			facts[key] = value
+		}
+		resolved := make(map[string]interface{}, len(decl))
+		if rawFacts, ok := decl["facts"]; ok {
+			resolved["facts"] = in.Value(rawFacts, appLocation+".facts", base[appName])
+			for key, value := range FlattenMapList(resolved["facts"]) {
+				facts[key] = value
+			}
+		}
+		for key, value := range decl {
+			if key != "facts" {
+				resolved[key] = in.Value(value, appLocation+"."+key, facts)
+			}
+		}
+		apps[appName] = resolved
+		appFacts[appName] = facts
+	}
+	return appFacts
+}
+
+// Settings resolves the references in all the settings of a stack or config file,
+// as read by viper. The vars: block was resolved by NewInterpolator.
+func (in *Interpolator) Settings(settings map[string]interface{}, fileName string) map[string]interface{} {
+	resolved := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		stack, ok := value.(map[string]interface{})
+		if key != "stack" || !ok {
+			resolved[key] = in.Value(value, fileName+": "+key, nil)
+			continue
+		}
+
+		resolvedStack := make(map[string]interface{}, len(stack))
+		var appFacts map[string]map[string]string
+		if apps, ok := stack["apps"].(map[string]interface{}); ok {
+			appFacts = in.Apps(apps, fileName+": stack.apps", nil)
+			resolvedStack["apps"] = apps
+		}
+		for stackKey, stackValue := range stack {
+			location := fileName + ": stack." + stackKey
+			switch envs, ok := stackValue.(map[string]interface{}); {
+			case stackKey == "apps" && resolvedStack["apps"] != nil, stackKey == "vars":
+				resolvedStack[stackKey] = stackValue
+			case stackKey == "environments" && ok:
+				for envName, env := range envs {
+					envFields, ok := env.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					for envKey, envValue := range envFields {
+						if apps, ok := envValue.(map[string]interface{}); ok && envKey == "apps" {
+							in.Apps(apps, location+"."+envName+".apps", appFacts)
+						} else {
+							envFields[envKey] = in.Value(envValue, location+"."+envName+"."+envKey, nil)
+						}
+					}
+				}
+				resolvedStack[stackKey] = envs
+			default:
+				resolvedStack[stackKey] = in.Value(stackValue, location, nil)
+			}
+		}
+		resolved[key] = resolvedStack
+	}
+	return resolved
+}
+
+// Err reports the undefined references found so far, as a validation error
+func (in *Interpolator) Err() error {
+	if len(in.undefined) == 0 {
+		return nil
+	}
+	sort.Strings(in.undefined)
+	return NewError(ValidationError, "interpolate", errors.New(strings.Join(in.undefined, "; ")))
+}
+
+// FlattenMapList turns the YAML list of maps used for 'facts', e.g.
+// [ {role: db, dept: engr} ], into a single map
+func FlattenMapList(value interface{}) map[string]string {
+	flatMap := make(map[string]string)
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			for key, value := range FlattenMapList(item) {
+				flatMap[key] = value
+			}
+		}
+	case map[string]string:
+		for key, value := range v {
+			flatMap[key] = value
+		}
+	case map[string]interface{}:
+		for key, value := range v {
+			flatMap[key] = fmt.Sprintf("%v", value)
+		}
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			flatMap[fmt.Sprintf("%v", key)] = fmt.Sprintf("%v", value)
+		}
+	}
+	return flatMap
+}
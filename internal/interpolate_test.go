@@ -0,0 +1,153 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolatorString(t *testing.T) {
+	t.Setenv("EPHSTACK_TEST_OWNER", "alice")
+	defer func(env string) { Environment = env }(Environment)
+	Environment = "qa"
+	in := &Interpolator{Vars: map[string]string{"size": "large"}, StackName: "s1"}
+	facts := map[string]string{"role": "web"}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"${env:EPHSTACK_TEST_OWNER}", "alice"},
+		{"${var:size}", "large"},
+		{"${var:SIZE}", "large"},
+		{"${ var:size }", "large"},
+		{"${stack.name}-${stack.env}", "s1-qa"},
+		{"${facts.role}.example.com", "web.example.com"},
+		{"$${stack.name}", "${stack.name}"},
+		{"$$${stack.name}", "$${stack.name}"},
+		{"cost $5", "cost $5"},
+	}
+	for _, test := range tests {
+		if got := in.String(test.value, "f.yaml: x", facts); got != test.want {
+			t.Errorf("String(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+	if err := in.Err(); err != nil {
+		t.Errorf("defined references reported: %v", err)
+	}
+}
+
+func TestInterpolatorUndefined(t *testing.T) {
+	in := &Interpolator{Vars: map[string]string{}}
+	refs := []string{"${env:EPHSTACK_TEST_UNSET}", "${var:nope}", "${stack.name}", "${facts.role}", "${stack.owner}", "${}"}
+	for _, ref := range refs {
+		if got := in.String(ref, "f.yaml: stack.apps.web.config", nil); got != ref {
+			t.Errorf("undefined %s resolved to %q", ref, got)
+		}
+	}
+	err := in.Err()
+	var stackErr *Error
+	if !errors.As(err, &stackErr) || stackErr.Kind != ValidationError {
+		t.Fatalf("undefined references gave %v, want a validation error", err)
+	}
+	for _, ref := range refs {
+		if !strings.Contains(err.Error(), "f.yaml: stack.apps.web.config: undefined "+ref) {
+			t.Errorf("%s is not reported with its location: %v", ref, err)
+		}
+	}
+}
+
+func TestNewInterpolator(t *testing.T) {
+	t.Setenv("EPHSTACK_TEST_REGION", "westeurope")
+	defer func() { VarOverrides = make(map[string]string) }()
+	VarOverrides = map[string]string{"Size": "small"}
+
+	in, err := NewInterpolator("s.yaml", "s1", map[string]interface{}{"size": "large", "region": "${env:EPHSTACK_TEST_REGION}", "disks": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"size": "small", "region": "westeurope", "disks": "2"}
+	if !reflect.DeepEqual(in.Vars, want) {
+		t.Errorf("vars %v, want %v", in.Vars, want)
+	}
+
+	if _, err := NewInterpolator("s.yaml", "s1", map[string]interface{}{"owner": "${env:EPHSTACK_TEST_UNSET}"}); err == nil || !strings.Contains(err.Error(), "s.yaml: stack.vars.owner") {
+		t.Errorf("an undefined reference in a default gave %v", err)
+	}
+}
+
+func TestInterpolatorSettings(t *testing.T) {
+	in := &Interpolator{Vars: map[string]string{"domain": "example.com"}, StackName: "s1"}
+	settings := map[string]interface{}{
+		"stack": map[string]interface{}{
+			"name": "s1",
+			"vars": map[string]interface{}{"domain": "${env:EPHSTACK_TEST_UNSET}"},
+			"apps": map[string]interface{}{
+				"web": map[string]interface{}{
+					"facts":     []interface{}{map[string]interface{}{"role": "web"}, map[string]interface{}{"url": "${facts.role}.${var:domain}"}},
+					"dns_label": "${stack.name}-${facts.role}",
+				},
+			},
+			"environments": map[string]interface{}{
+				"qa": map[string]interface{}{
+					"ttl": "${var:ttl}",
+					"apps": map[string]interface{}{
+						"web": map[string]interface{}{
+							"facts":     []interface{}{map[string]interface{}{"role": "qa-${facts.role}"}},
+							"dns_label": "${facts.role}",
+						},
+					},
+				},
+			},
+		},
+	}
+	resolved := in.Settings(settings, "s.yaml")
+	stack := resolved["stack"].(map[string]interface{})
+	web := stack["apps"].(map[string]interface{})["web"].(map[string]interface{})
+	if web["dns_label"] != "s1-web" {
+		t.Errorf("dns_label %v", web["dns_label"])
+	}
+	// facts can't refer to the facts of the same block, only to the ones they override
+	if facts := FlattenMapList(web["facts"]); facts["url"] != "${facts.role}.example.com" {
+		t.Errorf("facts %v", facts)
+	}
+	// the vars: block was resolved by NewInterpolator
+	if vars := stack["vars"].(map[string]interface{}); vars["domain"] != "${env:EPHSTACK_TEST_UNSET}" {
+		t.Errorf("vars %v", vars)
+	}
+	qa := stack["environments"].(map[string]interface{})["qa"].(map[string]interface{})
+	qaWeb := qa["apps"].(map[string]interface{})["web"].(map[string]interface{})
+	if facts := FlattenMapList(qaWeb["facts"]); facts["role"] != "qa-web" {
+		t.Errorf("environment facts %v", facts)
+	}
+	if qaWeb["dns_label"] != "qa-web" {
+		t.Errorf("environment dns_label %v", qaWeb["dns_label"])
+	}
+
+	err := in.Err()
+	if err == nil {
+		t.Fatal("the undefined references are not reported")
+	}
+	for _, want := range []string{"s.yaml: stack.apps.web.facts[1].url: undefined ${facts.role}", "s.yaml: stack.environments.qa.ttl: undefined ${var:ttl}"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q is not reported: %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// localProvider allocates fake hosts on loopback addresses instead of cloud VMs,
+// and records them in a JSON state file. It lets the whole pipeline run on a
+// laptop or a CI runner without paying for VMs.
+type localProvider struct{}
+
+// localHost is a fake host allocated for an app
+type localHost struct {
+	Name     string            `json:"name"`
+	App      string            `json:"app"`
+	Infra    string            `json:"infra"`
+	IP       string            `json:"ip"`
+	Username string            `json:"username"`
+	Password string            `json:"password,omitempty"`
+	Facts    map[string]string `json:"facts,omitempty"`
+}
+
+// localState is the state of one environment of a stack on the local provider. Its
+// private key and passwords are encrypted in the state file, see stateCipher.
+type localState struct {
+	Stack          string                `json:"stack"`
+	Env            string                `json:"env"`
+	UpdatedAt      string                `json:"updatedAt"`
+	ExpiresAt      string                `json:"expiresAt,omitempty"`
+	SSHPublicKey   string                `json:"sshPublicKey"`
+	SSHPrivateKey  string                `json:"sshPrivateKey"`
+	Hosts          map[string]*localHost `json:"hosts"`          // by host name, see appHost
+	EncryptionSalt []byte                `json:"encryptionSalt"` // the salt of the key of its secrets
+}
+
+const localUsername = "ephstack"
+
+// localStateFile returns ~/.ephstack/local/<stack>/<env>.json
+func localStateFile(stackName string, envName string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".ephstack", "local", stackName, envName+".json"), nil
+}
+
+// readLocalState reads the state of a stack's environment, os.ErrNotExist if it was never deployed locally
+func readLocalState(stackName string, envName string) (*localState, error) {
+	stateFile, err := localStateFile(stackName, envName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	state := &localState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.New("corrupt local state " + stateFile + ": " + err.Error())
+	}
+	aead, err := stateCipher(state.EncryptionSalt)
+	if err != nil {
+		return nil, errors.New("local state " + stateFile + ": " + err.Error())
+	}
+	if state.SSHPrivateKey, err = openSecret(aead, state.SSHPrivateKey); err != nil {
+		return nil, errors.New("local state " + stateFile + ": " + err.Error())
+	}
+	for hostName, host := range state.Hosts {
+		if host.Password, err = openSecret(aead, host.Password); err != nil {
+			return nil, errors.New("local state " + stateFile + ": host " + hostName + ": " + err.Error())
+		}
+	}
+	return state, nil
+}
+
+// write saves the state readable only by the user, its private key and passwords
+// encrypted
+func (state *localState) write() error {
+	stateFile, err := localStateFile(state.Stack, state.Env)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		return err
+	}
+	if len(state.EncryptionSalt) == 0 {
+		if state.EncryptionSalt, err = newSalt(); err != nil {
+			return err
+		}
+	}
+	aead, err := stateCipher(state.EncryptionSalt)
+	if err != nil {
+		return err
+	}
+	sealed := *state
+	if sealed.SSHPrivateKey, err = sealSecret(aead, state.SSHPrivateKey); err != nil {
+		return err
+	}
+	sealed.Hosts = make(map[string]*localHost, len(state.Hosts))
+	for hostName, host := range state.Hosts {
+		sealedHost := *host
+		if sealedHost.Password, err = sealSecret(aead, host.Password); err != nil {
+			return err
+		}
+		sealed.Hosts[hostName] = &sealedHost
+	}
+	data, err := json.MarshalIndent(&sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stateFile, data, 0600)
+}
+
+// outputs presents the state like the outputs of a pulumi stack, so the credentials
+// and addresses are read the same way for every provider
+func (state *localState) outputs() auto.OutputMap {
+	outs := auto.OutputMap{
+		sshPublicKeyOutput:  {Value: state.SSHPublicKey},
+		sshPrivateKeyOutput: {Value: state.SSHPrivateKey, Secret: true},
+	}
+	if state.ExpiresAt != "" {
+		outs["expiresAt"] = auto.OutputValue{Value: state.ExpiresAt}
+	}
+	for hostName, host := range state.Hosts {
+		facts := make(map[string]interface{}, len(host.Facts))
+		for key, value := range host.Facts {
+			facts[key] = value
+		}
+		appOuts := map[string]interface{}{
+			"app":      host.App,
+			"ip":       host.IP,
+			"username": host.Username,
+			"facts":    facts,
+		}
+		if host.Password != "" {
+			appOuts["password"] = host.Password
+		}
+		outs[hostName] = auto.OutputValue{Value: appOuts, Secret: host.Password != ""}
+	}
+	return outs
+}
+
+// nextLoopbackIP returns the first address of 127.0.0.0/8, after 127.0.0.1, no host uses yet
+func (state *localState) nextLoopbackIP() (string, error) {
+	used := make(map[string]bool, len(state.Hosts))
+	for _, host := range state.Hosts {
+		used[host.IP] = true
+	}
+	for i := 2; i < 1<<16; i++ {
+		ip := fmt.Sprintf("127.0.%d.%d", i/256, i%256)
+		if i%256 != 0 && i%256 != 255 && !used[ip] {
+			return ip, nil
+		}
+	}
+	return "", errors.New("no loopback addresses left")
+}
+
+// generateLocalPassword returns a random 16 character alphanumeric password
+func generateLocalPassword() (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	password := make([]byte, 16)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = letters[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// Provision allocates the hosts of every app. Hosts that are still in the stack keep
+// their address and credentials, hosts of removed apps or past an app's count are released.
+func (localProvider) Provision(ctx context.Context) error {
+	op := "provision local stack " + StackInstance.Id + "/" + StackInstance.Env
+
+	state, err := readLocalState(StackInstance.Id, StackInstance.Env)
+	if errors.Is(err, os.ErrNotExist) {
+		state = &localState{Stack: StackInstance.Id, Env: StackInstance.Env, Hosts: make(map[string]*localHost)}
+	} else if err != nil {
+		return NewError(ProvisioningError, op, err)
+	}
+
+	if state.SSHPrivateKey == "" {
+		keyPair, err := GenerateSSHKeyPair()
+		if err != nil {
+			return NewError(ProvisioningError, op, err)
+		}
+		state.SSHPublicKey, state.SSHPrivateKey = keyPair.PublicKey, keyPair.PrivateKey
+	}
+
+	hosts := stackHosts()
+	inStack := make(map[string]bool, len(hosts))
+	for _, appHost := range hosts {
+		inStack[appHost.Name] = true
+	}
+	for hostName, host := range state.Hosts {
+		if !inStack[hostName] {
+			logStatus(StackInstance.Env, host.App, "releasing "+hostName)
+			delete(state.Hosts, hostName)
+		}
+	}
+
+	for _, appHost := range hosts {
+		appInst := StackInstance.AppInstances[appHost.App]
+		host := state.Hosts[appHost.Name]
+		if host == nil {
+			ip, err := state.nextLoopbackIP()
+			if err != nil {
+				return NewError(QuotaError, op, err)
+			}
+			host = &localHost{Name: StackInstance.Id + "-" + appHost.Name, IP: ip, Username: localUsername}
+			state.Hosts[appHost.Name] = host
+		}
+		host.App = appHost.App
+		host.Infra = appInst.Infra
+		host.Facts = appInst.hostFacts(appHost)
+
+		if !appInst.PasswordAuth {
+			host.Password = ""
+		} else if host.Password == "" {
+			if host.Password, err = generateLocalPassword(); err != nil {
+				return NewError(ProvisioningError, op, err)
+			}
+		}
+	}
+
+	state.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	state.ExpiresAt = environmentExpiry(state.outputs())
+	if err := state.write(); err != nil {
+		return NewError(ProvisioningError, op, err)
+	}
+
+	outs := state.outputs()
+	for _, appHost := range hosts {
+		if appHost.Index == 0 {
+			StackInstance.AppInstances[appHost.App].Creds = AppCredentials(outs, appHost.Name)
+		}
+		logStatus(StackInstance.Env, appHost.App, fmt.Sprintf("deployed %s running at local IP %s", appHost.Name, state.Hosts[appHost.Name].IP))
+	}
+	return nil
+}
+
+// Preview lists the hosts Provision would allocate or release
+func (localProvider) Preview(ctx context.Context) error {
+	state, err := readLocalState(StackInstance.Id, StackInstance.Env)
+	if errors.Is(err, os.ErrNotExist) {
+		state = &localState{Hosts: make(map[string]*localHost)}
+	} else if err != nil {
+		return NewError(ProvisioningError, "preview local stack "+StackInstance.Id, err)
+	}
+
+	inStack := make(map[string]bool)
+	for _, appHost := range stackHosts() {
+		inStack[appHost.Name] = true
+		if host, ok := state.Hosts[appHost.Name]; ok {
+			logStatus(StackInstance.Env, appHost.App, "  "+appHost.Name+" keeps "+host.IP)
+		} else {
+			logStatus(StackInstance.Env, appHost.App, "+ "+appHost.Name+" gets a new loopback host")
+		}
+	}
+	for hostName, host := range state.Hosts {
+		if !inStack[hostName] {
+			logStatus(StackInstance.Env, host.App, "- "+hostName+" releases "+host.IP)
+		}
+	}
+	return nil
+}
+
+// Destroy removes the state of the stack's environment
+func (localProvider) Destroy(ctx context.Context) error {
+	op := "destroy local stack " + StackInstance.Id + "/" + StackInstance.Env
+	stateFile, err := localStateFile(StackInstance.Id, StackInstance.Env)
+	if err != nil {
+		return NewError(ProvisioningError, op, err)
+	}
+	if err := os.Remove(stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return NewError(ProvisioningError, op, err)
+	}
+	logStatus(StackInstance.Env, "", "destroyed local hosts of "+StackInstance.Id)
+	return nil
+}
+
+// the entry of the local state in Resources
+const localResources = "local"
+
+// Resources lists the hosts of the stack's environment
+func (localProvider) Resources(ctx context.Context) (map[string][]string, error) {
+	state, err := readLocalState(StackInstance.Id, StackInstance.Env)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string][]string{}, nil
+	} else if err != nil {
+		return nil, NewError(ProvisioningError, "read local stack "+StackInstance.Id, err)
+	}
+	hostNames := make([]string, 0, len(state.Hosts))
+	for hostName := range state.Hosts {
+		hostNames = append(hostNames, hostName)
+	}
+	sort.Strings(hostNames)
+	return map[string][]string{localResources: hostNames}, nil
+}
+
+// Cleanup releases the hosts allocated since before, and removes the state if it is new
+func (localProvider) Cleanup(ctx context.Context, before map[string][]string) ([]string, error) {
+	op := "clean up local stack " + StackInstance.Id + "/" + StackInstance.Env
+	state, err := readLocalState(StackInstance.Id, StackInstance.Env)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, NewError(ProvisioningError, op, err)
+	}
+
+	hostNames, existed := before[localResources]
+	if !existed {
+		stateFile, err := localStateFile(StackInstance.Id, StackInstance.Env)
+		if err != nil {
+			return nil, NewError(ProvisioningError, op, err)
+		}
+		if err := os.Remove(stateFile); err != nil {
+			return nil, NewError(ProvisioningError, op, err)
+		}
+		return []string{fmt.Sprintf("the local state of %s, %d hosts", StackInstance.Id, len(state.Hosts))}, nil
+	}
+
+	kept := make(map[string]bool, len(hostNames))
+	for _, hostName := range hostNames {
+		kept[hostName] = true
+	}
+	var released []string
+	for hostName, host := range state.Hosts {
+		if !kept[hostName] {
+			released = append(released, "host "+hostName+" at "+host.IP)
+			delete(state.Hosts, hostName)
+		}
+	}
+	if len(released) == 0 {
+		return nil, nil
+	}
+	sort.Strings(released)
+	if err := state.write(); err != nil {
+		return nil, NewError(ProvisioningError, op, err)
+	}
+	return released, nil
+}
@@ -0,0 +1,250 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how long to wait for a locked stack, 0 to fail right away
+var LockTimeout time.Duration
+
+// run without the lock, e.g. without the credentials to keep it in the state backend
+var NoLock bool
+
+// a lock older than this is stale, no deploy or destroy takes that long
+var LockStaleAfter = 6 * time.Hour
+
+// how often a locked stack is checked while waiting for it
+const lockPollInterval = 2 * time.Second
+
+// StackLockType is the lock an operation holds on an environment of a stack, and on
+// its networking stack, while it runs
+type StackLockType struct {
+	Holder     string    `json:"holder"` // user@host
+	Host       string    `json:"host"`
+	PID        int       `json:"pid"`
+	Operation  string    `json:"operation"` // deploy, destroy or import
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+func (lock *StackLockType) String() string {
+	return fmt.Sprintf("%s by %s (pid %d) since %s", lock.Operation, lock.Holder, lock.PID, lock.AcquiredAt.Format(time.RFC3339))
+}
+
+// stale tells why the lock is left over, "" if its holder may still be running
+func (lock *StackLockType) stale() string {
+	if time.Since(lock.AcquiredAt) > LockStaleAfter {
+		return "older than " + LockStaleAfter.String()
+	}
+	if host, _ := os.Hostname(); host == lock.Host {
+		// signal 0 only checks the process exists
+		process, err := os.FindProcess(lock.PID)
+		if err != nil || process.Signal(syscall.Signal(0)) != nil {
+			return fmt.Sprintf("process %d is gone", lock.PID)
+		}
+	}
+	return ""
+}
+
+// newStackLock describes the current process holding a lock for operation
+func newStackLock(operation string) *StackLockType {
+	host, _ := os.Hostname()
+	userName := "unknown"
+	if current, err := user.Current(); err == nil {
+		userName = current.Username
+	}
+	return &StackLockType{
+		Holder:     userName + "@" + host,
+		Host:       host,
+		PID:        os.Getpid(),
+		Operation:  operation,
+		AcquiredAt: time.Now().UTC(),
+	}
+}
+
+// stackMetaFile returns ~/.ephstack/<kind>/<stack>/<env>.json, or the one under a file
+// backend set with --backend, so all the users of its state share it
+func stackMetaFile(kind string, stackName string, envName string) (string, error) {
+	if backendDir := sharedBackendDir(); backendDir != "" {
+		return filepath.Join(backendDir, ".ephstack", kind, stackName, envName+".json"), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".ephstack", kind, stackName, envName+".json"), nil
+}
+
+// createStackMetaDir creates the directory of a file of stackMetaFile. Under a file
+// backend the directories & files are shared with the group of its users: the umask
+// would take the group's write permission away, so it is given back with a chmod,
+// which fails harmlessly on the ones another user created.
+func createStackMetaDir(fileName string) error {
+	backendDir := sharedBackendDir()
+	if backendDir == "" {
+		return os.MkdirAll(filepath.Dir(fileName), 0700)
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0770); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(fileName); dir != backendDir && strings.HasPrefix(dir, backendDir); dir = filepath.Dir(dir) {
+		// keeping the setgid bit that gives new files the group of the directory
+		if info, err := os.Stat(dir); err == nil {
+			os.Chmod(dir, info.Mode()&os.ModeSetgid|0770)
+		}
+	}
+	return nil
+}
+
+// stackMetaFileMode is the mode of the files of stackMetaFile, see createStackMetaDir
+func stackMetaFileMode() os.FileMode {
+	if sharedBackendDir() != "" {
+		return 0660
+	}
+	return 0600
+}
+
+// lockFile returns the lock file of an environment of a stack, see stackMetaFile
+func lockFile(stackName string, envName string) (string, error) {
+	return stackMetaFile("locks", stackName, envName)
+}
+
+// readStoredLock reads the lock of an environment of a stack along with its content,
+// nil if it is not locked
+func readStoredLock(store lockStore, stackName string, envName string) (*StackLockType, []byte, error) {
+	data, err := store.read(stackName, envName)
+	if err != nil || data == nil {
+		return nil, nil, err
+	}
+	lock := &StackLockType{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, nil, errors.New("lock of " + stackName + "/" + envName + ": " + err.Error())
+	}
+	return lock, data, nil
+}
+
+// removeLock removes the lock file if it still holds data. The file is renamed away
+// first, which a single process can do, then put back if another process released
+// or took over that lock and locked again meanwhile.
+func removeLock(fileName string, data []byte) error {
+	removedName := fmt.Sprintf("%s.%d.removed", fileName, os.Getpid())
+	if err := os.Rename(fileName, removedName); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(removedName)
+	removed, err := os.ReadFile(removedName)
+	if err != nil || bytes.Equal(removed, data) {
+		return err
+	}
+	// a link fails rather than replace a lock taken since the rename
+	if err := os.Link(removedName, fileName); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// AcquireLock locks an environment of a stack for operation, waiting up to LockTimeout
+// for another operation to release it. Stale locks are taken over. The returned func
+// releases the lock.
+func AcquireLock(stackName string, envName string, operation string) (func(), error) {
+	op := "lock stack " + stackName + "/" + envName
+	if NoLock {
+		return func() {}, nil
+	}
+	store, err := newLockStore()
+	if err != nil {
+		return nil, NewError(LockError, op, err)
+	}
+	lock := newStackLock(operation)
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return nil, NewError(LockError, op, err)
+	}
+
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		created, err := store.create(stackName, envName, data)
+		if err != nil {
+			return nil, NewError(LockError, op, err)
+		}
+		if created {
+			release := func() {
+				// unless it was forced open & taken by another operation meanwhile
+				store.remove(stackName, envName, data)
+			}
+			return release, nil
+		}
+
+		held, heldData, err := readStoredLock(store, stackName, envName)
+		if err != nil {
+			return nil, NewError(LockError, op, err)
+		}
+		if held == nil {
+			// released between the two calls
+			continue
+		}
+		if reason := held.stale(); reason != "" {
+			logStatus(envName, "", "taking over the stale lock of "+held.String()+": "+reason)
+			// unless another process took it over first
+			if err := store.remove(stackName, envName, heldData); err != nil {
+				return nil, NewError(LockError, op, err)
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, NewError(LockError, op, errors.New("locked for "+held.String()+", retry later, wait with --lock-timeout or run 'ephstack unlock --force' if it is left over"))
+		}
+		logStatus(envName, "", "waiting for the lock of "+held.String())
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Unlock removes the lock of an environment of a stack, and returns it. Unless forced,
+// only a lock of the current user & host, or a stale one, is removed.
+func Unlock(stackName string, envName string, force bool) (*StackLockType, error) {
+	op := "unlock stack " + stackName + "/" + envName
+	store, err := newLockStore()
+	if err != nil {
+		return nil, NewError(LockError, op, err)
+	}
+	held, heldData, err := readStoredLock(store, stackName, envName)
+	if err != nil {
+		return nil, NewError(LockError, op, err)
+	}
+	if held == nil {
+		return nil, nil
+	}
+	if !force && held.Holder != newStackLock("").Holder && held.stale() == "" {
+		return nil, NewError(LockError, op, errors.New("locked for "+held.String()+", use --force to remove the lock of another user"))
+	}
+	if err := store.remove(stackName, envName, heldData); err != nil {
+		return nil, NewError(LockError, op, err)
+	}
+	return held, nil
+}
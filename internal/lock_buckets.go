@@ -0,0 +1,729 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3LockStore keeps the locks as objects of an S3 bucket, or of compatible object
+// storage like MinIO. They are created with If-None-Match: *, which S3 refuses if
+// the object exists.
+type s3LockStore struct {
+	endpoint  *url.URL // of the bucket's region, or of the endpoint of the backend URL
+	pathStyle bool     // the bucket is in the path rather than the host name, e.g. for MinIO
+	bucket    string
+	prefix    string
+	region    string
+	creds     awsCredentials
+}
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// newS3LockStore reads the bucket of an s3:// backend URL and the query parameters
+// pulumi reads too: region, endpoint, disableSSL, s3ForcePathStyle and profile
+func newS3LockStore(backend string) (lockStore, error) {
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	query := backendQuery(backendURL)
+	store := &s3LockStore{
+		bucket:    backendURL.Host,
+		prefix:    backendURL.Path,
+		pathStyle: query.Get("s3ForcePathStyle") == "true" || query.Get("use_path_style") == "true",
+	}
+	for _, region := range []string{query.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"} {
+		if region != "" {
+			store.region = region
+			break
+		}
+	}
+	scheme := "https"
+	if query.Get("disableSSL") == "true" || query.Get("disable_https") == "true" {
+		scheme = "http"
+	}
+	endpoint := scheme + "://s3." + store.region + ".amazonaws.com"
+	if custom := query.Get("endpoint"); strings.Contains(custom, "://") {
+		endpoint = custom
+	} else if custom != "" {
+		endpoint = scheme + "://" + custom
+	}
+	if store.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/")); err != nil {
+		return nil, err
+	}
+	if store.creds, err = awsLockCredentials(query.Get("profile")); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// awsLockCredentials reads the AWS credentials from the environment, else from a
+// profile of the shared credentials file
+func awsLockCredentials(profile string) (awsCredentials, error) {
+	if accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID"); accessKeyID != "" {
+		return awsCredentials{accessKeyID, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	fileName := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if fileName == "" {
+		homeDir, _ := os.UserHomeDir()
+		fileName = filepath.Join(homeDir, ".aws", "credentials")
+	}
+	creds := awsCredentials{}
+	if file, err := os.Open(fileName); err == nil {
+		defer file.Close()
+		section := ""
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = strings.TrimSpace(line[1 : len(line)-1])
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || section != profile {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "aws_access_key_id":
+				creds.accessKeyID = strings.TrimSpace(value)
+			case "aws_secret_access_key":
+				creds.secretAccessKey = strings.TrimSpace(value)
+			case "aws_session_token":
+				creds.sessionToken = strings.TrimSpace(value)
+			}
+		}
+	}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return creds, errors.New("no AWS credentials to keep the lock of the stack in the backend: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or profile '" + profile + "' in " + fileName)
+	}
+	return creds, nil
+}
+
+// objectURL returns the URL of an object of the bucket
+func (store *s3LockStore) objectURL(key string) string {
+	host, path := store.endpoint.Host, store.endpoint.EscapedPath()
+	if store.pathStyle {
+		path += "/" + awsURIEncode(store.bucket, true)
+	} else {
+		host = store.bucket + "." + host
+	}
+	return store.endpoint.Scheme + "://" + host + path + "/" + awsURIEncode(key, false)
+}
+
+func (store *s3LockStore) do(method string, key string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, store.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signAWSRequest(req, body, store.creds, store.region, time.Now())
+	return lockHTTPClient.Do(req)
+}
+
+func (store *s3LockStore) create(stackName string, envName string, data []byte) (bool, error) {
+	res, err := store.do(http.MethodPut, lockObjectKey(store.prefix, stackName, envName), data,
+		http.Header{"Content-Type": {"application/json"}, "If-None-Match": {"*"}})
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// it exists, or another operation is creating it
+		return false, nil
+	}
+	return false, lockResponseError(res)
+}
+
+// get returns the content and ETag of an object, nil if it doesn't exist
+func (store *s3LockStore) get(key string) ([]byte, string, error) {
+	res, err := store.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	} else if res.StatusCode != http.StatusOK {
+		return nil, "", lockResponseError(res)
+	}
+	var data bytes.Buffer
+	_, err = data.ReadFrom(res.Body)
+	return data.Bytes(), res.Header.Get("ETag"), err
+}
+
+func (store *s3LockStore) read(stackName string, envName string) ([]byte, error) {
+	data, _, err := store.get(lockObjectKey(store.prefix, stackName, envName))
+	return data, err
+}
+
+func (store *s3LockStore) remove(stackName string, envName string, data []byte) error {
+	key := lockObjectKey(store.prefix, stackName, envName)
+	held, etag, err := store.get(key)
+	if err != nil || held == nil || !bytes.Equal(held, data) {
+		return err
+	}
+	// If-Match leaves a lock taken over since it was read
+	res, err := store.do(http.MethodDelete, key, nil, http.Header{"If-Match": {etag}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound, http.StatusPreconditionFailed:
+		return nil
+	}
+	return lockResponseError(res)
+}
+
+// signAWSRequest signs a request to S3 with AWS signature version 4, over its host
+// and all its headers
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), strings.Join(params, "&"),
+		canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// awsURIEncode escapes all but the unreserved characters, and / unless encodeSlash
+func awsURIEncode(value string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			escaped.WriteByte(b)
+		default:
+			escaped.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{b})))
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// azblobLockStore keeps the locks as blobs of an Azure Blob container, or of the
+// Azurite emulator. They are created with If-None-Match: *, which Azure refuses if
+// the blob exists.
+type azblobLockStore struct {
+	endpoint  *url.URL // of the account's blob service
+	account   string
+	key       []byte // the account key, nil with a SAS token
+	sasToken  string
+	container string
+	prefix    string
+}
+
+// newAzblobLockStore reads the container of an azblob:// backend URL, the account of
+// AZURE_STORAGE_ACCOUNT with the key of AZURE_STORAGE_KEY or the token of
+// AZURE_STORAGE_SAS_TOKEN, and the emulator settings pulumi reads too: the domain,
+// protocol and localemu query parameters or AZURE_STORAGE_DOMAIN,
+// AZURE_STORAGE_PROTOCOL and AZURE_STORAGE_IS_LOCAL_EMULATOR
+func newAzblobLockStore(backend string) (lockStore, error) {
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	query := backendQuery(backendURL)
+	setting := func(param string, envVar string, defaultValue string) string {
+		if value := query.Get(param); value != "" {
+			return value
+		}
+		if value := os.Getenv(envVar); value != "" {
+			return value
+		}
+		return defaultValue
+	}
+	store := &azblobLockStore{
+		account:   os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		sasToken:  strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+		container: backendURL.Host,
+		prefix:    backendURL.Path,
+	}
+	if store.account == "" {
+		return nil, errors.New("no Azure storage account to keep the lock of the stack in the backend: set AZURE_STORAGE_ACCOUNT")
+	}
+	if accountKey := os.Getenv("AZURE_STORAGE_KEY"); accountKey != "" {
+		if store.key, err = base64.StdEncoding.DecodeString(accountKey); err != nil {
+			return nil, errors.New("AZURE_STORAGE_KEY is not a base64 account key")
+		}
+	} else if store.sasToken == "" {
+		return nil, errors.New("no Azure storage credentials to keep the lock of the stack in the backend: set AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN")
+	}
+
+	protocol := setting("protocol", "AZURE_STORAGE_PROTOCOL", "https")
+	domain := setting("domain", "AZURE_STORAGE_DOMAIN", "blob.core.windows.net")
+	endpoint := protocol + "://" + store.account + "." + domain
+	if emulator, _ := strconv.ParseBool(setting("localemu", "AZURE_STORAGE_IS_LOCAL_EMULATOR", "false")); emulator {
+		// the emulator has the account in the path
+		endpoint = protocol + "://" + domain + "/" + store.account
+	}
+	if store.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *azblobLockStore) do(method string, key string, body []byte, header http.Header) (*http.Response, error) {
+	blobURL := *store.endpoint
+	blobURL.Path += "/" + store.container + "/" + key
+	blobURL.RawQuery = store.sasToken
+	req, err := http.NewRequest(method, blobURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-version", "2020-10-02")
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if store.key != nil {
+		signAzblobRequest(req, store.account, store.key)
+	}
+	return lockHTTPClient.Do(req)
+}
+
+// signAzblobRequest signs a request to the blob service with the Shared Key of the account
+func signAzblobRequest(req *http.Request, account string, key []byte) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var msHeaders []string
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name+":"+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(query[name], ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // the date is in x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + strings.Join(msHeaders, "\n") + "\n" + resource
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (store *azblobLockStore) create(stackName string, envName string, data []byte) (bool, error) {
+	res, err := store.do(http.MethodPut, lockObjectKey(store.prefix, stackName, envName), data, http.Header{
+		"Content-Type":   {"application/json"},
+		"If-None-Match":  {"*"},
+		"X-Ms-Blob-Type": {"BlockBlob"},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return false, nil
+	}
+	return false, lockResponseError(res)
+}
+
+// get returns the content and ETag of a blob, nil if it doesn't exist
+func (store *azblobLockStore) get(key string) ([]byte, string, error) {
+	res, err := store.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	} else if res.StatusCode != http.StatusOK {
+		return nil, "", lockResponseError(res)
+	}
+	var data bytes.Buffer
+	_, err = data.ReadFrom(res.Body)
+	return data.Bytes(), res.Header.Get("ETag"), err
+}
+
+func (store *azblobLockStore) read(stackName string, envName string) ([]byte, error) {
+	data, _, err := store.get(lockObjectKey(store.prefix, stackName, envName))
+	return data, err
+}
+
+func (store *azblobLockStore) remove(stackName string, envName string, data []byte) error {
+	key := lockObjectKey(store.prefix, stackName, envName)
+	held, etag, err := store.get(key)
+	if err != nil || held == nil || !bytes.Equal(held, data) {
+		return err
+	}
+	res, err := store.do(http.MethodDelete, key, nil, http.Header{"If-Match": {etag}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound, http.StatusPreconditionFailed:
+		return nil
+	}
+	return lockResponseError(res)
+}
+
+// gcsLockStore keeps the locks as objects of a Google Cloud Storage bucket. They are
+// created with ifGenerationMatch=0, which GCS refuses if the object exists.
+type gcsLockStore struct {
+	endpoint string // https://storage.googleapis.com, or the emulator of STORAGE_EMULATOR_HOST
+	bucket   string
+	prefix   string
+	token    string // none for the emulator
+}
+
+// newGCSLockStore reads the bucket of a gs:// backend URL, and gets an access token
+// like the google client libraries do, see googleAccessToken
+func newGCSLockStore(backend string) (lockStore, error) {
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	store := &gcsLockStore{endpoint: "https://storage.googleapis.com", bucket: backendURL.Host, prefix: backendURL.Path}
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		store.endpoint = strings.TrimSuffix(emulator, "/")
+		if !strings.Contains(emulator, "://") {
+			store.endpoint = "http://" + store.endpoint
+		}
+		return store, nil
+	}
+	if store.token, err = googleAccessToken(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *gcsLockStore) do(method string, path string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, store.endpoint+path+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if store.token != "" {
+		req.Header.Set("Authorization", "Bearer "+store.token)
+	}
+	return lockHTTPClient.Do(req)
+}
+
+// objectPath returns the path of an object in the JSON API
+func (store *gcsLockStore) objectPath(key string) string {
+	return "/storage/v1/b/" + url.PathEscape(store.bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (store *gcsLockStore) create(stackName string, envName string, data []byte) (bool, error) {
+	query := url.Values{
+		"uploadType":        {"media"},
+		"name":              {lockObjectKey(store.prefix, stackName, envName)},
+		"ifGenerationMatch": {"0"},
+	}
+	res, err := store.do(http.MethodPost, "/upload/storage/v1/b/"+url.PathEscape(store.bucket)+"/o", query, data)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusPreconditionFailed:
+		return false, nil
+	}
+	return false, lockResponseError(res)
+}
+
+// get returns the content and generation of an object, nil if it doesn't exist
+func (store *gcsLockStore) get(key string) ([]byte, string, error) {
+	res, err := store.do(http.MethodGet, store.objectPath(key), url.Values{"alt": {"media"}}, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	} else if res.StatusCode != http.StatusOK {
+		return nil, "", lockResponseError(res)
+	}
+	var data bytes.Buffer
+	_, err = data.ReadFrom(res.Body)
+	return data.Bytes(), res.Header.Get("X-Goog-Generation"), err
+}
+
+func (store *gcsLockStore) read(stackName string, envName string) ([]byte, error) {
+	data, _, err := store.get(lockObjectKey(store.prefix, stackName, envName))
+	return data, err
+}
+
+func (store *gcsLockStore) remove(stackName string, envName string, data []byte) error {
+	key := lockObjectKey(store.prefix, stackName, envName)
+	held, generation, err := store.get(key)
+	if err != nil || held == nil || !bytes.Equal(held, data) {
+		return err
+	}
+	query := url.Values{}
+	if generation != "" {
+		query.Set("ifGenerationMatch", generation)
+	}
+	res, err := store.do(http.MethodDelete, store.objectPath(key), query, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound, http.StatusPreconditionFailed:
+		return nil
+	}
+	return lockResponseError(res)
+}
+
+// the scope of the access tokens of the GCS lock store
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// googleAccessToken gets an access token from GOOGLE_OAUTH_ACCESS_TOKEN, the
+// credentials file of GOOGLE_APPLICATION_CREDENTIALS or of gcloud auth
+// application-default login, else the metadata server of a google cloud VM
+func googleAccessToken() (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	credsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if credsFile == "" {
+		homeDir, _ := os.UserHomeDir()
+		defaultFile := filepath.Join(homeDir, ".config", "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(defaultFile); err == nil {
+			credsFile = defaultFile
+		}
+	}
+	if credsFile != "" {
+		return googleFileToken(credsFile)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	token, err := googleTokenResponse((&http.Client{Timeout: 3 * time.Second}).Do(req))
+	if err != nil {
+		return "", errors.New("no Google credentials to keep the lock of the stack in the backend: set GOOGLE_APPLICATION_CREDENTIALS or GOOGLE_OAUTH_ACCESS_TOKEN (" + err.Error() + ")")
+	}
+	return token, nil
+}
+
+// googleFileToken exchanges the credentials of a service account key file, or the
+// refresh token of gcloud's application default credentials, for an access token
+func googleFileToken(credsFile string) (string, error) {
+	data, err := os.ReadFile(credsFile)
+	if err != nil {
+		return "", err
+	}
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return "", errors.New("google credentials " + credsFile + ": " + err.Error())
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	form := url.Values{}
+	switch creds.Type {
+	case "service_account":
+		assertion, err := googleJWT(creds.ClientEmail, creds.PrivateKey, creds.TokenURI, time.Now())
+		if err != nil {
+			return "", errors.New("google credentials " + credsFile + ": " + err.Error())
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	default:
+		return "", errors.New("google credentials " + credsFile + " of type '" + creds.Type + "' are not supported, use a service account key or GOOGLE_OAUTH_ACCESS_TOKEN")
+	}
+	return googleTokenResponse(lockHTTPClient.PostForm(creds.TokenURI, form))
+}
+
+// googleJWT signs the assertion of a service account requesting an access token
+func googleJWT(email string, privateKey string, audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return "", errors.New("the private key is not PEM encoded")
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		key, _ = parsed.(*rsa.PrivateKey)
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", err
+	}
+	if key == nil {
+		return "", errors.New("the private key is not an RSA key")
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": gcsScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// googleTokenResponse reads the access token of a response of an OAuth token endpoint
+func googleTokenResponse(res *http.Response, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", lockResponseError(res)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no access token in the response of " + res.Request.URL.Host)
+	}
+	return token.AccessToken, nil
+}
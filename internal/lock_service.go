@@ -0,0 +1,198 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// the tag of a lock stack of the pulumi service holding the lock, continued in the
+// tags ephstack:lock.1, ephstack:lock.2... as tag values are at most 256 characters
+const lockStackTag = "ephstack:lock"
+
+const maxTagValue = 256
+
+// lockTags splits a lock into the tags of a lock stack
+func lockTags(data []byte) map[string]string {
+	tags := make(map[string]string)
+	for part := 0; len(data) > 0 || part == 0; part++ {
+		name := lockStackTag
+		if part > 0 {
+			name += "." + strconv.Itoa(part)
+		}
+		size := len(data)
+		if size > maxTagValue {
+			size = maxTagValue
+		}
+		tags[name], data = string(data[:size]), data[size:]
+	}
+	return tags
+}
+
+// serviceLockStore keeps the locks as stacks of the pulumi service, named
+// <env>.lock in the project of the stack, with the lock in a tag. The service refuses
+// to create a stack that exists, so a single operation creates the lock stack.
+type serviceLockStore struct {
+	api   string // e.g. https://api.pulumi.com
+	token string
+	org   string
+}
+
+// newServiceLockStore logs in to the service of an https:// backend URL with the token
+// of PULUMI_ACCESS_TOKEN or of pulumi login, and keeps the locks in the org the stacks
+// are created in: the default org of the backend, else the org of the user
+func newServiceLockStore(backend string) (lockStore, error) {
+	store := &serviceLockStore{api: strings.TrimSuffix(backend, "/")}
+	if store.api == "https://app.pulumi.com" {
+		store.api = "https://api.pulumi.com"
+	}
+	creds, err := workspace.GetStoredCredentials()
+	if err != nil {
+		return nil, err
+	}
+	store.token = os.Getenv("PULUMI_ACCESS_TOKEN")
+	if store.token == "" {
+		store.token = creds.AccessTokens[store.api]
+	}
+	if store.token == "" {
+		return nil, errors.New("no access token to keep the lock of the stack in " + store.api + ": set PULUMI_ACCESS_TOKEN or run pulumi login")
+	}
+
+	if config, err := workspace.GetPulumiConfig(); err == nil {
+		store.org = config.BackendConfig[store.api].DefaultOrg
+	}
+	if store.org == "" {
+		res, err := store.do(http.MethodGet, "/api/user", nil)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, lockResponseError(res)
+		}
+		var user struct {
+			GitHubLogin string `json:"githubLogin"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&user); err != nil {
+			return nil, err
+		}
+		store.org = user.GitHubLogin
+	}
+	return store, nil
+}
+
+func (store *serviceLockStore) do(method string, path string, body interface{}) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, store.api+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.pulumi+8")
+	req.Header.Set("Authorization", "token "+store.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return lockHTTPClient.Do(req)
+}
+
+// stackPath returns the API path of the lock stack of an environment
+func (store *serviceLockStore) stackPath(stackName string, envName string) string {
+	return "/api/stacks/" + url.PathEscape(store.org) + "/" + url.PathEscape(stackName) + "/" + url.PathEscape(envName+".lock")
+}
+
+func (store *serviceLockStore) create(stackName string, envName string, data []byte) (bool, error) {
+	res, err := store.do(http.MethodPost, "/api/stacks/"+url.PathEscape(store.org)+"/"+url.PathEscape(stackName), map[string]interface{}{
+		"stackName": envName + ".lock",
+		"tags":      lockTags(data),
+	})
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	return false, lockResponseError(res)
+}
+
+func (store *serviceLockStore) read(stackName string, envName string) ([]byte, error) {
+	res, err := store.do(http.MethodGet, store.stackPath(stackName, envName), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if res.StatusCode != http.StatusOK {
+		return nil, lockResponseError(res)
+	}
+	var stack struct {
+		Tags map[string]string `json:"tags"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stack); err != nil {
+		return nil, err
+	}
+	lock, ok := stack.Tags[lockStackTag]
+	if !ok {
+		return nil, errors.New("stack " + store.org + "/" + stackName + "/" + envName + ".lock of " + store.api + " has no " + lockStackTag + " tag, remove it with pulumi stack rm")
+	}
+	for part := 1; ; part++ {
+		more, ok := stack.Tags[lockStackTag+"."+strconv.Itoa(part)]
+		if !ok {
+			break
+		}
+		lock += more
+	}
+	return []byte(lock), nil
+}
+
+// remove deletes the lock stack if it still holds data. The service can't delete a
+// stack conditionally, so a lock taken over between the read and the delete would be
+// removed too; taking over a lock is only done with stale ones.
+func (store *serviceLockStore) remove(stackName string, envName string, data []byte) error {
+	held, err := store.read(stackName, envName)
+	if err != nil || held == nil || !bytes.Equal(held, data) {
+		return err
+	}
+	res, err := store.do(http.MethodDelete, store.stackPath(stackName, envName), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return lockResponseError(res)
+}
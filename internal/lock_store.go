@@ -0,0 +1,131 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// lockStore keeps the locks of the environments of the stacks with the state backend
+// they guard, so all the users of the backend see the same ones. Creating a lock is
+// atomic: of the operations creating it at the same time, a single one gets it.
+type lockStore interface {
+	// create stores the lock of an environment unless it is locked, false if it is
+	create(stackName string, envName string, data []byte) (bool, error)
+	// read returns the content of the lock of an environment, nil if it is not locked
+	read(stackName string, envName string) ([]byte, error)
+	// remove removes the lock of an environment if it still holds data, so a lock taken
+	// over by another operation meanwhile is left alone
+	remove(stackName string, envName string, data []byte) error
+}
+
+// newLockStore returns the lock store of the state backend the stacks use
+func newLockStore() (lockStore, error) {
+	backend := stateBackend()
+	scheme, _, _ := strings.Cut(backend, "://")
+	switch scheme {
+	case "s3":
+		return newS3LockStore(backend)
+	case "azblob":
+		return newAzblobLockStore(backend)
+	case "gs":
+		return newGCSLockStore(backend)
+	case "https", "http":
+		return newServiceLockStore(backend)
+	}
+	return fileLockStore{}, nil
+}
+
+// fileLockStore keeps the locks as files, with the state of a file backend or in
+// ~/.ephstack, see lockFile
+type fileLockStore struct{}
+
+func (fileLockStore) create(stackName string, envName string, data []byte) (bool, error) {
+	fileName, err := lockFile(stackName, envName)
+	if err != nil {
+		return false, err
+	}
+	if err := createStackMetaDir(fileName); err != nil {
+		return false, err
+	}
+	// O_EXCL makes creating the lock file atomic, a single process gets it
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, stackMetaFileMode())
+	if errors.Is(err, os.ErrExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	file.Chmod(stackMetaFileMode())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fileName)
+		return false, err
+	}
+	return true, nil
+}
+
+func (fileLockStore) read(stackName string, envName string) ([]byte, error) {
+	fileName, err := lockFile(stackName, envName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (fileLockStore) remove(stackName string, envName string, data []byte) error {
+	fileName, err := lockFile(stackName, envName)
+	if err != nil {
+		return err
+	}
+	return removeLock(fileName, data)
+}
+
+// the client of the lock stores of the object storage and pulumi service backends
+var lockHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// lockObjectKey returns the key of the lock of an environment in a bucket, under the
+// path of the backend URL if it has one, like the locks of a file backend
+func lockObjectKey(prefix string, stackName string, envName string) string {
+	return path.Join(strings.Trim(prefix, "/"), ".ephstack", "locks", stackName, envName+".json")
+}
+
+// backendQuery returns the query of a backend URL, e.g. the region of s3://bucket?region=us-west-2
+func backendQuery(backend *url.URL) url.Values {
+	query, _ := url.ParseQuery(backend.RawQuery)
+	return query
+}
+
+// lockResponseError describes an unexpected response of a lock store, leaving out
+// the query of its URL, which may hold a token
+func lockResponseError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	where := res.Request.URL.Scheme + "://" + res.Request.URL.Host + res.Request.URL.EscapedPath()
+	return errors.New(res.Request.Method + " " + where + ": " + res.Status + " " + strings.TrimSpace(string(body)))
+}
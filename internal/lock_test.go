@@ -0,0 +1,192 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLockHome keeps the locks in a temporary home, with the default backend
+func useLockHome(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	backend, timeout := BackendURL, LockTimeout
+	BackendURL, LockTimeout = "", 0
+	t.Cleanup(func() { BackendURL, LockTimeout, NoLock = backend, timeout, false })
+}
+
+func TestAcquireLock(t *testing.T) {
+	useLockHome(t)
+	release, err := AcquireLock("s1", "dev", "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, _, err := readStoredLock(fileLockStore{}, "s1", "dev")
+	if err != nil || held == nil || held.Operation != "deploy" || held.PID != os.Getpid() {
+		t.Fatalf("the lock is %+v, %v", held, err)
+	}
+
+	// this process is still running, the lock isn't stale
+	_, err = AcquireLock("s1", "dev", "destroy")
+	if ExitCode(err) != 9 || !strings.Contains(err.Error(), "locked for deploy by") {
+		t.Errorf("a locked stack gave %v", err)
+	}
+	if _, err := AcquireLock("s1", "qa", "deploy"); err != nil {
+		t.Errorf("another environment is locked too: %v", err)
+	}
+
+	release()
+	if held, _, _ := readStoredLock(fileLockStore{}, "s1", "dev"); held != nil {
+		t.Errorf("the lock is left after its release: %+v", held)
+	}
+	release, err = AcquireLock("s1", "dev", "destroy")
+	if err != nil {
+		t.Fatalf("a released lock can't be taken: %v", err)
+	}
+	release()
+}
+
+func TestAcquireStaleLock(t *testing.T) {
+	useLockHome(t)
+	fileName, _ := lockFile("s1", "dev")
+	stale := newStackLock("deploy")
+	stale.AcquiredAt = time.Now().Add(-LockStaleAfter - time.Minute)
+	data, _ := json.Marshal(stale)
+	os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err := os.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := AcquireLock("s1", "dev", "destroy")
+	if err != nil {
+		t.Fatalf("the stale lock isn't taken over: %v", err)
+	}
+	defer release()
+	if held, _, _ := readStoredLock(fileLockStore{}, "s1", "dev"); held == nil || held.Operation != "destroy" {
+		t.Errorf("the lock is %+v", held)
+	}
+}
+
+// a lock that changed since it was read as stale is left alone
+func TestRemoveLock(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "dev.json")
+	os.WriteFile(fileName, []byte("fresh"), 0600)
+	if err := removeLock(fileName, []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(fileName); string(data) != "fresh" {
+		t.Errorf("the fresh lock is %q", data)
+	}
+	if err := removeLock(fileName, []byte("fresh")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("the lock is left: %v", err)
+	}
+	if err := removeLock(fileName, []byte("fresh")); err != nil {
+		t.Errorf("removing a released lock gave %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files are left behind: %v", entries)
+	}
+}
+
+// the object storage and pulumi service backends need credentials to keep the lock in
+func TestLockBackends(t *testing.T) {
+	useLockHome(t)
+	for _, envVar := range []string{"AWS_ACCESS_KEY_ID", "AWS_PROFILE", "AZURE_STORAGE_ACCOUNT", "GOOGLE_OAUTH_ACCESS_TOKEN", "STORAGE_EMULATOR_HOST", "PULUMI_ACCESS_TOKEN"} {
+		t.Setenv(envVar, "")
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(t.TempDir(), "none.json"))
+	for _, backend := range []string{"s3://team-state", "azblob://team-state", "gs://team-state", "https://api.pulumi.com"} {
+		BackendURL = backend
+		if _, err := AcquireLock("s1", "dev", "deploy"); ExitCode(err) != 9 {
+			t.Errorf("%s without credentials gave %v", backend, err)
+		}
+	}
+	NoLock = true
+	release, err := AcquireLock("s1", "dev", "deploy")
+	if err != nil {
+		t.Fatalf("--no-lock gave %v", err)
+	}
+	release()
+
+	NoLock = false
+	for _, backend := range []string{"", "file://" + t.TempDir()} {
+		BackendURL = backend
+		release, err := AcquireLock("s1", "dev", "deploy")
+		if err != nil {
+			t.Errorf("%q gave %v", backend, err)
+			continue
+		}
+		release()
+	}
+}
+
+// the locks & records of a shared backend are writable by the group of its users
+func TestSharedBackendModes(t *testing.T) {
+	useLockHome(t)
+	backendDir := t.TempDir()
+	BackendURL = "file://" + backendDir
+	StackInstance = &StackType{Id: "s1", Env: "dev"}
+	defer func() { StackInstance = nil }()
+
+	release, err := AcquireLock("s1", "dev", "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if err := saveDeployment([]byte(`{"stack":{"Id":"s1","Env":"dev"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	lockName, _ := lockFile("s1", "dev")
+	recordName, _ := deploymentFile("s1", "dev")
+	for _, name := range []string{lockName, recordName} {
+		if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0660 {
+			t.Errorf("%s: %v, %v", name, info.Mode(), err)
+		}
+		for dir := filepath.Dir(name); dir != backendDir; dir = filepath.Dir(dir) {
+			if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0770 {
+				t.Errorf("%s: %v, %v", dir, info.Mode(), err)
+			}
+		}
+	}
+	if info, _ := os.Stat(backendDir); info.Mode().Perm() == 0770 {
+		t.Errorf("the mode of the backend directory itself changed")
+	}
+}
+
+func TestSharedBackendSetgid(t *testing.T) {
+	useLockHome(t)
+	backendDir := t.TempDir()
+	if err := os.Chmod(backendDir, 0770|os.ModeSetgid); err != nil {
+		t.Skip(err)
+	}
+	BackendURL = "file://" + backendDir
+	lockName, _ := lockFile("s1", "dev")
+	if err := createStackMetaDir(lockName); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Dir(lockName))
+	if err != nil || info.Mode()&os.ModeSetgid == 0 || info.Mode().Perm() != 0770 {
+		t.Errorf("%s: %v, %v", filepath.Dir(lockName), info.Mode(), err)
+	}
+}
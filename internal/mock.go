@@ -0,0 +1,286 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// canned resource group the mocked network hands to the VM program
+const mockRGName = "mock-rg"
+
+// mockSubnetID is the canned ID of a subnet of the mocked network
+func mockSubnetID(subnetName string) string {
+	return "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/" + mockRGName +
+		"/providers/Microsoft.Network/virtualNetworks/server-network/subnets/" + subnetName
+}
+
+// the mocked stack's keypair, a real one would make the report differ on every run
+var mockKeyPair = &SSHKeyPair{
+	PublicKey:  "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQmock ephstack-mock",
+	PrivateKey: "mock-private-key",
+}
+
+// MockedResource is a resource the stack's programs would create, with its inputs
+type MockedResource struct {
+	Stack  string                 `json:"stack"`
+	App    string                 `json:"app"`
+	Type   string                 `json:"type"`
+	Name   string                 `json:"name"`
+	Inputs map[string]interface{} `json:"inputs"`
+}
+
+// stackMocks records the resources a program registers, and answers them with
+// canned IDs and IP addresses instead of calling the cloud provider
+type stackMocks struct {
+	mu         sync.Mutex
+	stackLabel string
+	appNames   []string
+	region     string            // the region of the stack, in the DNS names of the public IPs
+	subnets    map[string]string // the CIDR of every subnet, by mockSubnetID
+	resources  []MockedResource
+}
+
+func (mocks *stackMocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	mocks.mu.Lock()
+	defer mocks.mu.Unlock()
+
+	app := appOfResourceName(args.Name, mocks.appNames)
+	if app == "" {
+		app = stackGroup
+		if mocks.stackLabel == networkStackName(StackInstance.Env) {
+			app = "network"
+		}
+	}
+	inputs := make(map[string]interface{}, len(args.Inputs))
+	for key, value := range args.Inputs {
+		inputs[string(key)] = mockValue(value)
+	}
+	mocks.resources = append(mocks.resources, MockedResource{
+		Stack:  mocks.stackLabel,
+		App:    app,
+		Type:   args.TypeToken,
+		Name:   args.Name,
+		Inputs: inputs,
+	})
+
+	// pulumi auto-names resources after their logical name
+	state := args.Inputs.Copy()
+	if _, named := state["name"]; !named {
+		state["name"] = resource.NewStringProperty(args.Name)
+	}
+	switch args.TypeToken {
+	case "random:index/randomPassword:RandomPassword":
+		state["result"] = resource.MakeSecret(resource.NewStringProperty("mock-password"))
+	case "azure:network/networkInterface:NetworkInterface":
+		state["privateIpAddress"] = resource.NewStringProperty(mockSubnetAddress(mocks.subnets[nicSubnetID(args.Inputs)], args.Name))
+	case "azure:network/publicIp:PublicIp":
+		state["ipAddress"] = resource.NewStringProperty(mockIPAddress("203.0.113.", args.Name))
+		if label, ok := args.Inputs["domainNameLabel"]; ok && label.IsString() {
+			state["fqdn"] = resource.NewStringProperty(label.StringValue() + "." + mocks.region + ".cloudapp.azure.com")
+		}
+	}
+	return args.Name + "-id", state, nil
+}
+
+func (mocks *stackMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	if args.Token == "azure:network/getPublicIP:getPublicIP" {
+		name := args.Args["name"].StringValue()
+		return resource.PropertyMap{
+			"ipAddress": resource.NewStringProperty(mockIPAddress("203.0.113.", name)),
+		}, nil
+	}
+	return args.Args, nil
+}
+
+// mockIPAddress derives the host part of a canned IP address from the resource
+// name, so the same stack file always mocks the same addresses
+func mockIPAddress(prefix string, name string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return fmt.Sprintf("%s%d", prefix, hash.Sum32()%254+1)
+}
+
+// mockSubnetAddress derives a canned address in a subnet from the resource name, past
+// the first four addresses azure reserves, in 10.0.1.0/24 if the subnet is unknown
+func mockSubnetAddress(cidr string, name string) string {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil || subnet.IP.To4() == nil {
+		_, subnet, _ = net.ParseCIDR("10.0.1.0/24")
+	}
+	ones, bits := subnet.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	host := hash.Sum32() % size
+	if size > 5 {
+		// neither the reserved ones nor the broadcast address
+		host = hash.Sum32()%(size-5) + 4
+	}
+	address := binary.BigEndian.Uint32(subnet.IP.To4()) + host
+	return net.IPv4(byte(address>>24), byte(address>>16), byte(address>>8), byte(address)).String()
+}
+
+// nicSubnetID returns the subnet of the first IP configuration of a NIC's inputs
+func nicSubnetID(inputs resource.PropertyMap) string {
+	configs, ok := inputs["ipConfigurations"]
+	if !ok || !configs.IsArray() || len(configs.ArrayValue()) == 0 || !configs.ArrayValue()[0].IsObject() {
+		return ""
+	}
+	if subnetID, ok := configs.ArrayValue()[0].ObjectValue()["subnetId"]; ok && subnetID.IsString() {
+		return subnetID.StringValue()
+	}
+	return ""
+}
+
+// mockValue turns a resource input into plain data for the report, masking secrets
+func mockValue(value resource.PropertyValue) interface{} {
+	switch {
+	case value.IsSecret():
+		return secretMask
+	case value.IsComputed():
+		return "<unknown>"
+	case value.IsOutput():
+		output := value.OutputValue()
+		if !output.Known {
+			return "<unknown>"
+		}
+		if output.Secret {
+			return secretMask
+		}
+		return mockValue(output.Element)
+	case value.IsResourceReference():
+		return value.ResourceReferenceValue().URN
+	case value.IsArray():
+		var values []interface{}
+		for _, element := range value.ArrayValue() {
+			values = append(values, mockValue(element))
+		}
+		return values
+	case value.IsObject():
+		values := make(map[string]interface{})
+		for key, element := range value.ObjectValue() {
+			values[string(key)] = mockValue(element)
+		}
+		return values
+	}
+	return value.Mappable()
+}
+
+// MockDeploy runs the network and VM programs of the parsed stack against the
+// pulumi mocks, and returns the resources they would create, sorted per app.
+// It needs neither a backend nor cloud credentials.
+func MockDeploy() ([]MockedResource, error) {
+	op := "mock stack " + StackInstance.Id
+	provider, err := stackProvider()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := provider.(azureProvider); !ok {
+		return nil, NewError(ValidationError, op, errors.New("only stacks on azure run pulumi programs that can be mocked"))
+	}
+	appNames := sortedAppNames()
+	region, err := stackRegion()
+	if err != nil {
+		return nil, NewError(ValidationError, op, err)
+	}
+	// the DNS names have the programmatic name of the region, e.g. westus for West US
+	region = strings.ToLower(strings.ReplaceAll(region, " ", ""))
+
+	layout := StackNetwork()
+	subnetCIDRs := make(map[string]string, len(layout.Subnets))
+	for _, subnet := range layout.Subnets {
+		subnetCIDRs[mockSubnetID(subnet.Name)] = subnet.AddressPrefix
+	}
+	networkMocks := &stackMocks{stackLabel: networkStackName(StackInstance.Env), appNames: appNames, region: region, subnets: subnetCIDRs}
+	err = pulumi.RunErr(GetDeployNetworkFunc(layout), pulumi.WithMocks(StackInstance.Id, networkMocks.stackLabel, networkMocks))
+	if err != nil {
+		return nil, NewError(ProvisioningError, "mock network program", err)
+	}
+
+	vmMocks := &stackMocks{stackLabel: StackInstance.Env, appNames: appNames, region: region, subnets: subnetCIDRs}
+	subnetIDs := make(map[string]string, len(layout.Subnets))
+	for _, subnet := range layout.Subnets {
+		subnetIDs[subnet.Name] = mockSubnetID(subnet.Name)
+	}
+	err = pulumi.RunErr(GetDeployVMFunc(subnetIDs, mockRGName, mockKeyPair, environmentExpiry(nil)),
+		pulumi.WithMocks(StackInstance.Id, vmMocks.stackLabel, vmMocks))
+	if err != nil {
+		return nil, NewError(ProvisioningError, "mock vm program", err)
+	}
+
+	resources := append(networkMocks.resources, vmMocks.resources...)
+	sort.SliceStable(resources, func(i, j int) bool {
+		if resources[i].Stack != resources[j].Stack {
+			// the network is created first
+			return resources[i].Stack != StackInstance.Env
+		}
+		if resources[i].App != resources[j].App {
+			return resources[i].App < resources[j].App
+		}
+		return resources[i].Name < resources[j].Name
+	})
+	return resources, nil
+}
+
+// PrintMockReport prints the mocked resources grouped per app to out, as a single json
+// document with --log-format json
+func PrintMockReport(out io.Writer, resources []MockedResource) error {
+	if LogFormat == LogFormatJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(resources)
+	}
+
+	group := ""
+	for _, res := range resources {
+		if res.Stack+"/"+res.App != group {
+			group = res.Stack + "/" + res.App
+			fmt.Fprintln(out, group)
+		}
+		fmt.Fprintf(out, "  + %s %s\n", res.Type, res.Name)
+
+		keys := make([]string, 0, len(res.Inputs))
+		for key := range res.Inputs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var value strings.Builder
+			encoder := json.NewEncoder(&value)
+			encoder.SetEscapeHTML(false)
+			if err := encoder.Encode(res.Inputs[key]); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "      %s: %s\n", key, strings.TrimSpace(value.String()))
+		}
+	}
+	fmt.Fprintf(out, "%d resources would be created\n", len(resources))
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestMockSubnetAddress(t *testing.T) {
+	for _, cidr := range []string{"10.1.2.0/24", "172.16.0.0/28", "10.9.0.0/16", ""} {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			_, subnet, _ = net.ParseCIDR("10.0.1.0/24")
+		}
+		for _, name := range []string{"web1-0-nic", "app1-0-nic", "db1-3-nic"} {
+			address := net.ParseIP(mockSubnetAddress(cidr, name))
+			if address == nil || !subnet.Contains(address) {
+				t.Errorf("%s in %q is %v", name, cidr, address)
+				continue
+			}
+			if binary.BigEndian.Uint32(address.To4())-binary.BigEndian.Uint32(subnet.IP.To4()) < 4 {
+				t.Errorf("%s in %q is the reserved address %v", name, cidr, address)
+			}
+		}
+	}
+	if mockSubnetAddress("10.1.2.0/24", "web1-0-nic") != mockSubnetAddress("10.1.2.0/24", "web1-0-nic") {
+		t.Error("the mocked address changes between runs")
+	}
+}
+
+// the NICs get an address in their subnet, and the public IPs a DNS name in the stack's region
+func TestStackMocksAddresses(t *testing.T) {
+	mocks := &stackMocks{
+		stackLabel: "dev",
+		appNames:   []string{"web1"},
+		region:     "eastus2",
+		subnets:    map[string]string{mockSubnetID("web"): "10.1.1.0/24"},
+	}
+	_, state, err := mocks.NewResource(pulumi.MockResourceArgs{
+		TypeToken: "azure:network/networkInterface:NetworkInterface",
+		Name:      "web1-0-nic",
+		Inputs: resource.NewPropertyMapFromMap(map[string]interface{}{
+			"ipConfigurations": []interface{}{map[string]interface{}{"subnetId": mockSubnetID("web")}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := state["privateIpAddress"].StringValue(); !strings.HasPrefix(ip, "10.1.1.") {
+		t.Errorf("NIC address %s is not in 10.1.1.0/24", ip)
+	}
+
+	_, state, err = mocks.NewResource(pulumi.MockResourceArgs{
+		TypeToken: "azure:network/publicIp:PublicIp",
+		Name:      "web1-0-ip",
+		Inputs:    resource.NewPropertyMapFromMap(map[string]interface{}{"domainNameLabel": "tiered-web1"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fqdn := state["fqdn"].StringValue(); fqdn != "tiered-web1.eastus2.cloudapp.azure.com" {
+		t.Errorf("fqdn %s", fqdn)
+	}
+	if len(mocks.resources) != 2 || mocks.resources[0].App != "web1" {
+		t.Errorf("recorded %v", mocks.resources)
+	}
+}
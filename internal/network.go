@@ -0,0 +1,158 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"net"
+	"sort"
+)
+
+// the subnet apps are attached to when they don't choose one, if the layout has it
+const defaultSubnetName = "default"
+
+// DefaultNetwork is the layout used when neither the stack nor its cloud config
+// declare a network: a single 'default' subnet
+func DefaultNetwork() *NetworkType {
+	return &NetworkType{
+		ResourceGroup: "server-rg",
+		AddressSpaces: []string{"10.0.0.0/16"},
+		Subnets:       []SubnetType{{Name: defaultSubnetName, AddressPrefix: "10.0.1.0/24"}},
+	}
+}
+
+// NewNetwork builds a network layout, with its subnets sorted by name. The resource
+// group defaults to the one of DefaultNetwork.
+func NewNetwork(resourceGroup string, addressSpaces []string, subnets map[string]string) *NetworkType {
+	if resourceGroup == "" {
+		resourceGroup = DefaultNetwork().ResourceGroup
+	}
+	network := &NetworkType{ResourceGroup: resourceGroup, AddressSpaces: addressSpaces}
+	for name, prefix := range subnets {
+		network.Subnets = append(network.Subnets, SubnetType{Name: name, AddressPrefix: prefix})
+	}
+	sort.Slice(network.Subnets, func(i, j int) bool {
+		return network.Subnets[i].Name < network.Subnets[j].Name
+	})
+	return network
+}
+
+// StackNetwork returns the network layout of the parsed stack: its own, else the
+// one of the cloud config its apps run on, else the default one
+func StackNetwork() *NetworkType {
+	if StackInstance.Network != nil {
+		return StackInstance.Network
+	}
+	for _, appName := range sortedAppNames() {
+		cloudName, _ := lookupInfraCloud(StackInstance.AppInstances[appName].Infra)
+		if network, ok := CloudNetworks[cloudName]; ok {
+			return network
+		}
+	}
+	return DefaultNetwork()
+}
+
+// defaultSubnet is the 'default' subnet, or the first one
+func (network *NetworkType) defaultSubnet() string {
+	if len(network.Subnets) == 0 {
+		return ""
+	}
+	for _, subnet := range network.Subnets {
+		if subnet.Name == defaultSubnetName {
+			return subnet.Name
+		}
+	}
+	return network.Subnets[0].Name
+}
+
+// appSubnet returns the subnet an app is attached to
+func (network *NetworkType) appSubnet(appInst *AppInstanceType) string {
+	if appInst.Subnet != "" {
+		return appInst.Subnet
+	}
+	return network.defaultSubnet()
+}
+
+func (network *NetworkType) hasSubnet(name string) bool {
+	for _, subnet := range network.Subnets {
+		if subnet.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether two CIDRs share any address
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// contains reports whether the CIDR inner lies entirely within outer
+func contains(outer *net.IPNet, inner *net.IPNet) bool {
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return outer.Contains(inner.IP) && innerOnes >= outerOnes
+}
+
+// validate checks the CIDRs of the layout parse, the address spaces and the subnets
+// don't overlap, and every subnet lies within an address space
+func (network *NetworkType) validate() error {
+	if len(network.AddressSpaces) == 0 {
+		return errors.New("network has no address_space")
+	}
+	if len(network.Subnets) == 0 {
+		return errors.New("network has no subnets")
+	}
+
+	var spaces []*net.IPNet
+	for _, cidr := range network.AddressSpaces {
+		_, space, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("network address_space '" + cidr + "' is not a CIDR")
+		}
+		for i, other := range spaces {
+			if overlaps(space, other) {
+				return errors.New("network address_space '" + cidr + "' overlaps '" + network.AddressSpaces[i] + "'")
+			}
+		}
+		spaces = append(spaces, space)
+	}
+
+	var prefixes []*net.IPNet
+	for _, subnet := range network.Subnets {
+		_, prefix, err := net.ParseCIDR(subnet.AddressPrefix)
+		if err != nil {
+			return errors.New("subnet '" + subnet.Name + "' address '" + subnet.AddressPrefix + "' is not a CIDR")
+		}
+		contained := false
+		for _, space := range spaces {
+			if contains(space, prefix) {
+				contained = true
+			}
+		}
+		if !contained {
+			return errors.New("subnet '" + subnet.Name + "' " + subnet.AddressPrefix + " is outside the network address_space")
+		}
+		for i, other := range prefixes {
+			if overlaps(prefix, other) {
+				return errors.New("subnet '" + subnet.Name + "' " + subnet.AddressPrefix + " overlaps subnet '" +
+					network.Subnets[i].Name + "' " + network.Subnets[i].AddressPrefix)
+			}
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return nil
+}
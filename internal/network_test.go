@@ -0,0 +1,63 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNetworkValidate(t *testing.T) {
+	tests := []struct {
+		spaces  []string
+		subnets map[string]string
+		wantErr string
+	}{
+		{[]string{"10.0.0.0/16"}, map[string]string{"web": "10.0.1.0/24", "db": "10.0.2.0/24"}, ""},
+		{[]string{"10.0.0.0/16", "10.1.0.0/16"}, map[string]string{"web": "10.0.0.0/16", "db": "10.1.0.0/24"}, ""},
+		{[]string{"10.0.0.0/16", "10.0.128.0/17"}, map[string]string{"web": "10.0.1.0/24"}, "address_space '10.0.128.0/17' overlaps '10.0.0.0/16'"},
+		{[]string{"10.0.0.0/16"}, map[string]string{"a": "10.0.1.0/24", "b": "10.0.1.128/25"}, "subnet 'b' 10.0.1.128/25 overlaps subnet 'a' 10.0.1.0/24"},
+		{[]string{"10.0.0.0/16"}, map[string]string{"a": "10.0.0.0/8"}, "subnet 'a' 10.0.0.0/8 is outside the network address_space"},
+		{[]string{"10.0.0.0/16"}, map[string]string{"a": "10.1.0.0/24"}, "is outside the network address_space"},
+		{[]string{"10.0.0.0/33"}, map[string]string{"a": "10.0.0.0/24"}, "address_space '10.0.0.0/33' is not a CIDR"},
+		{[]string{"10.0.0.0/16"}, map[string]string{"a": "10.0.0.0"}, "subnet 'a' address '10.0.0.0' is not a CIDR"},
+		{nil, map[string]string{"a": "10.0.0.0/24"}, "network has no address_space"},
+		{[]string{"10.0.0.0/16"}, nil, "network has no subnets"},
+	}
+	for _, test := range tests {
+		err := NewNetwork("rg", test.spaces, test.subnets).validate()
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%v %v: %v", test.spaces, test.subnets, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%v %v: error %v, want %q", test.spaces, test.subnets, err, test.wantErr)
+		}
+	}
+}
+
+func TestAppSubnet(t *testing.T) {
+	network := NewNetwork("rg", []string{"10.0.0.0/16"}, map[string]string{"web": "10.0.1.0/24", "db": "10.0.2.0/24"})
+	if subnet := network.appSubnet(&AppInstanceType{}); subnet != "db" {
+		t.Errorf("without a default subnet the first one is used, got %q", subnet)
+	}
+	network = NewNetwork("rg", []string{"10.0.0.0/16"}, map[string]string{"web": "10.0.1.0/24", defaultSubnetName: "10.0.2.0/24"})
+	if subnet := network.appSubnet(&AppInstanceType{}); subnet != defaultSubnetName {
+		t.Errorf("got %q, want the default subnet", subnet)
+	}
+	if subnet := network.appSubnet(&AppInstanceType{Subnet: "web"}); subnet != "web" {
+		t.Errorf("got %q, want the app's subnet", subnet)
+	}
+}
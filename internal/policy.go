@@ -0,0 +1,212 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the levels of a policy: a warned violation is reported, an enforced one also blocks the deploy
+const (
+	PolicyWarn    = "warn"
+	PolicyEnforce = "enforce"
+)
+
+// the checks a policy can make, each with its list of values
+const (
+	allowedRegionsCheck = "allowed_regions" // the region of the infra must match one of the patterns
+	deniedSizesCheck    = "denied_sizes"    // the size of the infra must match none of the patterns, e.g. Standard_N* for the GPU sizes
+	allowedImagesCheck  = "allowed_images"  // the image of the infra must match one of the patterns
+	requiredTagsCheck   = "required_tags"   // the infra & app tags must include all of them
+)
+
+// PolicyType is a rule of the policy file, e.g.
+//
+//	policies:
+//	  - name: no-gpu
+//	    level: enforce
+//	    denied_sizes: [ Standard_N* ]
+type PolicyType struct {
+	Name   string
+	Level  string
+	Check  string
+	Values []string // patterns as in path.Match, matched case insensitively, or tag names
+}
+
+// PolicyViolationType is an app of the parsed stack breaking a policy
+type PolicyViolationType struct {
+	Policy  string
+	Level   string
+	App     string
+	Message string
+}
+
+// the policies of the policy file, none if there is no policy file
+var Policies []PolicyType
+
+// ParsePolicies reads the 'policies' list of the policy file
+func ParsePolicies(policies []interface{}, policyFileName string) ([]PolicyType, error) {
+	op := "parse policies of " + policyFileName
+	parsed := make([]PolicyType, 0, len(policies))
+	for i, value := range policies {
+		decl, ok := toSettings(value)
+		location := "policies[" + strconv.Itoa(i) + "]"
+		if !ok {
+			return nil, NewError(ParseError, op, errors.New(location+" must be a map"))
+		}
+		policy := PolicyType{Level: PolicyEnforce}
+		for key, value := range decl {
+			switch key {
+			case "name":
+				policy.Name = fmt.Sprintf("%v", value)
+			case "level":
+				policy.Level = strings.ToLower(fmt.Sprintf("%v", value))
+			case allowedRegionsCheck, deniedSizesCheck, allowedImagesCheck, requiredTagsCheck:
+				if policy.Check != "" {
+					return nil, NewError(ValidationError, op, errors.New(location+" makes both "+policy.Check+" and "+key+" checks, a policy makes one"))
+				}
+				policy.Check = key
+				values, _ := value.([]interface{})
+				for _, item := range values {
+					policy.Values = append(policy.Values, fmt.Sprintf("%v", item))
+				}
+			default:
+				return nil, NewError(ValidationError, op, errors.New(location+": unexpected policy value "+key))
+			}
+		}
+		if policy.Name == "" {
+			policy.Name = location
+		}
+		if policy.Check == "" {
+			return nil, NewError(ValidationError, op, errors.New("policy '"+policy.Name+"' makes no check"))
+		}
+		if policy.Level != PolicyWarn && policy.Level != PolicyEnforce {
+			return nil, NewError(ValidationError, op, errors.New("policy '"+policy.Name+"' level must be "+PolicyWarn+" or "+PolicyEnforce))
+		}
+		for _, pattern := range policy.Values {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, NewError(ValidationError, op, errors.New("policy '"+policy.Name+"' pattern '"+pattern+"': "+err.Error()))
+			}
+		}
+		parsed = append(parsed, policy)
+	}
+	return parsed, nil
+}
+
+// matchAny reports whether value matches one of the patterns, case insensitively
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(value)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate checks an app, with the infra it runs on, against the policy
+func (policy PolicyType) evaluate(appName string, appInst *AppInstanceType, infraHW *InfraHwType) []PolicyViolationType {
+	var messages []string
+	switch policy.Check {
+	case allowedRegionsCheck:
+		if !matchAny(policy.Values, infraHW.Region) {
+			messages = append(messages, "region '"+infraHW.Region+"' is not allowed")
+		}
+	case deniedSizesCheck:
+		if matchAny(policy.Values, infraHW.Type) {
+			messages = append(messages, "size '"+infraHW.Type+"' is denied")
+		}
+	case allowedImagesCheck:
+		if !matchAny(policy.Values, infraHW.Image) {
+			messages = append(messages, "image '"+infraHW.Image+"' is not allowed")
+		}
+	case requiredTagsCheck:
+		// the tags the app's resources get, as in GetDeployVMFunc
+		for _, tag := range policy.Values {
+			_, onInfra := infraHW.Tags[strings.ToLower(tag)]
+			_, onApp := appInst.Tags[strings.ToLower(tag)]
+			if !onInfra && !onApp {
+				messages = append(messages, "tag '"+tag+"' is missing")
+			}
+		}
+	}
+
+	violations := make([]PolicyViolationType, 0, len(messages))
+	for _, message := range messages {
+		violations = append(violations, PolicyViolationType{Policy: policy.Name, Level: policy.Level, App: appName, Message: message})
+	}
+	return violations
+}
+
+// EvaluatePolicies checks the apps of the parsed stack against the policies, with the
+// region & image they are deployed with when their infra sets none
+func EvaluatePolicies() []PolicyViolationType {
+	var violations []PolicyViolationType
+	// a stack with apps in several regions fails to validate
+	region, _ := stackRegion()
+	for _, appName := range sortedAppNames() {
+		appInst := StackInstance.AppInstances[appName]
+		cloudName, infraHW := lookupInfraCloud(appInst.Infra)
+		if infraHW == nil {
+			continue
+		}
+		deployed := *infraHW
+		if deployed.Region == "" {
+			deployed.Region = region
+		}
+		if deployed.Image == "" && cloudName == "azure" {
+			deployed.Image = defaultImage
+		}
+		for _, policy := range Policies {
+			violations = append(violations, policy.evaluate(appName, appInst, &deployed)...)
+		}
+	}
+	// the enforced violations last, next to the error they cause
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Level == PolicyWarn && violations[j].Level == PolicyEnforce
+	})
+	return violations
+}
+
+// PrintPolicyReport prints the violations, one per line
+func PrintPolicyReport(w io.Writer, violations []PolicyViolationType) {
+	for _, violation := range violations {
+		fmt.Fprintf(w, "%-7s %s: app '%s': %s\n", violation.Level, violation.Policy, violation.App, violation.Message)
+	}
+}
+
+// EnforcePolicies reports the violations of the policies by the parsed stack to w, and
+// fails if any of them is enforced
+func EnforcePolicies(w io.Writer) error {
+	violations := EvaluatePolicies()
+	PrintPolicyReport(w, violations)
+	enforced := 0
+	for _, violation := range violations {
+		if violation.Level == PolicyEnforce {
+			enforced++
+		}
+	}
+	if enforced > 0 {
+		return NewError(PolicyError, "enforce policies on stack "+StackInstance.Id,
+			errors.New(strconv.Itoa(enforced)+" enforced policy violation(s), see the report above"))
+	}
+	return nil
+}
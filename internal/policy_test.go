@@ -0,0 +1,106 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies([]interface{}{
+		map[string]interface{}{"name": "regions", "allowed_regions": []interface{}{"westus*"}},
+		map[string]interface{}{"level": "WARN", "required_tags": []interface{}{"owner"}},
+	}, "policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies[0].Level != PolicyEnforce || policies[0].Check != allowedRegionsCheck ||
+		policies[1].Name != "policies[1]" || policies[1].Level != PolicyWarn || policies[1].Values[0] != "owner" {
+		t.Errorf("policies %+v", policies)
+	}
+
+	tests := []struct {
+		policy  interface{}
+		wantErr string
+		exit    int
+	}{
+		{"no-gpu", "policies[0] must be a map", 2},
+		{map[string]interface{}{"name": "p"}, "policy 'p' makes no check", 3},
+		{map[string]interface{}{"denied_sizes": []interface{}{"a"}, "allowed_images": []interface{}{"b"}}, "makes both", 3},
+		{map[string]interface{}{"name": "p", "level": "block", "denied_sizes": []interface{}{"a"}}, "level must be warn or enforce", 3},
+		{map[string]interface{}{"name": "p", "denied_sizes": []interface{}{"Standard_[N"}}, "policy 'p' pattern 'Standard_[N'", 3},
+		{map[string]interface{}{"allowed_zones": []interface{}{"1"}}, "unexpected policy value allowed_zones", 3},
+	}
+	for _, test := range tests {
+		_, err := ParsePolicies([]interface{}{test.policy}, "policy.yaml")
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) || ExitCode(err) != test.exit {
+			t.Errorf("%v: error %v, want %q with exit code %d", test.policy, err, test.wantErr, test.exit)
+		}
+	}
+}
+
+func TestEvaluatePolicies(t *testing.T) {
+	InfraHWInstances = &InfraHWInstancesMapType{"azure": &InfraHWInstMapType{
+		"gpu":   {Name: "gpu", Type: "Standard_NC6", Region: "westus", Image: "Canonical:UbuntuServer:18.04-LTS:latest", Tags: map[string]string{"owner": "ops"}},
+		"plain": {Name: "plain", Type: "Standard_B1s"},
+	}}
+	StackInstance = &StackType{Id: "s1", AppInstances: map[string]*AppInstanceType{
+		"ml":  {Infra: "gpu", Tags: map[string]string{}},
+		"web": {Infra: "plain", Tags: map[string]string{"owner": "web-team"}},
+	}}
+	Policies = []PolicyType{
+		{Name: "regions", Level: PolicyEnforce, Check: allowedRegionsCheck, Values: []string{"eastus"}},
+		{Name: "no-gpu", Level: PolicyEnforce, Check: deniedSizesCheck, Values: []string{"standard_n*"}},
+		{Name: "images", Level: PolicyWarn, Check: allowedImagesCheck, Values: []string{"OpenLogic:*"}},
+		{Name: "tags", Level: PolicyWarn, Check: requiredTagsCheck, Values: []string{"Owner", "costcenter"}},
+	}
+	defer func() { InfraHWInstances, StackInstance, Policies = nil, nil, nil }()
+
+	// web has no region nor image, it is checked with the ones it is deployed with
+	want := []string{
+		"warn images ml image 'Canonical:UbuntuServer:18.04-LTS:latest' is not allowed",
+		"warn tags ml tag 'costcenter' is missing",
+		"warn images web image '" + defaultImage + "' is not allowed",
+		"warn tags web tag 'costcenter' is missing",
+		"enforce regions ml region 'westus' is not allowed",
+		"enforce no-gpu ml size 'Standard_NC6' is denied",
+		"enforce regions web region 'westus' is not allowed",
+	}
+	violations := EvaluatePolicies()
+	var got []string
+	for _, violation := range violations {
+		got = append(got, strings.Join([]string{violation.Level, violation.Policy, violation.App, violation.Message}, " "))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("violations:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	var report bytes.Buffer
+	err := EnforcePolicies(&report)
+	if ExitCode(err) != 8 || !strings.Contains(err.Error(), "3 enforced policy violation(s)") {
+		t.Errorf("enforcing gave %v", err)
+	}
+	if !strings.Contains(report.String(), "enforce no-gpu: app 'ml': size 'Standard_NC6' is denied\n") {
+		t.Errorf("report:\n%s", report.String())
+	}
+
+	Policies = Policies[2:]
+	if err := EnforcePolicies(&report); err != nil {
+		t.Errorf("warnings only gave %v", err)
+	}
+}
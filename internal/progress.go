@@ -0,0 +1,455 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"golang.org/x/term"
+)
+
+// the formats the deploy progress can be reported in
+const (
+	LogFormatPretty = "pretty" // a per-app progress view of the resources
+	LogFormatJSON   = "json"   // one structured event per line, for log aggregation
+	LogFormatRaw    = "raw"    // the pulumi CLI output
+)
+
+// global log format, set from the command line
+var LogFormat = LogFormatPretty
+
+// validLogFormat reports whether format is one of the supported log formats
+func validLogFormat(format string) bool {
+	return format == LogFormatPretty || format == LogFormatJSON || format == LogFormatRaw
+}
+
+// how long to wait for the last engine events once an update returned
+const eventDrainTimeout = 5 * time.Second
+
+// the group of the resources that don't belong to an app, e.g. the network
+const stackGroup = "stack"
+
+// pulumi colorizes diagnostics with tags like <{%reset%}>
+var colorTags = regexp.MustCompile(`<\{%[^%]*%\}>`)
+
+// ProgressEvent is one line of the json log format
+type ProgressEvent struct {
+	Time           string  `json:"time"`
+	Stack          string  `json:"stack"`
+	App            string  `json:"app,omitempty"`
+	Resource       string  `json:"resource,omitempty"`
+	Type           string  `json:"type,omitempty"`
+	Op             string  `json:"op,omitempty"`
+	Status         string  `json:"status"` // info, started, done, failed, planned, diagnostic or summary
+	ElapsedSeconds float64 `json:"elapsedSeconds,omitempty"`
+	Severity       string  `json:"severity,omitempty"`
+	Message        string  `json:"message,omitempty"`
+}
+
+type resourceProgress struct {
+	app     string
+	name    string
+	resType string
+	op      string
+	status  string // running, done, failed or planned
+	start   time.Time
+	end     time.Time
+	message string
+}
+
+func (res *resourceProgress) elapsed() time.Duration {
+	if res.end.IsZero() {
+		return time.Since(res.start).Round(time.Second)
+	}
+	return res.end.Sub(res.start).Round(time.Second)
+}
+
+// progressView renders the engine events of one pulumi stack update
+type progressView struct {
+	mu         sync.Mutex
+	out        io.Writer
+	stackLabel string
+	appNames   []string
+	preview    bool // the resources are planned, not changed
+	tty        bool
+	resources  map[string]*resourceProgress // by URN
+	order      []string
+	errors     []string // error diagnostics not tied to a resource
+	linesDrawn int
+}
+
+func newProgressView(stackLabel string, appNames []string) *progressView {
+	return &progressView{
+		out:        os.Stdout,
+		stackLabel: stackLabel,
+		appNames:   appNames,
+		tty:        term.IsTerminal(int(os.Stdout.Fd())),
+		resources:  make(map[string]*resourceProgress),
+	}
+}
+
+// runWithProgress runs an operation of a stack and reports its progress in the selected
+// log format. run passes the event channel it gets to pulumi, or the pulumi CLI output
+// to stdout when it gets none, in the raw log format.
+func runWithProgress(view *progressView, run func(eventCh chan<- events.EngineEvent) error) error {
+	if LogFormat == LogFormatRaw {
+		return run(nil)
+	}
+
+	eventCh := make(chan events.EngineEvent)
+	done := make(chan struct{})
+	go func() {
+		for event := range eventCh {
+			view.handleEvent(event)
+		}
+		close(done)
+	}()
+
+	err := run(eventCh)
+
+	// the event channel is only closed once pulumi started tailing its event log
+	select {
+	case <-done:
+	case <-time.After(eventDrainTimeout):
+	}
+	view.finish(err)
+	return err
+}
+
+// upWithProgress runs stack.Up and reports its progress in the selected log format.
+// appNames are used to group the resources per app.
+func upWithProgress(ctx context.Context, stack auto.Stack, stackLabel string, appNames []string) (auto.UpResult, error) {
+	var res auto.UpResult
+	err := runWithProgress(newProgressView(stackLabel, appNames), func(eventCh chan<- events.EngineEvent) (err error) {
+		if eventCh == nil {
+			res, err = stack.Up(ctx, optup.ProgressStreams(os.Stdout))
+		} else {
+			res, err = stack.Up(ctx, optup.EventStreams(eventCh))
+		}
+		return err
+	})
+	return res, err
+}
+
+// previewWithProgress runs stack.Preview and reports the planned changes like upWithProgress
+func previewWithProgress(ctx context.Context, stack auto.Stack, stackLabel string, appNames []string) (auto.PreviewResult, error) {
+	var res auto.PreviewResult
+	view := newProgressView(stackLabel, appNames)
+	view.preview = true
+	err := runWithProgress(view, func(eventCh chan<- events.EngineEvent) (err error) {
+		if eventCh == nil {
+			res, err = stack.Preview(ctx, optpreview.ProgressStreams(os.Stdout))
+		} else {
+			res, err = stack.Preview(ctx, optpreview.EventStreams(eventCh))
+		}
+		return err
+	})
+	return res, err
+}
+
+// destroyWithProgress runs stack.Destroy, of the targets if any, and reports its
+// progress like upWithProgress
+func destroyWithProgress(ctx context.Context, stack auto.Stack, stackLabel string, appNames []string, opts ...optdestroy.Option) error {
+	return runWithProgress(newProgressView(stackLabel, appNames), func(eventCh chan<- events.EngineEvent) (err error) {
+		if eventCh == nil {
+			_, err = stack.Destroy(ctx, append(opts, optdestroy.ProgressStreams(os.Stdout))...)
+		} else {
+			_, err = stack.Destroy(ctx, append(opts, optdestroy.EventStreams(eventCh))...)
+		}
+		return err
+	})
+}
+
+// resourceName returns the name, the last part, of a resource URN
+func resourceName(urn string) string {
+	parts := strings.Split(urn, "::")
+	return parts[len(parts)-1]
+}
+
+// appOfResourceName finds the app a resource belongs to, "" if none: the app's
+// component and all its children are named after the app
+func appOfResourceName(name string, appNames []string) string {
+	app := ""
+	for _, appName := range appNames {
+		if (name == appName || strings.HasPrefix(name, appName+"-")) && len(appName) > len(app) {
+			app = appName
+		}
+	}
+	return app
+}
+
+func (view *progressView) appOfResource(name string) string {
+	switch app := appOfResourceName(name, view.appNames); {
+	case app != "":
+		return app
+	case strings.HasPrefix(view.stackLabel, "networking"):
+		return "network"
+	}
+	return stackGroup
+}
+
+func (view *progressView) handleEvent(event events.EngineEvent) {
+	view.mu.Lock()
+	defer view.mu.Unlock()
+
+	switch {
+	case event.ResourcePreEvent != nil:
+		if event.ResourcePreEvent.Planning != view.preview {
+			return
+		}
+		meta := event.ResourcePreEvent.Metadata
+		// a preview only reports what would change
+		if skipResourceType(meta.Type) || view.preview && meta.Op == apitype.OpSame {
+			return
+		}
+		res := &resourceProgress{
+			app:     view.appOfResource(resourceName(meta.URN)),
+			name:    resourceName(meta.URN),
+			resType: meta.Type,
+			op:      string(meta.Op),
+			status:  "running",
+			start:   time.Now(),
+		}
+		if view.preview {
+			res.status, res.end = "planned", res.start
+		}
+		if _, seen := view.resources[meta.URN]; !seen {
+			view.order = append(view.order, meta.URN)
+		}
+		view.resources[meta.URN] = res
+		if view.preview {
+			view.emit(res, "planned", "")
+		} else {
+			view.emit(res, "started", "")
+		}
+	case event.ResOutputsEvent != nil && !view.preview:
+		if res := view.resources[event.ResOutputsEvent.Metadata.URN]; res != nil {
+			res.status = "done"
+			res.end = time.Now()
+			view.emit(res, "done", "")
+		}
+	case event.ResOpFailedEvent != nil:
+		if res := view.resources[event.ResOpFailedEvent.Metadata.URN]; res != nil {
+			res.status = "failed"
+			res.end = time.Now()
+			view.emit(res, "failed", res.message)
+		}
+	case event.DiagnosticEvent != nil:
+		view.handleDiagnostic(event.DiagnosticEvent)
+	case event.SummaryEvent != nil:
+		if LogFormat == LogFormatJSON {
+			view.writeJSON(ProgressEvent{
+				Status:         "summary",
+				ElapsedSeconds: float64(event.SummaryEvent.DurationSeconds),
+				Message:        summaryMessage(event.SummaryEvent.ResourceChanges),
+			})
+		}
+	}
+}
+
+func (view *progressView) handleDiagnostic(diag *apitype.DiagnosticEvent) {
+	message := strings.TrimSpace(colorTags.ReplaceAllString(diag.Message, ""))
+	if message == "" || diag.Ephemeral {
+		return
+	}
+	if LogFormat == LogFormatJSON {
+		event := ProgressEvent{Status: "diagnostic", Severity: diag.Severity, Message: message}
+		if res := view.resources[diag.URN]; res != nil {
+			event.App, event.Resource, event.Type = res.app, res.name, res.resType
+		}
+		view.writeJSON(event)
+	}
+	if diag.Severity != "error" {
+		return
+	}
+	if res := view.resources[diag.URN]; res != nil {
+		res.message = message
+	} else {
+		view.errors = append(view.errors, message)
+	}
+}
+
+// the stack itself and the providers are not worth reporting
+func skipResourceType(resType string) bool {
+	return resType == "pulumi:pulumi:Stack" || strings.HasPrefix(resType, "pulumi:providers:")
+}
+
+// emit reports a change of a resource: a line per event in json, a redraw of the
+// view on a terminal, or a line per finished resource otherwise
+func (view *progressView) emit(res *resourceProgress, status string, message string) {
+	switch {
+	case LogFormat == LogFormatJSON:
+		event := ProgressEvent{
+			App:      res.app,
+			Resource: res.name,
+			Type:     res.resType,
+			Op:       res.op,
+			Status:   status,
+			Message:  message,
+		}
+		if status != "started" && status != "planned" {
+			event.ElapsedSeconds = res.elapsed().Seconds()
+		}
+		view.writeJSON(event)
+	case view.tty:
+		view.redraw()
+	case status == "planned":
+		fmt.Fprintf(view.out, "[%s] %s %s\n", res.app, res.name, res.op)
+	case status != "started":
+		fmt.Fprintf(view.out, "[%s] %s %s %s (%s)\n", res.app, res.name, res.op, status, res.elapsed())
+	}
+}
+
+func (view *progressView) writeJSON(event ProgressEvent) {
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	event.Stack = view.stackLabel
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(view.out, string(line))
+}
+
+// redraw clears the previously drawn view and draws the resources grouped per app
+func (view *progressView) redraw() {
+	if view.linesDrawn > 0 {
+		fmt.Fprintf(view.out, "\033[%dA\033[J", view.linesDrawn)
+	}
+	lines := view.render()
+	for _, line := range lines {
+		fmt.Fprintln(view.out, line)
+	}
+	view.linesDrawn = len(lines)
+}
+
+func (view *progressView) render() []string {
+	groups := make(map[string][]*resourceProgress)
+	var groupNames []string
+	for _, urn := range view.order {
+		res := view.resources[urn]
+		if _, ok := groups[res.app]; !ok {
+			groupNames = append(groupNames, res.app)
+		}
+		groups[res.app] = append(groups[res.app], res)
+	}
+	sort.Strings(groupNames)
+
+	lines := []string{view.stackLabel}
+	for _, groupName := range groupNames {
+		lines = append(lines, "  "+groupName)
+		for _, res := range groups[groupName] {
+			line := fmt.Sprintf("    %s %-40s %-10s %-8s %s", statusMark(res.status), res.name, res.op, res.status, res.elapsed())
+			if res.status == "planned" {
+				line = fmt.Sprintf("    %s %-40s %s", statusMark(res.status), res.name, res.op)
+			}
+			if res.status == "failed" && res.message != "" {
+				line += ": " + res.message
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func statusMark(status string) string {
+	switch status {
+	case "done":
+		return "✓"
+	case "failed":
+		return "✗"
+	case "planned":
+		return "•"
+	}
+	return "…"
+}
+
+// finish prints the failures of the update, the view itself is already up to date
+func (view *progressView) finish(updateErr error) {
+	view.mu.Lock()
+	defer view.mu.Unlock()
+
+	if LogFormat == LogFormatJSON {
+		if updateErr != nil {
+			view.writeJSON(ProgressEvent{Status: "failed", Message: updateErr.Error()})
+		}
+		return
+	}
+	if view.tty {
+		view.redraw()
+	}
+
+	var failures []string
+	for _, urn := range view.order {
+		if res := view.resources[urn]; res.status == "failed" {
+			failures = append(failures, fmt.Sprintf("%s/%s: %s", res.app, res.name, res.message))
+		}
+	}
+	failures = append(failures, view.errors...)
+	if len(failures) == 0 {
+		return
+	}
+	fmt.Fprintf(view.out, "%s failed:\n", view.stackLabel)
+	for _, failure := range failures {
+		fmt.Fprintln(view.out, "  "+failure)
+	}
+}
+
+func summaryMessage(changes map[apitype.OpType]int) string {
+	var parts []string
+	for op, count := range changes {
+		parts = append(parts, fmt.Sprintf("%d %s", count, op))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// logStatus reports a step of ephstack itself in the selected log format
+func logStatus(stackLabel string, app string, message string) {
+	if LogFormat != LogFormatJSON {
+		fmt.Println(message)
+		return
+	}
+	line, err := json.Marshal(ProgressEvent{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Stack:   stackLabel,
+		App:     app,
+		Status:  "info",
+		Message: message,
+	})
+	if err != nil {
+		return
+	}
+	fmt.Println(string(line))
+}
+
+// errLogFormat is returned for an unsupported --log-format
+var errLogFormat = errors.New("log format must be one of " + LogFormatPretty + ", " + LogFormatJSON + " or " + LogFormatRaw)
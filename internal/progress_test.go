@@ -0,0 +1,170 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+const testURNPrefix = "urn:pulumi:dev::s1::"
+
+func stepMetadata(op apitype.OpType, resType string, name string) apitype.StepEventMetadata {
+	return apitype.StepEventMetadata{Op: op, URN: testURNPrefix + resType + "::" + name, Type: resType}
+}
+
+// the events of an update: the stack, a VM of web created, a NIC of db failing
+func updateEvents(planning bool) []events.EngineEvent {
+	vm := stepMetadata(apitype.OpCreate, "azure:compute/virtualMachine:VirtualMachine", "web-0")
+	nic := stepMetadata(apitype.OpCreate, "azure:network/networkInterface:NetworkInterface", "db-0-nic")
+	same := stepMetadata(apitype.OpSame, "azure:network/publicIp:PublicIp", "web-0-ip")
+	stack := stepMetadata(apitype.OpCreate, "pulumi:pulumi:Stack", "s1-dev")
+	return []events.EngineEvent{
+		{EngineEvent: apitype.EngineEvent{ResourcePreEvent: &apitype.ResourcePreEvent{Metadata: stack, Planning: planning}}},
+		{EngineEvent: apitype.EngineEvent{ResourcePreEvent: &apitype.ResourcePreEvent{Metadata: vm, Planning: planning}}},
+		{EngineEvent: apitype.EngineEvent{ResourcePreEvent: &apitype.ResourcePreEvent{Metadata: same, Planning: planning}}},
+		{EngineEvent: apitype.EngineEvent{ResourcePreEvent: &apitype.ResourcePreEvent{Metadata: nic, Planning: planning}}},
+		{EngineEvent: apitype.EngineEvent{ResOutputsEvent: &apitype.ResOutputsEvent{Metadata: vm, Planning: planning}}},
+		{EngineEvent: apitype.EngineEvent{DiagnosticEvent: &apitype.DiagnosticEvent{URN: nic.URN, Severity: "error", Message: "<{%reset%}>SubnetNotFound<{%reset%}>\n"}}},
+		{EngineEvent: apitype.EngineEvent{ResOpFailedEvent: &apitype.ResOpFailedEvent{Metadata: nic}}},
+		{EngineEvent: apitype.EngineEvent{SummaryEvent: &apitype.SummaryEvent{DurationSeconds: 42, ResourceChanges: map[apitype.OpType]int{apitype.OpCreate: 1}}}},
+	}
+}
+
+// testProgressView is a view of the apps web & db, writing to a buffer instead of a terminal
+func testProgressView(format string, preview bool) (*progressView, *bytes.Buffer) {
+	LogFormat = format
+	out := &bytes.Buffer{}
+	view := newProgressView("dev", []string{"db", "web"})
+	view.out, view.tty, view.preview = out, false, preview
+	return view, out
+}
+
+func TestProgressJSON(t *testing.T) {
+	defer func() { LogFormat = LogFormatPretty }()
+	view, out := testProgressView(LogFormatJSON, false)
+	for _, event := range updateEvents(false) {
+		view.handleEvent(event)
+	}
+	view.finish(errors.New("update failed"))
+
+	var got []ProgressEvent
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event ProgressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if event.Time == "" || event.Stack != "dev" {
+			t.Errorf("line %q has no time or stack", line)
+		}
+		event.Time, event.Stack, event.ElapsedSeconds = "", "", 0
+		got = append(got, event)
+	}
+	vmType, nicType := "azure:compute/virtualMachine:VirtualMachine", "azure:network/networkInterface:NetworkInterface"
+	want := []ProgressEvent{
+		{App: "web", Resource: "web-0", Type: vmType, Op: "create", Status: "started"},
+		{App: "web", Resource: "web-0-ip", Type: "azure:network/publicIp:PublicIp", Op: "same", Status: "started"},
+		{App: "db", Resource: "db-0-nic", Type: nicType, Op: "create", Status: "started"},
+		{App: "web", Resource: "web-0", Type: vmType, Op: "create", Status: "done"},
+		{App: "db", Resource: "db-0-nic", Type: nicType, Status: "diagnostic", Severity: "error", Message: "SubnetNotFound"},
+		{App: "db", Resource: "db-0-nic", Type: nicType, Op: "create", Status: "failed", Message: "SubnetNotFound"},
+		{Status: "summary", Message: "1 create"},
+		{Status: "failed", Message: "update failed"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestProgressPretty(t *testing.T) {
+	view, out := testProgressView(LogFormatPretty, false)
+	for _, event := range updateEvents(false) {
+		view.handleEvent(event)
+	}
+	view.finish(errors.New("update failed"))
+	want := `[web] web-0 create done (0s)
+[db] db-0-nic create failed (0s)
+dev failed:
+  db/db-0-nic: SubnetNotFound
+`
+	if out.String() != want {
+		t.Errorf("output\n%s\nwant\n%s", out, want)
+	}
+
+	// the resources grouped per app, the ones of no app under the stack
+	view.handleEvent(events.EngineEvent{EngineEvent: apitype.EngineEvent{ResourcePreEvent: &apitype.ResourcePreEvent{
+		Metadata: stepMetadata(apitype.OpCreate, "azure:core/resourceGroup:ResourceGroup", "rg")}}})
+	var got []string
+	for _, line := range view.render() {
+		got = append(got, strings.Join(strings.Fields(line), " "))
+	}
+	wantLines := []string{
+		"dev",
+		"  db", "✗ db-0-nic create failed 0s: SubnetNotFound",
+		"  stack", "… rg create running 0s",
+		"  web", "✓ web-0 create done 0s", "… web-0-ip same running 0s",
+	}
+	for i := range wantLines {
+		wantLines[i] = strings.Join(strings.Fields(wantLines[i]), " ")
+	}
+	if !reflect.DeepEqual(got, wantLines) {
+		t.Errorf("view\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(wantLines, "\n"))
+	}
+}
+
+// a preview reports the planned changes, not the unchanged resources, and its failures
+func TestProgressPreview(t *testing.T) {
+	defer func() { LogFormat = LogFormatPretty }()
+	view, out := testProgressView(LogFormatPretty, true)
+	planned := updateEvents(true)
+	for _, event := range planned {
+		view.handleEvent(event)
+	}
+	// the steps of an update don't show in a preview
+	view.handleEvent(updateEvents(false)[1])
+	view.finish(nil)
+	want := `[web] web-0 create
+[db] db-0-nic create
+[db] db-0-nic create failed (0s)
+dev failed:
+  db/db-0-nic: SubnetNotFound
+`
+	if out.String() != want {
+		t.Errorf("output\n%s\nwant\n%s", out, want)
+	}
+
+	view, out = testProgressView(LogFormatJSON, true)
+	for _, event := range planned {
+		view.handleEvent(event)
+	}
+	var statuses []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event ProgressEvent
+		json.Unmarshal([]byte(line), &event)
+		statuses = append(statuses, event.Resource+" "+event.Status)
+	}
+	wantStatuses := []string{"web-0 planned", "db-0-nic planned", "db-0-nic diagnostic", "db-0-nic failed", " summary"}
+	if !reflect.DeepEqual(statuses, wantStatuses) {
+		t.Errorf("events %v, want %v", statuses, wantStatuses)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Provider is the provisioning contract every cloud implements for the parsed stack.
+// Errors are returned as *Error values, whose Kind tells what went wrong.
+type Provider interface {
+	// Provision creates or updates the hosts of the apps, and fills in their credentials
+	Provision(ctx context.Context) error
+	// Preview reports what Provision would change, without changing anything
+	Preview(ctx context.Context) error
+	// Destroy tears down everything Provision created
+	Destroy(ctx context.Context) error
+	// Resources lists the resources of the environment, by pulumi stack or state; the
+	// ones that don't exist yet have no entry
+	Resources(ctx context.Context) (map[string][]string, error)
+	// Cleanup tears down the resources created since Resources returned before, whole
+	// stacks if they are not in it, and lists what it tore down
+	Cleanup(ctx context.Context, before map[string][]string) ([]string, error)
+}
+
+// the providers, by the 'config.cloud' of the config files
+var providers = map[string]Provider{
+	"azure": azureProvider{},
+	"local": localProvider{},
+}
+
+// lookupInfraCloud finds the infra settings an app refers to and the cloud they belong to.
+// infraName is either qualified by its cloud, e.g. azure/centos7_large, or a bare name
+// declared on a single cloud; an ambiguous bare name finds nothing.
+func lookupInfraCloud(infraName string) (string, *InfraHwType) {
+	if InfraHWInstances == nil {
+		return "", nil
+	}
+	// viper lower cases the keys of the config files
+	infraName = strings.ToLower(infraName)
+	if cloudName, entryName, qualified := strings.Cut(infraName, "/"); qualified {
+		if cloudInfraHW, ok := (*InfraHWInstances)[cloudName]; ok {
+			if infraHW, ok := (*cloudInfraHW)[entryName]; ok {
+				return cloudName, infraHW
+			}
+		}
+		return "", nil
+	}
+	clouds := infraClouds(infraName)
+	if len(clouds) != 1 {
+		return "", nil
+	}
+	return clouds[0], (*(*InfraHWInstances)[clouds[0]])[infraName]
+}
+
+// infraClouds returns the clouds that declare the bare infra entry name, sorted
+func infraClouds(infraName string) []string {
+	var clouds []string
+	if InfraHWInstances == nil {
+		return clouds
+	}
+	for cloudName, cloudInfraHW := range *InfraHWInstances {
+		if _, ok := (*cloudInfraHW)[infraName]; ok {
+			clouds = append(clouds, cloudName)
+		}
+	}
+	sort.Strings(clouds)
+	return clouds
+}
+
+// stackProvider returns the provider of the cloud all the apps of the parsed stack run on
+func stackProvider() (Provider, error) {
+	op := "select provider for stack " + StackInstance.Id
+	stackCloud := ""
+	for _, appName := range sortedAppNames() {
+		cloudName, _ := lookupInfraCloud(StackInstance.AppInstances[appName].Infra)
+		if stackCloud != "" && cloudName != stackCloud {
+			return nil, NewError(ValidationError, op, errors.New("apps run on both "+stackCloud+" and "+cloudName+", a stack must use a single cloud"))
+		}
+		stackCloud = cloudName
+	}
+
+	provider, ok := providers[stackCloud]
+	if !ok {
+		return nil, NewError(ValidationError, op, errors.New("cloud '"+stackCloud+"' is not supported"))
+	}
+	return provider, nil
+}
+
+// stackRegion returns the region the parsed stack is deployed in: the region of the infra
+// of its apps, which must agree as the network and the VMs of a stack share one
+func stackRegion() (string, error) {
+	region, regionApp := "", ""
+	for _, appName := range sortedAppNames() {
+		infraHW := LookupInfraHW(StackInstance.AppInstances[appName].Infra)
+		if infraHW == nil || infraHW.Region == "" {
+			continue
+		}
+		if region != "" && !strings.EqualFold(infraHW.Region, region) {
+			return "", errors.New("app '" + regionApp + "' runs in " + region + " and app '" + appName + "' in " + infraHW.Region + ", a stack must use a single region")
+		}
+		region, regionApp = strings.ToLower(infraHW.Region), appName
+	}
+	if region == "" {
+		return defaultRegion, nil
+	}
+	return region, nil
+}
+
+// ProvisionInfrastructure deploys the parsed stack on its cloud, holding its lock. A
+// successful deployment is recorded, so a later one that fails can roll back to it;
+// see OnFailure.
+func ProvisionInfrastructure() error {
+	if err := checkOnFailure(); err != nil {
+		return err
+	}
+	provider, err := stackProvider()
+	if err != nil {
+		return err
+	}
+	release, err := AcquireLock(StackInstance.Id, StackInstance.Env, "deploy")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	op := "deploy stack " + StackInstance.Id + "/" + StackInstance.Env
+	ctx := context.Background()
+	snapshot, err := newDeploymentRecord()
+	if err != nil {
+		return NewError(ValidationError, op, err)
+	}
+	var before map[string][]string
+	var previous *DeploymentRecordType
+	if OnFailure != OnFailureKeep {
+		if before, err = provider.Resources(ctx); err != nil {
+			return err
+		}
+		if previous, err = readLastDeployment(); err != nil {
+			return NewError(ParseError, op, err)
+		}
+	}
+
+	if err := provider.Provision(ctx); err != nil {
+		if OnFailure == OnFailureKeep {
+			return err
+		}
+		return recoverDeploy(ctx, provider, before, previous, err)
+	}
+	// the deploy succeeded all the same, only a later rollback can't return to it
+	if err := saveDeployment(snapshot); err != nil {
+		logStatus(StackInstance.Env, "", "warning: could not record the deployment to roll back to: "+err.Error())
+	}
+	return nil
+}
+
+// PreviewInfrastructure shows what deploying the parsed stack would change
+func PreviewInfrastructure() error {
+	provider, err := stackProvider()
+	if err != nil {
+		return err
+	}
+	return provider.Preview(context.Background())
+}
+
+// DestroyInfrastructure tears down the parsed stack's environment, holding its lock
+func DestroyInfrastructure() error {
+	provider, err := stackProvider()
+	if err != nil {
+		return err
+	}
+	release, err := AcquireLock(StackInstance.Id, StackInstance.Env, "destroy")
+	if err != nil {
+		return err
+	}
+	defer release()
+	return provider.Destroy(context.Background())
+}
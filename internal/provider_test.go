@@ -0,0 +1,58 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStackRegion(t *testing.T) {
+	InfraHWInstances = &InfraHWInstancesMapType{"azure": &InfraHWInstMapType{
+		"west":     {Name: "west", Region: "westus"},
+		"west2":    {Name: "west2", Region: "WestUS"},
+		"east":     {Name: "east", Region: "eastus"},
+		"noregion": {Name: "noregion"},
+	}}
+	defer func() { InfraHWInstances, StackInstance = nil, nil }()
+
+	tests := []struct {
+		infra   []string
+		want    string
+		wantErr string
+	}{
+		{[]string{"west", "west2", "noregion"}, "westus", ""},
+		{[]string{"east"}, "eastus", ""},
+		{[]string{"noregion"}, defaultRegion, ""},
+		{[]string{"west", "east"}, "", "app 'app0' runs in westus and app 'app1' in eastus"},
+	}
+	for _, test := range tests {
+		StackInstance = &StackType{Id: "s1", AppInstances: map[string]*AppInstanceType{}}
+		for i, infra := range test.infra {
+			StackInstance.AppInstances["app"+string(rune('0'+i))] = &AppInstanceType{Infra: infra}
+		}
+		region, err := stackRegion()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%v: error %v, want %q", test.infra, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || region != test.want {
+			t.Errorf("%v: region %q, %v, want %q", test.infra, region, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// the policies of a deploy that fails midway
+const (
+	OnFailureKeep     = "keep"     // leave what was built for inspection
+	OnFailureDestroy  = "destroy"  // tear down what the failed deploy created
+	OnFailureRollback = "rollback" // deploy the last successful deployment again
+)
+
+// what a failed deploy does with what it built so far
+var OnFailure = OnFailureKeep
+
+// DeploymentRecordType is the definition of a successful deployment of an environment,
+// enough to deploy it again without its stack and config files
+type DeploymentRecordType struct {
+	DeployedAt string                  `json:"deployedAt"`
+	Stack      *StackType              `json:"stack"`
+	Infra      InfraHWInstancesMapType `json:"infra"`
+	Networks   map[string]*NetworkType `json:"networks"`
+}
+
+// newDeploymentRecord snapshots the definition of the parsed stack, before Provision
+// fills in the credentials of its apps
+func newDeploymentRecord() ([]byte, error) {
+	record := &DeploymentRecordType{Stack: StackInstance, Networks: CloudNetworks}
+	if InfraHWInstances != nil {
+		record.Infra = *InfraHWInstances
+	}
+	return json.Marshal(record)
+}
+
+// deploymentFile returns the record of the last successful deployment of an environment
+// of a stack, see stackMetaFile
+func deploymentFile(stackName string, envName string) (string, error) {
+	return stackMetaFile("deployments", stackName, envName)
+}
+
+// readLastDeployment reads the last successful deployment of the parsed stack's
+// environment, nil if there is none
+func readLastDeployment() (*DeploymentRecordType, error) {
+	fileName, err := deploymentFile(StackInstance.Id, StackInstance.Env)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &DeploymentRecordType{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, errors.New("deployment record " + fileName + ": " + err.Error())
+	}
+	return record, nil
+}
+
+// saveDeployment records a snapshot of newDeploymentRecord as the last successful
+// deployment
+func saveDeployment(snapshot []byte) error {
+	record := &DeploymentRecordType{}
+	if err := json.Unmarshal(snapshot, record); err != nil {
+		return err
+	}
+	record.DeployedAt = time.Now().UTC().Format(time.RFC3339)
+	return writeDeployment(record)
+}
+
+// writeDeployment writes a deployment record, readable only by the user, or the users
+// of a shared file backend. The values of the secret facts are left out, see use.
+func writeDeployment(record *DeploymentRecordType) error {
+	if record.Stack == nil {
+		return errors.New("deployment record has no stack")
+	}
+	for _, appInst := range record.Stack.AppInstances {
+		for _, key := range appInst.SecretFacts {
+			delete(appInst.Facts, key)
+		}
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	fileName, err := deploymentFile(record.Stack.Id, record.Stack.Env)
+	if err != nil {
+		return err
+	}
+	if err := createStackMetaDir(fileName); err != nil {
+		return err
+	}
+	if err := os.WriteFile(fileName, data, stackMetaFileMode()); err != nil {
+		return err
+	}
+	os.Chmod(fileName, stackMetaFileMode())
+	return nil
+}
+
+// use makes the recorded deployment the parsed stack, the returned func restores the
+// parsed one. The secret facts take the values of the apps of the parsed stack.
+func (record *DeploymentRecordType) use() func() {
+	for appName, appInst := range record.Stack.AppInstances {
+		current, ok := StackInstance.AppInstances[appName]
+		if !ok {
+			continue
+		}
+		for _, key := range appInst.SecretFacts {
+			if value, ok := current.Facts[key]; ok {
+				if appInst.Facts == nil {
+					appInst.Facts = make(map[string]string)
+				}
+				appInst.Facts[key] = value
+			}
+		}
+	}
+	stack, infra, networks := StackInstance, InfraHWInstances, CloudNetworks
+	StackInstance, InfraHWInstances, CloudNetworks = record.Stack, &record.Infra, record.Networks
+	if CloudNetworks == nil {
+		CloudNetworks = make(map[string]*NetworkType)
+	}
+	return func() {
+		StackInstance, InfraHWInstances, CloudNetworks = stack, infra, networks
+	}
+}
+
+// checkOnFailure checks the --on-failure policy
+func checkOnFailure() error {
+	switch OnFailure {
+	case OnFailureKeep, OnFailureDestroy, OnFailureRollback:
+		return nil
+	}
+	return NewError(ValidationError, "deploy stack "+StackInstance.Id,
+		errors.New("--on-failure must be "+OnFailureKeep+", "+OnFailureDestroy+" or "+OnFailureRollback))
+}
+
+// recoverDeploy applies the --on-failure policy to a deploy that failed with deployErr:
+// it rolls the environment back to previous, or tears down what the deploy created
+// since before when there is nothing to roll back to. The returned error is deployErr,
+// of the same kind, reporting what was cleaned up.
+func recoverDeploy(ctx context.Context, provider Provider, before map[string][]string, previous *DeploymentRecordType, deployErr error) error {
+	env := StackInstance.Env
+	var report string
+	var err error
+	if OnFailure == OnFailureRollback && previous != nil {
+		logStatus(env, "", "deploy failed, rolling back to the deployment of "+previous.DeployedAt+"...")
+		restore := previous.use()
+		err = provider.Provision(ctx)
+		restore()
+		if err == nil {
+			report = "rolled back to the deployment of " + previous.DeployedAt
+		}
+	} else {
+		if OnFailure == OnFailureRollback {
+			logStatus(env, "", "deploy failed and there is no successful deployment to roll back to, destroying what it created...")
+		} else {
+			logStatus(env, "", "deploy failed, destroying what it created...")
+		}
+		var destroyed []string
+		destroyed, err = provider.Cleanup(ctx, before)
+		for _, item := range destroyed {
+			logStatus(env, "", "destroyed "+item)
+		}
+		if len(destroyed) > 0 {
+			report = "destroyed " + strings.Join(destroyed, "; ")
+		} else if err == nil {
+			report = "it created nothing to destroy"
+		}
+	}
+	if err != nil {
+		if report != "" {
+			report += "; "
+		}
+		report += fmt.Sprintf("the %s failed too, resources may be left behind, see 'ephstack destroy': %v", OnFailure, err)
+	}
+	var stackErr *Error
+	if errors.As(deployErr, &stackErr) {
+		return NewError(stackErr.Kind, stackErr.Op, fmt.Errorf("%w (%s)", stackErr.Err, report))
+	}
+	return fmt.Errorf("%w (%s)", deployErr, report)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useLocalStack parses a stack of one app with a secret fact on the local provider
+func useLocalStack(t *testing.T, token string) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(passphraseEnvVar, "pw")
+	stateCiphers = make(map[string]cipher.AEAD)
+	InfraHWInstances = &InfraHWInstancesMapType{"local": &InfraHWInstMapType{"local_small": {Name: "local_small", Type: "small", Region: "local", Image: "none"}}}
+	StackInstance = &StackType{Id: "s1", Env: "dev", AppInstances: map[string]*AppInstanceType{
+		"web": {Infra: "local_small", Count: 1, Facts: map[string]string{"role": "web", "token": token}, SecretFacts: []string{"token"}},
+	}}
+	t.Cleanup(func() { InfraHWInstances, StackInstance, OnFailure = nil, nil, OnFailureKeep })
+}
+
+func TestDeploymentRecordSecretFacts(t *testing.T) {
+	useLocalStack(t, "s3cr3t")
+	snapshot, err := newDeploymentRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveDeployment(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if token := StackInstance.AppInstances["web"].Facts["token"]; token != "s3cr3t" {
+		t.Errorf("recording the deployment changed the parsed stack: %q", token)
+	}
+	fileName, _ := deploymentFile("s1", "dev")
+	if data, _ := os.ReadFile(fileName); strings.Contains(string(data), "s3cr3t") {
+		t.Errorf("the record holds the secret fact:\n%s", data)
+	}
+
+	record, err := readLastDeployment()
+	if err != nil || record == nil {
+		t.Fatalf("record %v, %v", record, err)
+	}
+	if facts := record.Stack.AppInstances["web"].Facts; facts["role"] != "web" || facts["token"] != "" {
+		t.Errorf("recorded facts %v", facts)
+	}
+
+	// a rollback deploys the secret facts of the parsed stack
+	StackInstance.AppInstances["web"].Facts["token"] = "rotated"
+	parsed := StackInstance
+	restore := record.use()
+	if StackInstance == parsed || StackInstance.AppInstances["web"].Facts["token"] != "rotated" {
+		t.Errorf("the recorded deployment has the facts %v", StackInstance.AppInstances["web"].Facts)
+	}
+	restore()
+	if StackInstance != parsed {
+		t.Errorf("the parsed stack isn't restored")
+	}
+}
+
+// the deploy succeeded, failing to record it is only worth a warning
+func TestProvisionRecordFailure(t *testing.T) {
+	useLocalStack(t, "s3cr3t")
+	fileName, _ := deploymentFile("s1", "dev")
+	// a file where the records' directory goes
+	os.MkdirAll(filepath.Dir(filepath.Dir(fileName)), 0700)
+	if err := os.WriteFile(filepath.Dir(fileName), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProvisionInfrastructure(); err != nil {
+		t.Errorf("the deploy failed: %v", err)
+	}
+	if _, err := readLocalState("s1", "dev"); err != nil {
+		t.Errorf("nothing was deployed: %v", err)
+	}
+}
+
+// the error of a cleaned up deploy keeps its kind & cause
+func TestRecoverDeployError(t *testing.T) {
+	useLocalStack(t, "s3cr3t")
+	OnFailure = OnFailureDestroy
+	if err := (localProvider{}).Provision(nil); err != nil {
+		t.Fatal(err)
+	}
+	cause := errors.New("boom")
+	err := recoverDeploy(context.Background(), localProvider{}, map[string][]string{}, nil, NewError(QuotaError, "deploy", cause))
+	if !errors.Is(err, cause) || !IsKind(err, QuotaError) || !strings.Contains(err.Error(), "destroyed the local state of s1") {
+		t.Errorf("recoverDeploy returned %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const passphraseProvider = "passphrase"
+
+// the env var the pulumi CLI reads the passphrase from
+const passphraseEnvVar = "PULUMI_CONFIG_PASSPHRASE"
+
+// masked in place of secrets whenever ephstack prints them
+const secretMask = "[secret]"
+
+// SecretsSettingsType selects how secrets are encrypted in stack state
+type SecretsSettingsType struct {
+	// "passphrase" or a pulumi secrets provider URL, e.g. azurekeyvault://myvault.vault.azure.net/keys/mykey
+	Provider string
+	// optional file holding the passphrase, e.g. one only the CI user can read
+	PassphraseFile string
+	// optional OpenPGP private key file the passphrase is derived from, see gpgKeyFilePassphrase
+	GPGKeyFile string
+}
+
+// global secrets settings, set from the command line
+var SecretsSettings = &SecretsSettingsType{Provider: passphraseProvider}
+
+// secretsProviderOptions returns the workspace options that make a stack
+// encrypt its secrets with the configured secrets provider
+func secretsProviderOptions() ([]auto.LocalWorkspaceOption, error) {
+	opts := []auto.LocalWorkspaceOption{auto.SecretsProvider(SecretsSettings.Provider)}
+	if SecretsSettings.Provider != passphraseProvider {
+		return opts, nil
+	}
+
+	passphrase, err := resolvePassphrase()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, auto.EnvVars(map[string]string{passphraseEnvVar: passphrase}))
+	return opts, nil
+}
+
+// resolvePassphrase reads the passphrase from the passphrase file, derives it from the
+// gpg key file, reads it from the environment or, as a last resort, prompts for it on
+// the terminal
+func resolvePassphrase() (string, error) {
+	if SecretsSettings.PassphraseFile != "" && SecretsSettings.GPGKeyFile != "" {
+		return "", errors.New("pass either --passphrase-file or --gpg-key-file, not both")
+	}
+	if SecretsSettings.GPGKeyFile != "" {
+		return gpgKeyFilePassphrase(SecretsSettings.GPGKeyFile)
+	}
+	if SecretsSettings.PassphraseFile != "" {
+		data, err := os.ReadFile(SecretsSettings.PassphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read passphrase file %s: %w", SecretsSettings.PassphraseFile, err)
+		}
+		passphrase := strings.TrimSpace(string(data))
+		if passphrase == "" {
+			return "", errors.New("passphrase file " + SecretsSettings.PassphraseFile + " is empty")
+		}
+		return passphrase, nil
+	}
+
+	if passphrase, ok := os.LookupEnv(passphraseEnvVar); ok {
+		return passphrase, nil
+	}
+
+	if promptedPassphrase != "" {
+		return promptedPassphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("no passphrase for the stack secrets: set " + passphraseEnvVar + ", or pass --passphrase-file or --gpg-key-file")
+	}
+	fmt.Fprint(os.Stderr, "Enter passphrase for the stack secrets: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	promptedPassphrase = string(passphrase)
+	return promptedPassphrase, nil
+}
+
+// the passphrase prompted for, so it is asked once per run
+var promptedPassphrase string
+
+// passphraseCipher derives an AES-GCM cipher from a passphrase and a salt
+func passphraseCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// the ciphers of the state files ephstack keeps itself, by salt
+var stateCiphers = make(map[string]cipher.AEAD)
+
+// newSalt returns a random salt for stateCipher
+func newSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// stateCipher returns the cipher of the secrets in a state file ephstack keeps itself,
+// e.g. the local provider state. Only the passphrase secrets provider can encrypt them.
+func stateCipher(salt []byte) (cipher.AEAD, error) {
+	if aead, ok := stateCiphers[string(salt)]; ok {
+		return aead, nil
+	}
+	if SecretsSettings.Provider != passphraseProvider {
+		return nil, errors.New("the secrets of ephstack's own state files are encrypted with the '" + passphraseProvider + "' secrets provider, not " + SecretsSettings.Provider)
+	}
+	passphrase, err := resolvePassphrase()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	stateCiphers[string(salt)] = aead
+	return aead, nil
+}
+
+// sealSecret encrypts a secret for a state file, an empty one stays empty
+func sealSecret(aead cipher.AEAD, secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// openSecret decrypts a secret sealed by sealSecret
+func openSecret(aead cipher.AEAD, sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("corrupt secret")
+	}
+	secret, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("wrong passphrase for the secrets")
+	}
+	return string(secret), nil
+}
+
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return secretMask
+}
+
+// String keeps passwords and private keys out of any printed output
+func (creds Credentials) String() string {
+	return fmt.Sprintf("{Username:%s Password:%s Private_key:%s Public_key:%s}",
+		creds.Username, maskSecret(creds.Password), maskSecret(creds.Private_key), creds.Public_key)
+}
+
+// MaskedFacts returns the app's facts with the values of secret facts masked
+func (appInst AppInstanceType) MaskedFacts() map[string]string {
+	maskedFacts := make(map[string]string, len(appInst.Facts))
+	for key, value := range appInst.Facts {
+		if appInst.IsSecretFact(key) {
+			value = maskSecret(value)
+		}
+		maskedFacts[key] = value
+	}
+	return maskedFacts
+}
+
+// IsSecretFact reports whether the fact was listed under the app's 'secret_facts'
+func (appInst AppInstanceType) IsSecretFact(key string) bool {
+	for _, secretKey := range appInst.SecretFacts {
+		if secretKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (appInst AppInstanceType) String() string {
+	return fmt.Sprintf("{Infra:%s Creds:%v Config:%s Facts:%v PasswordAuth:%t}",
+		appInst.Infra, appInst.Creds, appInst.Config, appInst.MaskedFacts(), appInst.PasswordAuth)
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"golang.org/x/crypto/ssh"
+)
+
+// stack outputs that hold the stack's SSH keypair. The private key is
+// exported as a secret so it is only ever stored encrypted in stack state.
+const (
+	sshPublicKeyOutput  = "sshPublicKey"
+	sshPrivateKeyOutput = "sshPrivateKey"
+)
+
+// Azure only accepts RSA keys for Linux VMs
+const sshKeyBits = 4096
+
+// SSHKeyPair is an OpenSSH authorized_keys public key and its PEM encoded private key
+type SSHKeyPair struct {
+	PublicKey  string
+	PrivateKey string
+}
+
+// GenerateSSHKeyPair creates a new RSA keypair for logging into the stack's VMs
+func GenerateSSHKeyPair() (*SSHKeyPair, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, sshKeyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+
+	return &SSHKeyPair{
+		PublicKey:  string(ssh.MarshalAuthorizedKey(publicKey)),
+		PrivateKey: string(privatePEM),
+	}, nil
+}
+
+// outputsKeyPair returns the keypair recorded in the outputs of a previous deploy,
+// or generates a new one for a fresh stack. Reusing the keypair keeps redeploys
+// from replacing every VM.
+func outputsKeyPair(outs auto.OutputMap) (*SSHKeyPair, error) {
+	publicKey, pubOk := outs[sshPublicKeyOutput].Value.(string)
+	privateKey, privOk := outs[sshPrivateKeyOutput].Value.(string)
+	if pubOk && privOk && publicKey != "" && privateKey != "" {
+		return &SSHKeyPair{PublicKey: publicKey, PrivateKey: privateKey}, nil
+	}
+
+	return GenerateSSHKeyPair()
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestStackKeyPair(t *testing.T) {
+	keyPair, err := outputsKeyPair(auto.OutputMap{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyPair.PublicKey)); err != nil {
+		t.Errorf("the public key doesn't parse: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(keyPair.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ssh.MarshalAuthorizedKey(signer.PublicKey())) != keyPair.PublicKey {
+		t.Errorf("the keys don't make a pair")
+	}
+
+	// a redeploy reuses the keypair of the stack's outputs
+	outs := auto.OutputMap{
+		sshPublicKeyOutput:  {Value: keyPair.PublicKey},
+		sshPrivateKeyOutput: {Value: keyPair.PrivateKey, Secret: true},
+	}
+	again, err := outputsKeyPair(outs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *again != *keyPair {
+		t.Errorf("the second deploy generated another keypair")
+	}
+}
+
+func TestWriteStackPrivateKey(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	keyPair, err := GenerateSSHKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := WriteStackPrivateKey("s1", "dev", "old key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(keyFile, 0644)
+	if keyFile, err = WriteStackPrivateKey("s1", "dev", keyPair.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the private key file has mode %v, want 0600", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(keyFile); string(data) != keyPair.PrivateKey {
+		t.Errorf("the private key file holds %q", data)
+	}
+}
+
+// the local provider keeps the keypair of its state
+func TestLocalStackKeyPair(t *testing.T) {
+	useLocalStack(t, "s3cr3t")
+	if err := (localProvider{}).Provision(nil); err != nil {
+		t.Fatal(err)
+	}
+	first, err := readLocalState("s1", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (localProvider{}).Provision(nil); err != nil {
+		t.Fatal(err)
+	}
+	second, err := readLocalState("s1", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.SSHPublicKey != first.SSHPublicKey || second.SSHPrivateKey != first.SSHPrivateKey {
+		t.Errorf("the redeploy generated another keypair")
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(first.SSHPublicKey)); err != nil {
+		t.Errorf("the public key doesn't parse: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+const sshPort = "22"
+
+// OpenSSHSession opens an interactive shell on a host with the stack's credentials
+func OpenSSHSession(host string, creds Credentials) error {
+	var authMethods []ssh.AuthMethod
+	if creds.Private_key != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(creds.Private_key))
+		if err != nil {
+			return err
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+	if creds.Password != "" {
+		authMethods = append(authMethods, ssh.Password(creds.Password))
+	}
+	if len(authMethods) == 0 {
+		return errors.New("no credentials to log into " + host)
+	}
+
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, sshPort), &ssh.ClientConfig{
+		User: creds.Username,
+		Auth: authMethods,
+		// the VMs are ephemeral and re-created with new host keys, so there is nothing to pin
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	stdinFd := int(os.Stdin.Fd())
+	if term.IsTerminal(stdinFd) {
+		oldState, err := term.MakeRaw(stdinFd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(stdinFd, oldState)
+
+		width, height, err := term.GetSize(stdinFd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm"
+		}
+		if err := session.RequestPty(termType, height, width, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+			return err
+		}
+	}
+
+	if err := session.Shell(); err != nil {
+		return err
+	}
+	return session.Wait()
+}
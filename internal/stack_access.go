@@ -0,0 +1,157 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// projectOption sets up the pulumi project of an ephstack stack, using the state backend
+// of --backend or the config files, a local one by default, instead of the service
+func projectOption(projectName string) auto.LocalWorkspaceOption {
+	return auto.Project(workspace.Project{
+		Name:    tokens.PackageName(projectName),
+		Runtime: workspace.NewProjectRuntimeInfo("go", nil),
+		Backend: &workspace.ProjectBackend{
+			URL: stateBackend(),
+		},
+	})
+}
+
+// every environment of an ephstack stack is a pulumi stack named after it, with
+// its own networking stack. The one of the default environment keeps the name it had
+// before there were environments, so the networks already deployed are kept.
+func networkStackName(envName string) string {
+	if envName == DefaultEnvironment {
+		return "networking"
+	}
+	return "networking-" + envName
+}
+
+// selectAppStack selects the already deployed app stack of an environment
+func selectAppStack(ctx context.Context, projectName string, envName string) (auto.Stack, error) {
+	secretsOpts, err := secretsProviderOptions()
+	if err != nil {
+		return auto.Stack{}, err
+	}
+	return auto.SelectStackInlineSource(ctx, envName, projectName, nil,
+		append(secretsOpts, projectOption(projectName))...)
+}
+
+// StackOutputs returns the outputs, secrets included, of the selected environment of a deployed stack.
+// Stacks deployed on the local provider are read from its state file. A stack deployed
+// both ways is an error, rather than reading the outputs of the wrong one.
+func StackOutputs(stackName string) (auto.OutputMap, error) {
+	op := "read stack " + stackName + "/" + Environment
+	state, localErr := readLocalState(stackName, Environment)
+	if localErr != nil && !errors.Is(localErr, os.ErrNotExist) {
+		return nil, NewError(ParseError, op, localErr)
+	}
+
+	ctx := context.Background()
+	stack, err := selectAppStack(ctx, stackName, Environment)
+	if localErr == nil {
+		if err == nil {
+			return nil, NewError(ValidationError, op, errors.New("stack "+stackName+" is deployed in environment "+Environment+
+				" both on the local provider and in the state backend "+stateBackend()+", destroy the one not in use"))
+		}
+		return state.outputs(), nil
+	}
+	if err != nil {
+		return nil, stackAccessError(op, stackName, err)
+	}
+	outs, err := stack.Outputs(ctx)
+	if err != nil {
+		return nil, stackAccessError(op, stackName, err)
+	}
+	return outs, nil
+}
+
+// StackAppNames lists, sorted, the hosts of the apps that have outputs in a deployed stack
+func StackAppNames(outs auto.OutputMap) []string {
+	var appNames []string
+	for key, out := range outs {
+		if appOuts, ok := out.Value.(map[string]interface{}); ok {
+			if _, hasIP := appOuts["ip"]; hasIP {
+				appNames = append(appNames, key)
+			}
+		}
+	}
+	sort.Strings(appNames)
+	return appNames
+}
+
+// hostOutputs returns the outputs of a host of a deployed stack, named <app>-<index>,
+// or those of the first host of an app
+func hostOutputs(outs auto.OutputMap, name string) (map[string]interface{}, bool) {
+	if hostOuts, ok := outs[name].Value.(map[string]interface{}); ok {
+		return hostOuts, true
+	}
+	hostOuts, ok := outs[name+"-0"].Value.(map[string]interface{})
+	return hostOuts, ok
+}
+
+// AppIPAddress returns the IP address of a host, or of an app's first host, in a deployed
+// stack, its private one if the host has no public IP
+func AppIPAddress(outs auto.OutputMap, appName string) (string, error) {
+	op := "read app " + appName
+	appOuts, ok := hostOutputs(outs, appName)
+	if !ok {
+		return "", NewError(ValidationError, op, errors.New("app "+appName+" not found in the stack outputs"))
+	}
+	ip, _ := appOuts["ip"].(string)
+	if ip == "" {
+		return "", NewError(ValidationError, op, errors.New("app "+appName+" has no IP address"))
+	}
+	return ip, nil
+}
+
+// AppHostName returns the DNS name of a host, or of an app's first host, in a deployed stack if it has one, its IP address otherwise
+func AppHostName(outs auto.OutputMap, appName string) (string, error) {
+	if appOuts, ok := hostOutputs(outs, appName); ok {
+		if fqdn, _ := appOuts["fqdn"].(string); fqdn != "" {
+			return fqdn, nil
+		}
+	}
+	return AppIPAddress(outs, appName)
+}
+
+// WriteStackPrivateKey saves the private key of a stack's environment, readable only
+// by the user, under ~/.ephstack/keys so ssh can use it as an IdentityFile
+func WriteStackPrivateKey(stackName string, envName string, privateKey string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	keysDir := filepath.Join(homeDir, ".ephstack", "keys")
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		return "", err
+	}
+	keyFile := filepath.Join(keysDir, stackName+"_"+envName+"_id_rsa")
+	if err := os.WriteFile(keyFile, []byte(privateKey), 0600); err != nil {
+		return "", err
+	}
+	// ssh refuses a key file others can read, written before with another mode
+	return keyFile, os.Chmod(keyFile, 0600)
+}
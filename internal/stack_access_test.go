@@ -0,0 +1,52 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+func TestNetworkStackName(t *testing.T) {
+	tests := map[string]string{
+		DefaultEnvironment: "networking",
+		"qa":               "networking-qa",
+		"staging":          "networking-staging",
+	}
+	for envName, want := range tests {
+		if got := networkStackName(envName); got != want {
+			t.Errorf("networkStackName(%q) = %q, want %q", envName, got, want)
+		}
+	}
+}
+
+// an app name stands for its first host
+func TestAppIPAddress(t *testing.T) {
+	outs := auto.OutputMap{
+		"web-0": {Value: map[string]interface{}{"app": "web", "ip": "10.0.1.4"}},
+		"web-1": {Value: map[string]interface{}{"app": "web", "ip": "10.0.1.5"}},
+	}
+	tests := map[string]string{"web": "10.0.1.4", "web-0": "10.0.1.4", "web-1": "10.0.1.5"}
+	for name, want := range tests {
+		if ip, err := AppIPAddress(outs, name); err != nil || ip != want {
+			t.Errorf("AppIPAddress(%q) = %q, %v, want %q", name, ip, err, want)
+		}
+	}
+	if _, err := AppIPAddress(outs, "db"); !IsKind(err, ValidationError) {
+		t.Errorf("an app not in the stack gave %v", err)
+	}
+}
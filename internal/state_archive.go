@@ -0,0 +1,370 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"golang.org/x/term"
+)
+
+// the format of the state archives this version of ephstack writes and reads
+const StateArchiveFormat = "ephstack-state/1"
+
+// the env var the archive passphrase is read from, else it is prompted for
+const archivePassphraseEnvVar = "EPHSTACK_ARCHIVE_PASSPHRASE"
+
+// StateArchiveType is a portable archive of an environment of a stack. Its metadata is
+// readable, its state is encrypted with the archive passphrase as it holds the secrets
+// of the stack, e.g. the credentials of its apps, in the clear.
+type StateArchiveType struct {
+	Format     string   `json:"format"`
+	Stack      string   `json:"stack"`
+	Env        string   `json:"env"`
+	ExportedAt string   `json:"exportedAt"`
+	Backend    string   `json:"backend"`          // the state backend it was exported from
+	Provider   string   `json:"provider"`         // pulumi, or local for the local provider
+	Stacks     []string `json:"stacks,omitempty"` // the pulumi stacks in the archive
+	Salt       []byte   `json:"salt"`
+	Nonce      []byte   `json:"nonce"`
+	State      []byte   `json:"state"` // the gzipped archiveState, sealed with AES-GCM
+}
+
+// archiveState is the state of an environment, as exported from its backend
+type archiveState struct {
+	Deployments map[string]apitype.UntypedDeployment `json:"deployments,omitempty"` // the pulumi checkpoints, secrets in the clear, by pulumi stack
+	Config      map[string]auto.ConfigMap            `json:"config,omitempty"`      // the pulumi stack config, by pulumi stack
+	Local       *localState                          `json:"local,omitempty"`
+	Deployment  json.RawMessage                      `json:"deployment,omitempty"` // the last successful deployment, see saveDeployment
+}
+
+// ArchivePassphrase reads the passphrase of a state archive from the environment or,
+// as a last resort, prompts for it on the terminal; twice when confirm is set
+func ArchivePassphrase(confirm bool) (string, error) {
+	if passphrase, ok := os.LookupEnv(archivePassphraseEnvVar); ok && passphrase != "" {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("no passphrase for the state archive: set " + archivePassphraseEnvVar)
+	}
+	fmt.Fprint(os.Stderr, "Enter passphrase for the state archive: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) == 0 {
+		return "", errors.New("the state archive passphrase is empty")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(passphrase) {
+			return "", errors.New("the passphrases don't match")
+		}
+	}
+	return string(passphrase), nil
+}
+
+// additionalData binds the readable metadata to the sealed state, so it can't be edited
+func (archive *StateArchiveType) additionalData() []byte {
+	return []byte(archive.Format + "\x00" + archive.Stack + "\x00" + archive.Env)
+}
+
+// seal compresses & encrypts the state into the archive
+func (archive *StateArchiveType) seal(state *archiveState, passphrase string) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(state); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	archive.Salt = make([]byte, 16)
+	if _, err := rand.Read(archive.Salt); err != nil {
+		return err
+	}
+	aead, err := passphraseCipher(passphrase, archive.Salt)
+	if err != nil {
+		return err
+	}
+	archive.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(archive.Nonce); err != nil {
+		return err
+	}
+	archive.State = aead.Seal(nil, archive.Nonce, buf.Bytes(), archive.additionalData())
+	return nil
+}
+
+// open decrypts & decompresses the state of the archive
+func (archive *StateArchiveType) open(passphrase string) (*archiveState, error) {
+	aead, err := passphraseCipher(passphrase, archive.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(archive.Nonce) != aead.NonceSize() {
+		return nil, errors.New("corrupt state archive: bad nonce")
+	}
+	data, err := aead.Open(nil, archive.Nonce, archive.State, archive.additionalData())
+	if err != nil {
+		return nil, errors.New("wrong passphrase, or the state archive was modified")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("corrupt state archive: " + err.Error())
+	}
+	data, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, errors.New("corrupt state archive: " + err.Error())
+	}
+	state := &archiveState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.New("corrupt state archive: " + err.Error())
+	}
+	return state, nil
+}
+
+// ExportState archives an environment of a deployed stack: the local provider state, or
+// the pulumi checkpoints & config of its app and networking stacks in the state backend
+func ExportState(ctx context.Context, stackName string, envName string, passphrase string) (*StateArchiveType, error) {
+	op := "export state of stack " + stackName + "/" + envName
+	archive := &StateArchiveType{
+		Format:     StateArchiveFormat,
+		Stack:      stackName,
+		Env:        envName,
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Backend:    stateBackend(),
+	}
+	state := &archiveState{}
+
+	local, err := readLocalState(stackName, envName)
+	switch {
+	case err == nil:
+		archive.Provider = "local"
+		state.Local = local
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, NewError(ParseError, op, err)
+	default:
+		archive.Provider = "pulumi"
+		state.Deployments = make(map[string]apitype.UntypedDeployment)
+		state.Config = make(map[string]auto.ConfigMap)
+		secretsOpts, err := secretsProviderOptions()
+		if err != nil {
+			return nil, NewError(ValidationError, "setup secrets provider", err)
+		}
+		for _, pulumiStackName := range []string{envName, networkStackName(envName)} {
+			stack, err := auto.SelectStackInlineSource(ctx, pulumiStackName, stackName, nil,
+				append(secretsOpts, projectOption(stackName))...)
+			if err != nil {
+				if pulumiStackName == envName {
+					return nil, NewError(ValidationError, op, errors.New("stack "+stackName+" is not deployed in environment "+envName+": "+err.Error()))
+				}
+				// the stacks of some providers have no network of their own
+				continue
+			}
+			deployment, err := stack.Export(ctx)
+			if err != nil {
+				return nil, provisioningError("export stack "+stackName+"/"+pulumiStackName, err)
+			}
+			config, err := stack.GetAllConfig(ctx)
+			if err != nil {
+				return nil, provisioningError("read config of stack "+stackName+"/"+pulumiStackName, err)
+			}
+			state.Deployments[pulumiStackName] = deployment
+			state.Config[pulumiStackName] = config
+			archive.Stacks = append(archive.Stacks, pulumiStackName)
+		}
+	}
+
+	recordFile, err := deploymentFile(stackName, envName)
+	if err != nil {
+		return nil, NewError(ParseError, op, err)
+	}
+	if record, err := os.ReadFile(recordFile); err == nil {
+		state.Deployment = record
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, NewError(ParseError, op, err)
+	}
+
+	if err := archive.seal(state, passphrase); err != nil {
+		return nil, NewError(ValidationError, op, err)
+	}
+	return archive, nil
+}
+
+// WriteStateArchive saves an archive readable only by the user
+func WriteStateArchive(archive *StateArchiveType, fileName string) error {
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0600)
+}
+
+// ReadStateArchive reads an archive written by WriteStateArchive
+func ReadStateArchive(fileName string) (*StateArchiveType, error) {
+	op := "read state archive " + fileName
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, NewError(ParseError, op, err)
+	}
+	archive := &StateArchiveType{}
+	if err := json.Unmarshal(data, archive); err != nil {
+		return nil, NewError(ParseError, op, err)
+	}
+	if archive.Format != StateArchiveFormat {
+		return nil, NewError(ParseError, op, errors.New("format '"+archive.Format+"' is not "+StateArchiveFormat))
+	}
+	if archive.Stack == "" || archive.Env == "" {
+		return nil, NewError(ParseError, op, errors.New("no stack or environment"))
+	}
+	return archive, nil
+}
+
+// countResources returns the number of resources of a pulumi checkpoint
+func countResources(deployment apitype.UntypedDeployment) int {
+	var checkpoint struct {
+		Resources []json.RawMessage `json:"resources"`
+	}
+	json.Unmarshal(deployment.Deployment, &checkpoint)
+	return len(checkpoint.Resources)
+}
+
+// withoutSecretsProvider drops the secrets provider of an exported checkpoint, its
+// secrets are in the clear, so they get encrypted by the one of the stack importing it
+func withoutSecretsProvider(deployment apitype.UntypedDeployment) (apitype.UntypedDeployment, error) {
+	var checkpoint map[string]json.RawMessage
+	if err := json.Unmarshal(deployment.Deployment, &checkpoint); err != nil {
+		return deployment, err
+	}
+	delete(checkpoint, "secrets_providers")
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return deployment, err
+	}
+	return apitype.UntypedDeployment{Version: deployment.Version, Deployment: data}, nil
+}
+
+// ImportState restores an archive into the state backend, re-encrypting the secrets with
+// the secrets provider set on the command line. An environment that is already deployed
+// there is only overwritten if forced. It returns what was restored.
+func ImportState(ctx context.Context, archive *StateArchiveType, passphrase string, force bool) ([]string, error) {
+	op := "import state of stack " + archive.Stack + "/" + archive.Env
+	state, err := archive.open(passphrase)
+	if err != nil {
+		return nil, NewError(ValidationError, op, err)
+	}
+	release, err := AcquireLock(archive.Stack, archive.Env, "import")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// nothing is written before every check passed
+	var record *DeploymentRecordType
+	if len(state.Deployment) > 0 {
+		record = &DeploymentRecordType{}
+		if err := json.Unmarshal(state.Deployment, record); err != nil {
+			return nil, NewError(ParseError, op, errors.New("deployment record: "+err.Error()))
+		}
+	}
+	if state.Local != nil {
+		if _, err := readLocalState(archive.Stack, archive.Env); err == nil && !force {
+			return nil, NewError(ValidationError, op, errors.New("the local provider already has state for it, use --force to replace it"))
+		}
+	}
+	// the networking stack first, the app stack depends on it
+	var pulumiStackNames []string
+	for _, name := range []string{networkStackName(archive.Env), archive.Env} {
+		if _, ok := state.Deployments[name]; ok {
+			pulumiStackNames = append(pulumiStackNames, name)
+		}
+	}
+	var secretsOpts []auto.LocalWorkspaceOption
+	if len(pulumiStackNames) > 0 {
+		if secretsOpts, err = secretsProviderOptions(); err != nil {
+			return nil, NewError(ValidationError, "setup secrets provider", err)
+		}
+	}
+	stacks := make(map[string]auto.Stack, len(pulumiStackNames))
+	for _, pulumiStackName := range pulumiStackNames {
+		stack, err := auto.UpsertStackInlineSource(ctx, pulumiStackName, archive.Stack, nil,
+			append(secretsOpts, projectOption(archive.Stack))...)
+		if err != nil {
+			return nil, provisioningError("create stack "+archive.Stack+"/"+pulumiStackName, err)
+		}
+		if !force {
+			current, err := stack.Export(ctx)
+			if err != nil {
+				return nil, provisioningError("export stack "+archive.Stack+"/"+pulumiStackName, err)
+			}
+			if n := countResources(current); n > 0 {
+				return nil, NewError(ValidationError, op, fmt.Errorf("stack %s/%s already has %d resources in %s, use --force to replace its state", archive.Stack, pulumiStackName, n, stateBackend()))
+			}
+		}
+		stacks[pulumiStackName] = stack
+	}
+
+	var restored []string
+	if state.Local != nil {
+		if err := state.Local.write(); err != nil {
+			return nil, NewError(ProvisioningError, op, err)
+		}
+		stateFile, _ := localStateFile(archive.Stack, archive.Env)
+		restored = append(restored, "local state "+stateFile)
+	}
+	for _, pulumiStackName := range pulumiStackNames {
+		stack := stacks[pulumiStackName]
+		deployment, err := withoutSecretsProvider(state.Deployments[pulumiStackName])
+		if err != nil {
+			return nil, NewError(ParseError, op, errors.New("checkpoint of "+pulumiStackName+": "+err.Error()))
+		}
+		if err := stack.Import(ctx, deployment); err != nil {
+			return nil, provisioningError("import stack "+archive.Stack+"/"+pulumiStackName, err)
+		}
+		if config := state.Config[pulumiStackName]; len(config) > 0 {
+			if err := stack.SetAllConfig(ctx, config); err != nil {
+				return nil, provisioningError("set config of stack "+archive.Stack+"/"+pulumiStackName, err)
+			}
+		}
+		restored = append(restored, fmt.Sprintf("pulumi stack %s/%s, %d resources", archive.Stack, pulumiStackName, countResources(deployment)))
+	}
+	// last, so the record is of a deployment the backend has
+	if record != nil {
+		if err := writeDeployment(record); err != nil {
+			return nil, NewError(ProvisioningError, op, err)
+		}
+		restored = append(restored, "the record of the last successful deployment, to roll back to")
+	}
+	return restored, nil
+}
@@ -0,0 +1,216 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+func TestStateArchiveSeal(t *testing.T) {
+	state := &archiveState{
+		Deployments: map[string]apitype.UntypedDeployment{"dev": {Version: 3, Deployment: json.RawMessage(`{"resources":[{"urn":"a"}]}`)}},
+		Config:      map[string]auto.ConfigMap{"dev": {"azure:location": {Value: "westus"}}},
+		Deployment:  json.RawMessage(`{"deployedAt":"2022-11-01T00:00:00Z"}`),
+	}
+	sealed := func() *StateArchiveType {
+		archive := &StateArchiveType{Format: StateArchiveFormat, Stack: "s1", Env: "dev"}
+		if err := archive.seal(state, "archive-pw"); err != nil {
+			t.Fatal(err)
+		}
+		return archive
+	}
+
+	opened, err := sealed().open("archive-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opened, state) {
+		t.Errorf("opened %+v, want %+v", opened, state)
+	}
+	if archive := sealed(); strings.Contains(string(archive.State), "westus") {
+		t.Errorf("the sealed state is in the clear")
+	}
+
+	tests := map[string]func(archive *StateArchiveType){
+		"wrong passphrase": func(archive *StateArchiveType) {},
+		"tampered state":   func(archive *StateArchiveType) { archive.State[len(archive.State)/2] ^= 1 },
+		"tampered stack":   func(archive *StateArchiveType) { archive.Stack = "s2" },
+		"tampered env":     func(archive *StateArchiveType) { archive.Env = "prod" },
+	}
+	for name, tamper := range tests {
+		archive := sealed()
+		tamper(archive)
+		passphrase := "archive-pw"
+		if name == "wrong passphrase" {
+			passphrase = "guess"
+		}
+		if _, err := archive.open(passphrase); err == nil || err.Error() != "wrong passphrase, or the state archive was modified" {
+			t.Errorf("%s: opened with %v", name, err)
+		}
+	}
+	archive := sealed()
+	archive.Nonce = archive.Nonce[1:]
+	if _, err := archive.open("archive-pw"); err == nil || !strings.Contains(err.Error(), "bad nonce") {
+		t.Errorf("a short nonce gave %v", err)
+	}
+}
+
+func TestWithoutSecretsProvider(t *testing.T) {
+	deployment := apitype.UntypedDeployment{Version: 3, Deployment: json.RawMessage(
+		`{"manifest":{"time":"2022-11-01T00:00:00Z"},"secrets_providers":{"type":"passphrase","state":{"salt":"v1:abc"}},"resources":[{"urn":"a"},{"urn":"b"}]}`)}
+	stripped, err := withoutSecretsProvider(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkpoint map[string]json.RawMessage
+	if err := json.Unmarshal(stripped.Deployment, &checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checkpoint["secrets_providers"]; ok || checkpoint["manifest"] == nil {
+		t.Errorf("stripped checkpoint %s", stripped.Deployment)
+	}
+	if stripped.Version != 3 || countResources(stripped) != 2 {
+		t.Errorf("stripped checkpoint of version %d with %d resources", stripped.Version, countResources(stripped))
+	}
+	if _, err := withoutSecretsProvider(apitype.UntypedDeployment{Deployment: json.RawMessage(`[]`)}); err == nil {
+		t.Errorf("a checkpoint that isn't an object was accepted")
+	}
+}
+
+// an environment on the local provider moves to another machine, with another passphrase
+func TestExportImportLocalState(t *testing.T) {
+	useLocalStack(t, "s3cr3t")
+	if err := (localProvider{}).Provision(nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := newDeploymentRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveDeployment(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readLastDeployment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := readLocalState("s1", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ExportState(nil, "s1", "dev", "archive-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.Provider != "local" || archive.Stack != "s1" || archive.Env != "dev" || len(archive.Stacks) != 0 {
+		t.Errorf("archive %+v", archive)
+	}
+	fileName := filepath.Join(t.TempDir(), "s1-dev.ephstate")
+	if err := WriteStateArchive(archive, fileName); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(fileName); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the archive file is %v, %v", info, err)
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(passphraseEnvVar, "other-pw")
+	stateCiphers = make(map[string]cipher.AEAD)
+	read, err := ReadStateArchive(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportState(nil, read, "guess", false); !IsKind(err, ValidationError) {
+		t.Errorf("importing with the wrong passphrase gave %v", err)
+	}
+	restored, err := ImportState(nil, read, "archive-pw", false)
+	if err != nil || len(restored) != 2 {
+		t.Fatalf("restored %v, %v", restored, err)
+	}
+	imported, err := readLocalState("s1", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.SSHPrivateKey != exported.SSHPrivateKey || !reflect.DeepEqual(imported.Hosts, exported.Hosts) {
+		t.Errorf("imported %+v, exported %+v", imported, exported)
+	}
+	if record, err := readLastDeployment(); err != nil || record == nil || record.DeployedAt != saved.DeployedAt {
+		t.Errorf("imported the deployment record %v, %v", record, err)
+	}
+}
+
+func TestReadStateArchive(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"not json":       `ephstate`,
+		"other format":   `{"format":"ephstack-state/2","stack":"s1","env":"dev"}`,
+		"no environment": `{"format":"ephstack-state/1","stack":"s1"}`,
+	}
+	for name, content := range tests {
+		fileName := filepath.Join(dir, name)
+		os.WriteFile(fileName, []byte(content), 0600)
+		if _, err := ReadStateArchive(fileName); !IsKind(err, ParseError) {
+			t.Errorf("%s: read with %v", name, err)
+		}
+	}
+}
+
+// an import refused as the environment is deployed already writes nothing
+func TestImportStateChecksFirst(t *testing.T) {
+	useLocalStack(t, "s3cr3t")
+	if err := (localProvider{}).Provision(nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := newDeploymentRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := readLocalState("s1", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := &StateArchiveType{Format: StateArchiveFormat, Stack: "s1", Env: "dev", Provider: "local"}
+	if err := archive.seal(&archiveState{Local: local, Deployment: snapshot}, "archive-pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ImportState(nil, archive, "archive-pw", false); err == nil || !strings.Contains(err.Error(), "use --force") {
+		t.Fatalf("importing over a deployed environment gave %v", err)
+	}
+	fileName, _ := deploymentFile("s1", "dev")
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("the refused import wrote the deployment record: %v", err)
+	}
+
+	restored, err := ImportState(nil, archive, "archive-pw", true)
+	if err != nil || len(restored) != 2 {
+		t.Fatalf("restored %v, %v", restored, err)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil || strings.Contains(string(data), "s3cr3t") {
+		t.Errorf("the imported record is %s, %v", data, err)
+	}
+}
@@ -16,10 +16,13 @@ limitations under the License.
 
 package ephstack
 
+import "time"
+
 type Credentials struct {
 	Username    string
 	Password    string 
 	Private_key string 
+	Public_key  string
 }
 
 type AppInstanceType struct {
@@ -27,26 +30,77 @@ type AppInstanceType struct {
     Creds   	Credentials
 	Config      string 
 	Facts 		map[string]string
+	SecretFacts  []string // facts encrypted in stack state and masked in output
+	PasswordAuth bool // password logins are disabled unless the app opts in
+	Subnet       string // the network subnet the app's VM is attached to, the default subnet if empty
+	Ports        []PortRuleType // inbound traffic allowed to the app, unrestricted if nil
+	PublicIP     string // none, dynamic or static, dynamic if empty
+	DNSLabel     string // the public IP's DNS label, the app gets <label>.<region>.cloudapp.azure.com
+	Count        int    // number of hosts, named <app>-0..<app>-<count-1>; 1 unless set
+	UserData     string // path of the cloud-init or script template run on first boot, see UserDataValues
+	Tags         map[string]string // tags of the app's resources, on top of the ones of its infra
+	Size         string // a portable size of the catalog of the config files, instead of infra
+	SizeRequirement *SizeRequirementType // the smallest size of the catalog meeting it, instead of infra
+	Image        string // a portable image of the catalog of the config files, e.g. ubuntu22
+	Cloud        string // the cloud the size & image resolve on, needed if several have them
+}
+
+type SizeRequirementType struct {
+	CPUs     int     `json:"cpus,omitempty"`
+	MemoryGB float64 `json:"memoryGb,omitempty"`
+}
+
+type PortRuleType struct {
+	Port     string   `json:"port"`               // a port, a range like 8000-8080, or * for all
+	Protocol string   `json:"protocol,omitempty"` // tcp, udp, icmp or *, tcp if empty
+	From     []string `json:"from"`               // source CIDRs, * for anywhere, or names of apps of the stack
 }
 
 type StackType struct {
 	Id           string              // must be unique per live session
+	Env          string              // each environment is deployed as its own pulumi stack
+	TTL          time.Duration       // how long the environment is meant to live, 0 if unlimited
 	AppInstances map[string]*AppInstanceType  
+	Network      *NetworkType        // the network layout, nil to use the one of the cloud config
+	Budget       float64             // the most the environment may cost a month, 0 if unlimited; see EstimateCost
+}
+
+type SubnetType struct {
+	Name          string `json:"name"`
+	AddressPrefix string `json:"addressPrefix"` // CIDR, must be within an address space of the network
+}
+
+type NetworkType struct {
+	ResourceGroup string       `json:"resourceGroup"`
+	AddressSpaces []string     `json:"addressSpaces"` // CIDRs of the virtual network
+	Subnets       []SubnetType `json:"subnets"`       // sorted by name
 }
 
 type InfraHwType struct {
-	Name        string 
-	Region      string 
-	Type        string 
-	Image       string 
-	Disks       []string 
-	Tags        map[string]string  
+	Name        string            `json:"name"`
+	Region      string            `json:"region"`
+	Type        string            `json:"type"`
+	Image       string            `json:"image"`
+	Disks       []string          `json:"disks"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Sources     map[string]string `json:"sources"` // the config file & entry each value came from, by key
 }
 // a map for just storing One cloud infra settings, say just azure
 type InfraHWInstMapType       map[string]*InfraHwType
 // a map to store all the cloud infra settings 
 type InfraHWInstancesMapType  map[string]*InfraHWInstMapType
 
+// the environment deployed when no --env is given
+const DefaultEnvironment = "dev"
+
 // global data structures
 var StackInstance      *StackType
 var InfraHWInstances   *InfraHWInstancesMapType
+var Environment        = DefaultEnvironment
+var CloudNetworks      = make(map[string]*NetworkType) // network layouts of the cloud configs, by cloud
+
+// LookupInfraHW finds the infra settings an app refers to, across all the clouds
+func LookupInfraHW(infraName string) *InfraHwType {
+	_, infraHW := lookupInfraCloud(infraName)
+	return infraHW
+}
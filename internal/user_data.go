@@ -0,0 +1,165 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// the boot script of apps without user_data
+const defaultBootScript = `#!/bin/bash
+	echo "Hello, from VMGR!" > index.html
+	nohup python -m SimpleHTTPServer 80 &`
+
+// UserDataValues are the values a user_data template is rendered with, e.g.
+//
+//	#!/bin/bash
+//	echo "{{ .Facts.role }} {{ .Host }} of {{ .Stack }}/{{ .Env }}" > /etc/motd
+//	echo "DB_HOST={{ index .PrivateIPs "db1-0" }}" >> /etc/environment
+type UserDataValues struct {
+	Stack      string
+	Env        string
+	App        string
+	Host       string // <app>-<index>
+	Index      int
+	Facts      map[string]string
+	Self       map[string]string // the host's own outputs known before it boots: username, privateIp, and fqdn or ip if allocated up front
+	PrivateIPs map[string]string // the private IPs of all the hosts of the stack, by host name
+}
+
+// parseUserData reads the user_data template of an app, the default boot script if it has none
+func (appInst *AppInstanceType) parseUserData() (*template.Template, error) {
+	text := defaultBootScript
+	if appInst.UserData != "" {
+		data, err := os.ReadFile(appInst.UserData)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return template.New(filepath.Base(appInst.UserData)).Option("missingkey=error").Parse(text)
+}
+
+// validateUserData checks the user_data template of an app parses, is cloud-init or a script,
+// and renders for every host of the app with placeholder addresses, so a reference to a
+// missing fact or host fails now rather than minutes into the deploy
+func validateUserData(appName string, appInst *AppInstanceType) error {
+	if appInst.UserData == "" {
+		return nil
+	}
+	tmpl, err := appInst.parseUserData()
+	if err != nil {
+		return errors.New("app '" + appName + "' user_data: " + err.Error())
+	}
+	text := tmpl.Root.String()
+	if !strings.HasPrefix(text, "#cloud-config") && !strings.HasPrefix(text, "#!") {
+		return errors.New("app '" + appName + "' user_data must be cloud-init YAML starting with #cloud-config, or a script starting with #!")
+	}
+
+	privateIPs := make(map[string]string)
+	for i, host := range stackHosts() {
+		privateIPs[host.Name] = fmt.Sprintf("10.0.%d.%d", i/250, i%250+4)
+	}
+	for _, host := range appInst.hosts(appName) {
+		self := map[string]string{
+			"username":  vmUsername,
+			"privateIp": privateIPs[host.Name],
+			"ip":        "203.0.113.10",
+			"fqdn":      host.Name + ".example.com",
+		}
+		if _, err := appInst.renderUserData(host, self, privateIPs, false); err != nil {
+			return errors.New("app '" + appName + "' user_data: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// renderUserData renders the user_data of a host. Secret facts are masked when mask is set.
+func (appInst *AppInstanceType) renderUserData(host appHost, self map[string]string, privateIPs map[string]string, mask bool) (string, error) {
+	tmpl, err := appInst.parseUserData()
+	if err != nil {
+		return "", err
+	}
+	facts := appInst.hostFacts(host)
+	if mask {
+		for key, value := range facts {
+			if appInst.IsSecretFact(key) {
+				facts[key] = maskSecret(value)
+			}
+		}
+	}
+	var rendered strings.Builder
+	err = tmpl.Execute(&rendered, UserDataValues{
+		Stack:      StackInstance.Id,
+		Env:        StackInstance.Env,
+		App:        host.App,
+		Host:       host.Name,
+		Index:      host.Index,
+		Facts:      facts,
+		Self:       self,
+		PrivateIPs: privateIPs,
+	})
+	if err != nil {
+		return "", errors.New("render user_data of " + host.Name + ": " + err.Error())
+	}
+	return rendered.String(), nil
+}
+
+// RenderAppUserData renders the user_data of every host of an app, by host name, with
+// secret facts masked. The addresses are read from the outputs of the deployed stack,
+// hosts that are not deployed get placeholders like <app2-1.privateIp>.
+func RenderAppUserData(appName string, outs auto.OutputMap) (map[string]string, error) {
+	appInst, ok := StackInstance.AppInstances[strings.ToLower(appName)]
+	if !ok {
+		return nil, NewError(ValidationError, "render user_data", errors.New("app '"+appName+"' is not in stack "+StackInstance.Id))
+	}
+
+	hostOutput := func(hostName string, key string) string {
+		if hostOuts, ok := outs[hostName].Value.(map[string]interface{}); ok {
+			if value, _ := hostOuts[key].(string); value != "" {
+				return value
+			}
+		}
+		return "<" + hostName + "." + key + ">"
+	}
+	privateIPs := make(map[string]string)
+	for _, host := range stackHosts() {
+		privateIPs[host.Name] = hostOutput(host.Name, "privateIp")
+	}
+
+	rendered := make(map[string]string)
+	for _, host := range appInst.hosts(strings.ToLower(appName)) {
+		self := map[string]string{
+			"username":  hostOutput(host.Name, "username"),
+			"privateIp": privateIPs[host.Name],
+			"ip":        hostOutput(host.Name, "ip"),
+			"fqdn":      hostOutput(host.Name, "fqdn"),
+		}
+		text, err := appInst.renderUserData(host, self, privateIPs, true)
+		if err != nil {
+			return nil, NewError(ValidationError, "render user_data", err)
+		}
+		rendered[host.Name] = text
+	}
+	return rendered, nil
+}
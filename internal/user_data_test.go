@@ -0,0 +1,56 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateUserData(t *testing.T) {
+	dir := t.TempDir()
+	web := &AppInstanceType{Count: 2, Facts: map[string]string{"role": "web"}}
+	db := &AppInstanceType{Count: 1, Facts: map[string]string{}}
+	StackInstance = &StackType{Id: "s1", Env: "dev", AppInstances: map[string]*AppInstanceType{"web": web, "db": db}}
+	defer func() { StackInstance = nil }()
+
+	tests := []struct {
+		template string
+		wantErr  string
+	}{
+		{"#!/bin/sh\necho {{.Facts.role}} {{.Self.fqdn}} {{.Self.privateIp}} {{index .PrivateIPs \"db\"}} {{.Index}}\n", ""},
+		{"#cloud-config\nhostname: {{.Host}}\n", ""},
+		{"#!/bin/sh\necho {{.Facts.rol}}\n", `map has no entry for key "rol"`},
+		{"#!/bin/sh\necho {{.Self.hostname}}\n", `map has no entry for key "hostname"`},
+		{"#!/bin/sh\necho {{.Facts.role\n", "unclosed action"},
+		{"echo hello\n", "must be cloud-init"},
+	}
+	for i, test := range tests {
+		web.UserData = filepath.Join(dir, "user_data")
+		if err := os.WriteFile(web.UserData, []byte(test.template), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := validateUserData("web", web)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("template %d: %v", i, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("template %d: error %v, want %q", i, err, test.wantErr)
+		}
+	}
+}
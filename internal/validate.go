@@ -0,0 +1,131 @@
+/*
+Copyright © 2022 Rajesh Radhakrishnan enthoughts@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ephstack
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ValidateStack checks the parsed stack against the parsed config files before
+// anything is provisioned
+func ValidateStack() error {
+	if StackInstance == nil {
+		return NewError(ValidationError, "validate stack", errors.New("no stack was parsed"))
+	}
+	op := "validate stack " + StackInstance.Id
+	if StackInstance.Id == "" {
+		return NewError(ValidationError, op, errors.New("stack.name is not set"))
+	}
+	if !validLogFormat(LogFormat) {
+		return NewError(ValidationError, op, errLogFormat)
+	}
+	if len(StackInstance.AppInstances) == 0 {
+		return NewError(ValidationError, op, errors.New("stack has no apps"))
+	}
+
+	for _, appName := range sortedAppNames() {
+		appInst := StackInstance.AppInstances[appName]
+		if appInst.Infra == "" {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"' has no infra"))
+		}
+		if clouds := infraClouds(strings.ToLower(appInst.Infra)); len(clouds) > 1 {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"' refers to infra '"+appInst.Infra+"' declared on "+strings.Join(clouds, " and ")+", qualify it as "+clouds[0]+"/"+appInst.Infra))
+		}
+		if LookupInfraHW(appInst.Infra) == nil {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"' refers to unknown infra '"+appInst.Infra+"'"))
+		}
+		// typos in sizes & regions are caught now rather than minutes into the deploy
+		if err := validateCatalog(appInst); err != nil {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"': "+err.Error()))
+		}
+		// the azure VMs are created from the image's URN, with the disks' sizes
+		if cloudName, infraHW := lookupInfraCloud(appInst.Infra); cloudName == "azure" {
+			if _, err := imageReference(infraHW.Image); err != nil {
+				return NewError(ValidationError, op, errors.New("app '"+appName+"': "+infraHW.Sources["image"]+": "+err.Error()))
+			}
+			if _, err := dataDiskArray(appName, infraHW.Disks); err != nil {
+				return NewError(ValidationError, op, errors.New("app '"+appName+"': "+infraHW.Sources["disk"]+": "+err.Error()))
+			}
+		}
+		if appInst.Count < 1 {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"' count must be at least 1, remove the app to have no hosts"))
+		}
+		// the hosts are named <app>-<index>, which must not clash with another app, as
+		// ssh & creds take either
+		for _, host := range appInst.hosts(appName) {
+			if _, clash := StackInstance.AppInstances[host.Name]; clash {
+				return NewError(ValidationError, op, errors.New("host '"+host.Name+"' of app '"+appName+"' clashes with the app of that name"))
+			}
+		}
+	}
+
+	if _, err := stackRegion(); err != nil {
+		return NewError(ValidationError, op, err)
+	}
+
+	network := StackNetwork()
+	if err := network.validate(); err != nil {
+		return NewError(ValidationError, op, err)
+	}
+	for _, appName := range sortedAppNames() {
+		if subnet := StackInstance.AppInstances[appName].Subnet; subnet != "" && !network.hasSubnet(subnet) {
+			return NewError(ValidationError, op, errors.New("app '"+appName+"' refers to unknown subnet '"+subnet+"'"))
+		}
+		if err := validatePorts(appName, StackInstance.AppInstances[appName], network); err != nil {
+			return NewError(ValidationError, op, err)
+		}
+		if err := validatePublicIP(appName, StackInstance.AppInstances[appName]); err != nil {
+			return NewError(ValidationError, op, err)
+		}
+		if err := validateUserData(appName, StackInstance.AppInstances[appName]); err != nil {
+			return NewError(ValidationError, op, err)
+		}
+	}
+	return nil
+}
+
+// azure DNS labels are lower case letters, digits and hyphens, starting with a letter
+var dnsLabelPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// validatePublicIP checks the public IP allocation and DNS label of an app
+func validatePublicIP(appName string, appInst *AppInstanceType) error {
+	switch appInst.PublicIP {
+	case "", PublicIPDynamic, PublicIPStatic:
+	case PublicIPNone:
+		if appInst.DNSLabel != "" {
+			return errors.New("app '" + appName + "' has a dns_label but no public IP")
+		}
+	default:
+		return errors.New("app '" + appName + "' public_ip must be " + PublicIPNone + ", " + PublicIPDynamic + " or " + PublicIPStatic)
+	}
+	if appInst.DNSLabel != "" && !dnsLabelPattern.MatchString(appInst.DNSLabel) {
+		return errors.New("app '" + appName + "' dns_label '" + appInst.DNSLabel + "' must be 3 to 63 lower case letters, digits or hyphens, starting with a letter")
+	}
+	return nil
+}
+
+// sortedAppNames lists the apps of the parsed stack in a stable order
+func sortedAppNames() []string {
+	appNames := make([]string, 0, len(StackInstance.AppInstances))
+	for appName := range StackInstance.AppInstances {
+		appNames = append(appNames, appName)
+	}
+	sort.Strings(appNames)
+	return appNames
+}
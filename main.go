@@ -24,12 +24,10 @@ import (
 )
 
 func main() {
+	// deploy provisions the infrastructure after parsing the stack file
 	cmd.Execute()
 	// debugStackParsePrint()
 
-	// 
-	ephstack.ProvisionInfrastructure()
-
 	// 
 	//ephstack.RunConfigurationMgmt()
 }
@@ -0,0 +1,5 @@
+#!/bin/bash
+# rendered by ephstack for {{ .Host }} of {{ .Stack }}/{{ .Env }}
+echo "{{ .Facts.role }} {{ .Index }} at {{ .Self.privateIp }}" > index.html
+echo "APP_HOST={{ index .PrivateIPs "app1-0" }}" >> /etc/environment
+nohup python3 -m http.server 80 &